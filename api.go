@@ -6,6 +6,7 @@ import (
 	"github.com/apid/apid-core/util"
 	"github.com/pkg/errors"
 	"net/http"
+	"net/url"
 	"reflect"
 	"strconv"
 	"strings"
@@ -18,32 +19,114 @@ const (
 	API_ERR_BAD_DATA_MARSHALL
 	API_ERR_BAD_DEBUG_HEADER
 	API_ERR_BLOBSTORE
+	API_ERR_UNAUTHENTICATED
+	API_ERR_UNAUTHORIZED
+	API_ERR_UNKNOWN_SESSION
+	API_ERR_UPLOAD_STAGE
+	API_ERR_TRACE_TOO_LARGE
+	API_ERR_REDACTION
+	API_ERR_MALFORMED_TRACE
+	API_ERR_BAD_FILTER
+	API_ERR_DEAD_LETTERS
+	API_ERR_BAD_CONFIG
+	API_ERR_NOT_READY
+	API_ERR_SESSION_DELETED
+	API_ERR_NO_SUCH_DEAD_LETTER
+	API_ERR_UPLOAD_IN_PROGRESS
+	API_ERR_DEAD_LETTERS_DISABLED
+	API_ERR_REPLAY_IN_PROGRESS
 	blobStoreUri               = "/blobs"
 	configBearerToken          = "apigeesync_bearer_token"
 	configBlobServerBaseURI    = "apigeesync_blob_server_base"
 	maxIdleConnsPerHost        = 50
 	httpTimeout                = time.Minute
 	UPLOAD_TRACESESSION_HEADER = "X-Apigee-Debug-ID"
+	defaultTransactionsLimit   = 100
+	maxTransactionsLimit       = 1000
 )
 
-//InitAPI registers the two trace related endpoints, and starts a goroutine which assists in distributing
-//events (new signals) in support of long polling
+//registerAPI registers the trace related endpoints, and starts a goroutine which assists in distributing events (new
+//signals) in support of long polling.  It runs when the plugin starts, and endpoints which need the trace signals
+//answer that the plugin is not ready until InitAPI is called with the first snapshot.  No endpoint is registered if
+//any two of them conflict
+func (a *apiManager) registerAPI() error {
+	a.registerOnce.Do(func() {
+		routes := a.routes()
+		if err := checkRoutes(routes); err != nil {
+			a.registerErr = errors.Wrap(err, "unable to register endpoints")
+			return
+		}
+		for _, route := range routes {
+			services.API().HandleFunc(route.path, route.handler).Methods(route.method)
+		}
+		go util.DistributeEvents(a.newSignal, a.addSubscriber)
+		log.Debug("API endpoints registered")
+	})
+	return a.registerErr
+}
+
+//InitAPI marks the API ready once the first snapshot was received, releasing the long-polling requests parked until
+//then.  It registers the endpoints too, should that not have happened yet
 func (a *apiManager) InitAPI() {
+	if err := a.registerAPI(); err != nil {
+		log.Errorf("%v", err)
+	}
+	a.readyMux.Lock()
+	defer a.readyMux.Unlock()
 	if a.apiInitialized {
 		return
 	}
-	services.API().HandleFunc(a.signalEndpoint, a.apiGetTraceSignalEndpoint).Methods("GET")
-	services.API().HandleFunc(a.uploadEndpoint, a.apiUploadTraceDataEndpoint).Methods("POST")
 	a.apiInitialized = true
-	go util.DistributeEvents(a.newSignal, a.addSubscriber)
+	if a.ready != nil {
+		close(a.ready)
+	}
 	log.Debug("API endpoints initialized")
 }
 
+//authenticated applies caller authentication to an endpoint, if the apiManager is configured with an authenticator.
+//The authenticator is looked up per request, so that configuration reloads apply to it
+func (a *apiManager) authenticated(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := a.components().auth
+		if auth == nil {
+			handler(w, r)
+			return
+		}
+		auth.authenticated(handler)(w, r)
+	}
+}
+
+//administered restricts an endpoint to operators presenting the admin token.  Like authenticated, the authenticator
+//is looked up per request, and the endpoint is refused to everyone while no admin token is configured
+func (a *apiManager) administered(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := a.components().auth
+		err := errors.New("no caller authentication configured")
+		if auth != nil {
+			err = auth.authenticateAdmin(r)
+		}
+		if err != nil {
+			metrics.inc(metricAuthRejectedUnauthenticated)
+			log.Errorf("rejected unauthenticated %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			writeError(w, r, API_ERR_UNAUTHENTICATED, "admin authentication failed")
+			return
+		}
+		handler(w, r)
+	}
+}
+
 //notifyChange sends an object to the change notification channel used to kick of event distribution
 func (a *apiManager) notifyChange(arg interface{}) {
 	a.newSignal <- arg
 }
 
+//sessionDeleted starts the upload grace period of a trace signal which was just deleted
+func (a *apiManager) sessionDeleted(id string) {
+	if a.sessions != nil {
+		a.sessions.sessionDeleted(id)
+	}
+}
+
 //apiGetTraceSignalEndpoint is the API implementation for retrieving a list of trace sessions initiated via the MGMT API
 func (a *apiManager) apiGetTraceSignalEndpoint(w http.ResponseWriter, r *http.Request) {
 	b := r.URL.Query().Get("block")
@@ -52,18 +135,20 @@ func (a *apiManager) apiGetTraceSignalEndpoint(w http.ResponseWriter, r *http.Re
 		var err error
 		timeout, err = strconv.Atoi(b)
 		if err != nil {
-			writeError(w, http.StatusBadRequest, API_ERR_BAD_BLOCK, "bad block value, must be number of seconds")
+			writeError(w, r, API_ERR_BAD_BLOCK, "bad block value, must be number of seconds")
 			return
 		}
 	}
 	log.Debugf("api timeout: %d", timeout)
 
-	// If-None-Match is a csv of active debug session IDs
-	ifNoneMatch := r.Header.Get("If-None-Match")
+	// If-None-Match identifies the trace signals the client knows about, as the ETag of an earlier response.  In v1 it
+	// may also be the unquoted csv of active debug session IDs
+	version := requestAPIVersion(r)
+	ifNoneMatch := strings.Trim(strings.TrimPrefix(r.Header.Get("If-None-Match"), "W/"), `"`)
 	log.Debugf("If-None-Match: %s", ifNoneMatch)
 
 	if ifNoneMatch == "" {
-		a.sendTraceSignals(nil, w)
+		a.sendTraceSignals(r, nil, w)
 		return
 	}
 
@@ -71,22 +156,29 @@ func (a *apiManager) apiGetTraceSignalEndpoint(w http.ResponseWriter, r *http.Re
 	result, err := a.dbMan.getTraceSignals()
 	if err != nil {
 		log.Errorf("%v", err)
-		writeError(w, http.StatusInternalServerError, API_ERR_DB_ERROR, err.Error())
+		writeError(w, r, API_ERR_DB_ERROR, "unable to read trace signals")
 		return
 	}
 
-	if additionOrDeletionDetected(result, ifNoneMatch) {
-		a.sendTraceSignals(result, w)
+	if version.signalsModified(result, ifNoneMatch) {
+		a.sendTraceSignals(r, result, w)
 		return
 	}
 
+	//answers 304 carry the ETag of the signals they were compared with, sending the signals replaces it
+	w.Header().Set("ETag", signalsETag(version.signalsVersion(result.Signals)))
 	if timeout == 0 {
 		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
 	log.Debug("Blocking request... Waiting for new trace signals.")
-	util.LongPolling(w, time.Duration(timeout)*time.Second, a.addSubscriber, a.sendTraceSignals, a.LongPollTimeoutHandler)
+	metrics.add(metricBlockedSubscribers, 1)
+	defer metrics.add(metricBlockedSubscribers, -1)
+	util.LongPolling(w, time.Duration(timeout)*time.Second, a.addSubscriber,
+		func(signals interface{}, w http.ResponseWriter) {
+			a.sendTraceSignals(r, signals, w)
+		}, a.LongPollTimeoutHandler)
 
 }
 
@@ -98,73 +190,399 @@ func (a *apiManager) LongPollTimeoutHandler(w http.ResponseWriter) {
 }
 
 //sendTraceSignals uses the database manager to retrieve the list of signals and write them to the response as JSON
-func (a *apiManager) sendTraceSignals(signals interface{}, w http.ResponseWriter) {
+func (a *apiManager) sendTraceSignals(r *http.Request, signals interface{}, w http.ResponseWriter) {
 
-	var result getTraceSignalsResult
-	if signals != nil {
-		result = signals.(getTraceSignalsResult)
-	} else {
+	//change notifications carry no signals, the listener merely sends true
+	result, ok := signals.(getTraceSignalsResult)
+	if !ok {
 		var err error
 		result, err = a.dbMan.getTraceSignals()
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, API_ERR_DB_ERROR, err.Error())
+			log.Errorf("%v", err)
+			writeError(w, r, API_ERR_DB_ERROR, "unable to read trace signals")
 			return
 		}
 	}
 
-	b, err := json.Marshal(result)
+	version := requestAPIVersion(r)
+	b, err := json.Marshal(version.signalsBody(result))
 	if err != nil {
 		log.Errorf("unable to marshal trace signals: %v", err)
-		writeError(w, http.StatusInternalServerError, API_ERR_BAD_DATA_MARSHALL, err.Error())
+		writeError(w, r, API_ERR_BAD_DATA_MARSHALL, "unable to encode response")
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", signalsETag(version.signalsVersion(result.Signals)))
 	w.Write(b)
 }
 
+//signalsETag quotes the version of the trace signals as an entity tag
+func signalsETag(version string) string {
+	return `"` + version + `"`
+}
+
 //apiUploadTraceDataEndpoint is the API Implementation for uploading the trace data for a single completed request
 func (a *apiManager) apiUploadTraceDataEndpoint(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
-	sessionId := r.Header.Get(UPLOAD_TRACESESSION_HEADER)
-	blobMetadata, err := createBlobMetadataFromSessionId(sessionId)
+	sessionId, err := parseDebugSessionId(r.Header.Get(UPLOAD_TRACESESSION_HEADER))
 	if err != nil {
-		writeError(w, http.StatusBadRequest, API_ERR_BAD_DEBUG_HEADER, err.Error())
+		writeError(w, r, API_ERR_BAD_DEBUG_HEADER, err.Error())
+		return
+	}
+	blobMetadata := createBlobMetadata(sessionId, r.Header)
+
+	c := a.components()
+	if c.auth != nil && !c.auth.authorizeUpload(w, r, sessionId.Organization, sessionId.Environment) {
+		return
+	}
+
+	if !a.validateSession(w, r, sessionId) {
 		return
 	}
 
-	s, err := a.bsClient.getSignedURL(blobMetadata, config.GetString(configBlobServerBaseURI))
+	upload := &traceUpload{
+		sessionId: sessionId,
+		metadata:  blobMetadata,
+		body:      r.Body,
+	}
+	defer upload.close()
+
+	if !admitUpload(w, r, c.limiter, sessionId) {
+		return
+	}
+
+	var key string
+	if c.idempotency != nil {
+		if key, err = c.idempotency.key(upload, r.Header); err != nil {
+			writeUploadError(w, r, upload, err)
+			return
+		}
+	}
+	if key != "" {
+		result, owner, err := c.idempotency.begin(r.Context(), sessionId.Raw, key)
+		if err != nil {
+			log.Errorf("gave up waiting for the first upload %s for %s: %v", key, sessionId.Raw, err)
+			writeError(w, r, API_ERR_UPLOAD_IN_PROGRESS, "an upload of the same transaction is still in progress")
+			return
+		}
+		if !owner {
+			log.Debugf("replaying result of duplicate upload %s for %s", key, sessionId.Raw)
+			metrics.inc(metricUploadsDeduplicated)
+			result.replay(w)
+			return
+		}
+		rec := &recordingResponseWriter{ResponseWriter: w}
+		defer c.idempotency.finish(sessionId.Raw, key, result, rec)
+		w = rec
+	}
+
+	if !runUploadStages(w, r, c.stages, upload) {
+		return
+	}
+
+	//the trace is kept in memory when failed uploads go to the dead-letter store, which needs the payload sent
+	var payload []byte
+	if c.deadLetters != nil {
+		if payload, err = upload.bufferBody(); err != nil {
+			writeUploadError(w, r, upload, err)
+			return
+		}
+	}
+
+	stored, size, err := a.fanOut(c, upload)
+	if err != nil {
+		//traces found malformed while streaming are rejected, and would be rejected again on replay
+		if ue, ok := err.(*uploadError); c.deadLetters != nil && !(ok && ue.code == API_ERR_MALFORMED_TRACE) {
+			if entry, derr := c.deadLetters.add(upload, payload, err); derr != nil {
+				log.Errorf("unable to keep failed upload of %s as dead letter: %v", sessionId.Raw, derr)
+			} else {
+				log.Infof("kept failed upload of %s as dead letter %s", sessionId.Raw, entry.Id)
+			}
+		}
+		writeUploadError(w, r, upload, err)
+		return
+	}
+	defer stored.close()
+	blob := stored.blob
+	log.Infof("stored trace of %s (%d bytes) as blob %s at %s", sessionId.Raw, size, blob.Id, blob.Self)
+	a.indexUpload(upload, blob, size)
+	writeUploadResult(w, stored.res.StatusCode, blob)
+}
+
+//writeUploadResult tells the MP where its trace was stored, with the status code returned by the storage service
+func writeUploadResult(w http.ResponseWriter, status int, blob *blobServerResponse) {
+	b, err := json.Marshal(uploadTraceResult{
+		BlobId:          blob.Id,
+		Self:            blob.Self,
+		Store:           blob.Store,
+		SignedUrlExpiry: blob.SignedUrlExpiryTimestamp,
+	})
+	if err != nil {
+		log.Errorf("unable to marshal upload result: %v", err)
+		w.WriteHeader(status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+//indexUpload records an uploaded trace in the trace index.  The trace is already stored, so a failure to index it
+//is logged rather than reported to the MP
+func (a *apiManager) indexUpload(upload *traceUpload, blob *blobServerResponse, size int64) {
+	if a.dbMan == nil {
+		return
+	}
+	record := &traceRecord{
+		SessionId:  upload.sessionId.Raw,
+		BlobId:     blob.Id,
+		Timestamp:  time.Now().UTC(),
+		Size:       size,
+		URI:        upload.metadata.URI,
+		StatusCode: upload.metadata.StatusCode,
+		BlobSelf:   blob.Self,
+		BlobStore:  blob.Store,
+	}
+	if err := a.dbMan.insertTraceRecord(record); err != nil {
+		log.Errorf("unable to index trace %s for %s: %v", blob.Id, upload.sessionId.Raw, err)
+	}
+}
+
+//apiGetTraceTransactionsEndpoint is the API implementation for listing the traces uploaded for a debug session
+func (a *apiManager) apiGetTraceTransactionsEndpoint(w http.ResponseWriter, r *http.Request) {
+	sessionId, err := parseDebugSessionId(services.API().Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, API_ERR_BAD_DEBUG_HEADER, err.Error())
+		return
+	}
+	if auth := a.components().auth; auth != nil &&
+		!auth.authorizeUpload(w, r, sessionId.Organization, sessionId.Environment) {
+		return
+	}
+
+	filter, err := parseTraceRecordFilter(sessionId.Raw, r.URL.Query())
+	if err != nil {
+		writeError(w, r, API_ERR_BAD_FILTER, err.Error())
+		return
+	}
+	//fetch one more record than asked for, to find out whether there is a next page
+	filter.Limit++
+	records, err := a.dbMan.getTraceRecords(filter)
 	if err != nil {
-		err = errors.Wrap(err, "Unable to fetch signed upload URL")
 		log.Errorf("%v", err)
-		writeError(w, http.StatusInternalServerError, API_ERR_BLOBSTORE, "Unable fetch signed upload URL")
-	} else {
-		res, err := a.bsClient.uploadToBlobstore(s, r.Body)
-		if err != nil {
-			err = errors.Wrap(err, "Unable to use signed url for upload")
-			log.Errorf("%v", err)
-			writeError(w, http.StatusInternalServerError, API_ERR_BLOBSTORE, "Unable to use signed url for upload")
+		writeError(w, r, API_ERR_DB_ERROR, "unable to query trace index")
+		return
+	}
+
+	result := getTraceRecordsResult{Transactions: records}
+	if len(records) == filter.Limit {
+		result.Transactions = records[:len(records)-1]
+		next := filter.Offset + len(result.Transactions)
+		result.Next = &next
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		log.Errorf("unable to marshal trace records: %v", err)
+		writeError(w, r, API_ERR_BAD_DATA_MARSHALL, "unable to encode response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+//parseTraceRecordFilter reads the paging and filter query parameters of the transactions listing.  status accepts
+//either an exact code or a class such as 5xx, and from and to accept the same formats as X-Apigee-Transaction-Time
+func parseTraceRecordFilter(sessionId string, query url.Values) (filter traceRecordFilter, err error) {
+	filter = traceRecordFilter{SessionId: sessionId, Limit: defaultTransactionsLimit, URI: query.Get("uri")}
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit < 1 || filter.Limit > maxTransactionsLimit {
+			return filter, fmt.Errorf("bad limit value, must be between 1 and %d", maxTransactionsLimit)
+		}
+	}
+	if offset := query.Get("offset"); offset != "" {
+		if filter.Offset, err = strconv.Atoi(offset); err != nil || filter.Offset < 0 {
+			return filter, errors.New("bad offset value, must be a non negative number")
+		}
+	}
+	if status := strings.ToLower(query.Get("status")); status != "" {
+		if len(status) == 3 && strings.HasSuffix(status, "xx") && status[0] >= '1' && status[0] <= '5' {
+			filter.MinStatusCode = int(status[0]-'0') * 100
+			filter.MaxStatusCode = filter.MinStatusCode + 99
+		} else if code, err := strconv.Atoi(status); err == nil {
+			filter.MinStatusCode, filter.MaxStatusCode = code, code
 		} else {
-			w.WriteHeader(res.StatusCode)
+			return filter, errors.New("bad status value, must be a status code or a class such as 5xx")
+		}
+	}
+	if from := query.Get("from"); from != "" {
+		if filter.From, err = parseTransactionTime(from); err != nil {
+			return filter, errors.Wrap(err, "bad from value")
+		}
+	}
+	if to := query.Get("to"); to != "" {
+		if filter.To, err = parseTransactionTime(to); err != nil {
+			return filter, errors.Wrap(err, "bad to value")
+		}
+	}
+	return filter, nil
+}
+
+//admitUpload applies sampling and rate limits, acknowledging dropped uploads with 202 Accepted so that the MP does
+//not retry them
+func admitUpload(w http.ResponseWriter, r *http.Request, limiter *uploadLimiter, sessionId *debugSessionId) bool {
+	if limiter == nil {
+		return true
+	}
+	reason, err := limiter.admit(sessionId)
+	if err != nil {
+		log.Errorf("unable to apply upload limits to debug session %s: %v", sessionId.Raw, err)
+		writeError(w, r, API_ERR_DB_ERROR, "unable to apply upload limits")
+		return false
+	}
+	if reason == "" {
+		return true
+	}
+	log.Debugf("dropping upload for debug session %s: %s", sessionId.Raw, reason)
+	b, _ := json.Marshal(uploadDroppedResult{Dropped: reason})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(b)
+	return false
+}
+
+//apiGetTraceSessionEndpoint is the API implementation describing a debug session, including how many of its uploads
+//were stored or dropped
+func (a *apiManager) apiGetTraceSessionEndpoint(w http.ResponseWriter, r *http.Request) {
+	sessionId, err := parseDebugSessionId(services.API().Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, API_ERR_BAD_DEBUG_HEADER, err.Error())
+		return
+	}
+	c := a.components()
+	if c.auth != nil && !c.auth.authorizeUpload(w, r, sessionId.Organization, sessionId.Environment) {
+		return
+	}
+
+	result := sessionStatusResult{SessionId: sessionId.Raw}
+	if a.sessions != nil {
+		state, err := a.sessions.validate(sessionId)
+		if err != nil {
+			log.Errorf("unable to validate debug session %s: %v", sessionId.Raw, err)
+			writeError(w, r, API_ERR_DB_ERROR, "unable to validate debug session")
+			return
+		}
+		result.State = state.String()
+	}
+	if c.limiter != nil {
+		result.sessionCounts = c.limiter.counts(sessionId)
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		log.Errorf("unable to marshal session status: %v", err)
+		writeError(w, r, API_ERR_BAD_DATA_MARSHALL, "unable to encode response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+//apiGetDeadLettersEndpoint is the API implementation listing the uploads kept in the dead-letter store, optionally
+//only those of the org and env given as query parameters
+func (a *apiManager) apiGetDeadLettersEndpoint(w http.ResponseWriter, r *http.Request) {
+	deadLetters := a.components().deadLetters
+	if deadLetters == nil {
+		writeError(w, r, API_ERR_DEAD_LETTERS_DISABLED, "dead-letter store is not enabled")
+		return
+	}
+	entries, err := deadLetters.list(deadLetterFilterOf(r))
+	if err != nil {
+		log.Errorf("unable to list dead letters: %v", err)
+		writeError(w, r, API_ERR_DEAD_LETTERS, "unable to list dead letters")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, entries)
+}
+
+//apiReplayDeadLettersEndpoint is the API implementation retrying the upload of one dead letter, when the route has
+//an id, or of all of them, optionally only those of the org and env given as query parameters.  A single dead
+//letter is replayed before answering, while replaying all of them goes on in the background, one batch at a time
+func (a *apiManager) apiReplayDeadLettersEndpoint(w http.ResponseWriter, r *http.Request) {
+	c := a.components()
+	if c.deadLetters == nil {
+		writeError(w, r, API_ERR_DEAD_LETTERS_DISABLED, "dead-letter store is not enabled")
+		return
+	}
+
+	if id, ok := services.API().Vars(r)["id"]; ok {
+		result, err := a.replayDeadLetter(c, id)
+		if err != nil {
+			log.Errorf("unable to replay dead letter %s: %v", id, err)
+			result.Error = "unable to read dead letter"
+		} else if !result.Replayed && result.Error == "" {
+			writeError(w, r, API_ERR_NO_SUCH_DEAD_LETTER, "no such dead letter: "+id)
+			return
 		}
+		writeJSON(w, r, http.StatusOK, []deadLetterReplayResult{result})
+		return
+	}
+
+	if !c.deadLetters.startBatch() {
+		writeError(w, r, API_ERR_REPLAY_IN_PROGRESS, "dead letters are already being replayed")
+		return
 	}
+	entries, err := c.deadLetters.list(deadLetterFilterOf(r))
+	if err != nil {
+		c.deadLetters.endBatch()
+		log.Errorf("unable to list dead letters: %v", err)
+		writeError(w, r, API_ERR_DEAD_LETTERS, "unable to list dead letters")
+		return
+	}
+	ids := make([]string, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.Id
+	}
+	go a.replayDeadLetters(c, ids)
+	writeJSON(w, r, http.StatusAccepted, deadLetterBatchResult{Queued: len(ids)})
 }
 
-//writeError writes an error to the HTTP response, providing an error code which can be correlated with the enum
-//at the top of this file, and a reason which is typically the output of an error's Error() method
-func writeError(w http.ResponseWriter, status int, code int, reason string) {
+//writeJSON writes a value to the response as JSON
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, value interface{}) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		log.Errorf("unable to marshal response: %v", err)
+		writeError(w, r, API_ERR_BAD_DATA_MARSHALL, "unable to encode response")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
-	e := errorResponse{
-		ErrorCode: code,
-		Reason:    reason,
+	w.Write(b)
+}
+
+//validateSession rejects uploads for debug sessions which are not active, unless the session was deleted recently
+//enough that the upload may belong to a transaction which was in flight at the time
+func (a *apiManager) validateSession(w http.ResponseWriter, r *http.Request, sessionId *debugSessionId) bool {
+	if a.sessions == nil {
+		return true
 	}
-	bytes, err := json.Marshal(e)
+	state, err := a.sessions.validate(sessionId)
 	if err != nil {
-		log.Errorf("unable to marshal errorResponse: %v", err)
-	} else {
-		w.Write(bytes)
+		log.Errorf("unable to validate debug session %s: %v", sessionId.Raw, err)
+		writeError(w, r, API_ERR_DB_ERROR, "unable to validate debug session")
+		return false
 	}
-	log.Debugf("sending %d error to client: %s", status, reason)
+	switch state {
+	case sessionActive:
+		return true
+	case sessionInGracePeriod:
+		log.Debugf("accepting upload for recently deleted debug session %s", sessionId.Raw)
+		return true
+	case sessionDeleted:
+		writeError(w, r, API_ERR_SESSION_DELETED, "debug session has been deleted: "+sessionId.Raw)
+	default:
+		writeError(w, r, API_ERR_UNKNOWN_SESSION, "no active debug session: "+sessionId.Raw)
+	}
+	return false
 }
 
 //additionOrDeletionDetected compares what trace sessions are currently active on an MP and the actual state
@@ -188,20 +606,3 @@ func additionOrDeletionDetected(result getTraceSignalsResult, ifNoneMatch string
 	}
 	return !reflect.DeepEqual(clientTraceSessionExistence, apidTraceSessionExistence)
 }
-
-//createBlobMetadataFromSessionId parses the canonical sessionId, which is an MP internal format, into a useable data
-//structure for interacting with the blob creation API of the blobstore service
-func createBlobMetadataFromSessionId(sessionId string) (blobCreationMetadata, error) {
-	blobMetadata := blobCreationMetadata{}
-	if sessionId != "" {
-		sessionIdComponents := strings.Split(sessionId, "__")
-		if len(strings.Split(sessionId, "__")) == 5 {
-			blobMetadata.Customer = sessionIdComponents[0]
-			blobMetadata.Organization = sessionIdComponents[0]
-			blobMetadata.Environment = sessionIdComponents[1]
-			blobMetadata.Tags = []string{sessionIdComponents[4], sessionId}
-			return blobMetadata, nil
-		}
-	}
-	return blobMetadata, fmt.Errorf("Bad value for required header X-Apigee-Debug-ID: %s", sessionId)
-}
@@ -75,7 +75,7 @@ var _ = Describe("API Implementation", func() {
 			signals := &getTraceSignalsResult{}
 			err := json.Unmarshal(res.Bytes(), signals)
 			Expect(err).To(Succeed())
-			Expect(signals.Err).To(Succeed())
+			Expect(signals.Error).To(BeNil())
 			Expect(signals.Signals).ToNot(BeNil())
 			for index, signal := range signals.Signals {
 				Expect(signal.Id).To(Equal(strconv.Itoa(index)))
@@ -99,7 +99,7 @@ var _ = Describe("API Implementation", func() {
 			signals := &getTraceSignalsResult{}
 			err = json.Unmarshal(res.Bytes(), signals)
 			Expect(err).To(Succeed())
-			Expect(signals.Err).To(Succeed())
+			Expect(signals.Error).To(BeNil())
 			Expect(signals.Signals).ToNot(BeNil())
 			Expect(len(signals.Signals)).To(Equal(4))
 			for index, signal := range signals.Signals {
@@ -123,7 +123,7 @@ var _ = Describe("API Implementation", func() {
 			signals := &getTraceSignalsResult{}
 			err := json.Unmarshal(res.Bytes(), signals)
 			Expect(err).To(Succeed())
-			Expect(signals.Err).To(Succeed())
+			Expect(signals.Error).To(BeNil())
 			Expect(signals.Signals).ToNot(BeNil())
 			Expect(len(signals.Signals)).To(Equal(5))
 			for index, signal := range signals.Signals {
@@ -187,7 +187,7 @@ var _ = Describe("API Implementation", func() {
 			signals := &getTraceSignalsResult{}
 			err = json.Unmarshal(res.Bytes(), signals)
 			Expect(err).To(Succeed())
-			Expect(signals.Err).To(Succeed())
+			Expect(signals.Error).To(BeNil())
 			Expect(signals.Signals).ToNot(BeNil())
 			Expect(len(signals.Signals)).To(Equal(6))
 			for index, signal := range signals.Signals {
@@ -229,7 +229,7 @@ var _ = Describe("API Implementation", func() {
 			apiMan := apiManager{
 				bsClient: &mockBsClient,
 			}
-			mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), config.GetString(configBlobServerBaseURI)).Return("", errors.New("mock bsClient err: can't get url"))
+			mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), defaultBlobServerRoute()).Return((*blobServerResponse)(nil), errors.New("mock bsClient err: can't get url"))
 			apiMan.apiUploadTraceDataEndpoint(w, r)
 			Expect(w.Code).To(Equal(500))
 
@@ -243,8 +243,8 @@ var _ = Describe("API Implementation", func() {
 			apiMan := apiManager{
 				bsClient: &mockBsClient,
 			}
-			mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), config.GetString(configBlobServerBaseURI)).Return("testurl", nil)
-			mockBsClient.On("uploadToBlobstore", "testurl", r.Body).Return(&http.Response{}, errors.New("mock bsClient err: can't upload"))
+			mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), defaultBlobServerRoute()).Return(&blobServerResponse{Id: "testblob", SignedUrl: "testurl"}, nil)
+			mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Return(&http.Response{}, errors.New("mock bsClient err: can't upload"))
 
 			apiMan.apiUploadTraceDataEndpoint(w, r)
 			Expect(w.Code).To(Equal(500))
@@ -260,14 +260,43 @@ var _ = Describe("API Implementation", func() {
 			apiMan := apiManager{
 				bsClient: &mockBsClient,
 			}
-			mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), config.GetString(configBlobServerBaseURI)).Return("testurl", nil)
-			mockBsClient.On("uploadToBlobstore", "testurl", r.Body).Return(&http.Response{StatusCode: 200}, nil)
+			mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), defaultBlobServerRoute()).Return(&blobServerResponse{Id: "testblob", SignedUrl: "testurl"}, nil)
+			mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Return(&http.Response{StatusCode: 200}, nil)
 
 			apiMan.apiUploadTraceDataEndpoint(w, r)
 			Expect(w.Code).To(Equal(200))
 
 		})
 
+		It("should tell the MP where the trace was stored", func() {
+			r := httptest.NewRequest("POST", "/uploadTrace", strings.NewReader("a trace"))
+			r.Header.Add(UPLOAD_TRACESESSION_HEADER, "org__env__app__rev__testID")
+			w := httptest.NewRecorder()
+			apiMan := apiManager{
+				bsClient: &mockBsClient,
+			}
+			mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), defaultBlobServerRoute()).Return(&blobServerResponse{
+				Id:                       "testblob",
+				Self:                     "https://blobserver/blobs/testblob",
+				Store:                    "gcs",
+				SignedUrl:                "testurl",
+				SignedUrlExpiryTimestamp: "2026-10-19T11:00:00Z",
+			}, nil)
+			mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Return(&http.Response{StatusCode: 201}, nil)
+
+			apiMan.apiUploadTraceDataEndpoint(w, r)
+			Expect(w.Code).To(Equal(201))
+			Expect(w.Header().Get("Content-Type")).To(Equal("application/json"))
+			var result uploadTraceResult
+			Expect(json.Unmarshal(w.Body.Bytes(), &result)).To(Succeed())
+			Expect(result).To(Equal(uploadTraceResult{
+				BlobId:          "testblob",
+				Self:            "https://blobserver/blobs/testblob",
+				Store:           "gcs",
+				SignedUrlExpiry: "2026-10-19T11:00:00Z",
+			}))
+		})
+
 		It("should copy response from blobstore", func() {
 			r := httptest.NewRequest("POST", "/uploadTrace", nil)
 			r.Header.Add(UPLOAD_TRACESESSION_HEADER, "org__env__app__rev__testID")
@@ -276,8 +305,8 @@ var _ = Describe("API Implementation", func() {
 			apiMan := apiManager{
 				bsClient: &mockBsClient,
 			}
-			mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), config.GetString(configBlobServerBaseURI)).Return("testurl", nil)
-			mockBsClient.On("uploadToBlobstore", "testurl", r.Body).Return(&http.Response{StatusCode: 401}, nil)
+			mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), defaultBlobServerRoute()).Return(&blobServerResponse{Id: "testblob", SignedUrl: "testurl"}, nil)
+			mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Return(&http.Response{StatusCode: 401}, nil)
 
 			apiMan.apiUploadTraceDataEndpoint(w, r)
 			Expect(w.Code).To(Equal(401))
@@ -285,6 +314,94 @@ var _ = Describe("API Implementation", func() {
 
 	})
 
+	Context("Trace transactions API", func() {
+		var mockDbMan *mockDbManager
+		var apiMan *apiManager
+		var routed sync.Once
+		const sessionId = "org__env__app__rev__testID"
+
+		//the route is registered once on the shared router, and dispatches to the apiManager of the running test
+		get := func(path string) *httptest.ResponseRecorder {
+			routed.Do(func() {
+				services.API().Router().HandleFunc(transactionsEndpoint, func(w http.ResponseWriter, r *http.Request) {
+					apiMan.apiGetTraceTransactionsEndpoint(w, r)
+				})
+			})
+			w := httptest.NewRecorder()
+			services.API().Router().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			return w
+		}
+
+		BeforeEach(func() {
+			mockDbMan = &mockDbManager{}
+			apiMan = &apiManager{dbMan: mockDbMan}
+		})
+
+		It("should index uploaded traces", func() {
+			mockBsClient := mockBlobstoreClient{}
+			apiMan.bsClient = &mockBsClient
+			mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), defaultBlobServerRoute()).Return(&blobServerResponse{Id: "testblob", Self: "self", Store: "gcs", SignedUrl: "testurl"}, nil)
+			mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Run(func(args mock.Arguments) {
+				ioutil.ReadAll(args.Get(1).(io.Reader))
+			}).Return(&http.Response{StatusCode: 200}, nil)
+			mockDbMan.On("insertTraceRecord", mock.MatchedBy(func(record *traceRecord) bool {
+				return record.SessionId == sessionId && record.BlobId == "testblob" && record.Size == 7 &&
+					record.StatusCode == 503 && record.BlobSelf == "self" && record.BlobStore == "gcs"
+			})).Return(errors.New("index unavailable"))
+
+			r := httptest.NewRequest("POST", "/uploadtrace", strings.NewReader("a trace"))
+			r.Header.Add(UPLOAD_TRACESESSION_HEADER, sessionId)
+			r.Header.Add(UPLOAD_STATUS_CODE_HEADER, "503")
+			w := httptest.NewRecorder()
+			apiMan.apiUploadTraceDataEndpoint(w, r)
+			Expect(w.Code).To(Equal(200))
+			mockDbMan.AssertExpectations(GinkgoT())
+		})
+
+		It("should list a page of transactions with filters", func() {
+			from := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+			mockDbMan.On("getTraceRecords", traceRecordFilter{
+				SessionId:     sessionId,
+				URI:           "/v1",
+				MinStatusCode: 500,
+				MaxStatusCode: 599,
+				From:          from,
+				Limit:         3,
+				Offset:        4,
+			}).Return([]traceRecord{{BlobId: "a"}, {BlobId: "b"}, {BlobId: "c"}}, nil)
+
+			w := get("/tracesessions/" + sessionId + "/transactions?limit=2&offset=4&status=5xx&uri=/v1&from=2026-10-19T10:00:00Z")
+			Expect(w.Code).To(Equal(200))
+			var result getTraceRecordsResult
+			Expect(json.Unmarshal(w.Body.Bytes(), &result)).To(Succeed())
+			Expect(result.Transactions).To(HaveLen(2))
+			Expect(*result.Next).To(Equal(6))
+		})
+
+		It("should omit the next offset on the last page", func() {
+			mockDbMan.On("getTraceRecords", mock.AnythingOfType("traceRecordFilter")).Return([]traceRecord{{BlobId: "a"}}, nil)
+			w := get("/tracesessions/" + sessionId + "/transactions")
+			Expect(w.Code).To(Equal(200))
+			Expect(w.Body.String()).ToNot(ContainSubstring("next"))
+			mockDbMan.AssertCalled(GinkgoT(), "getTraceRecords", traceRecordFilter{SessionId: sessionId, Limit: defaultTransactionsLimit + 1})
+		})
+
+		It("should reject bad paging and filter values", func() {
+			for _, query := range []string{"limit=0", "limit=abc", "offset=-1", "status=9xx", "status=bad", "from=yesterday"} {
+				w := get("/tracesessions/" + sessionId + "/transactions?" + query)
+				Expect(w.Code).To(Equal(400), query)
+			}
+			w := get("/tracesessions/invalid/transactions")
+			Expect(w.Code).To(Equal(400))
+		})
+
+		It("should return 500 if the index cannot be queried", func() {
+			mockDbMan.On("getTraceRecords", mock.AnythingOfType("traceRecordFilter")).Return([]traceRecord(nil), errors.New("db error"))
+			w := get("/tracesessions/" + sessionId + "/transactions")
+			Expect(w.Code).To(Equal(500))
+		})
+	})
+
 	Context("API Manager Util function tests", func() {
 		It("should detect the deletion of a trace signal", func() {
 			ifNoneMatchHeader := "1,2,7"
@@ -0,0 +1,143 @@
+package apidGatewayTrace
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	problemContentType = "application/problem+json"
+	problemTypePrefix  = "urn:apidgatewaytrace:error:"
+)
+
+//apiErrorType describes one kind of error reported by the API.  Name is the stable string code callers should match
+//on, while the numeric code of the enum in api.go is kept for MPs which already parse it
+type apiErrorType struct {
+	Name      string
+	Title     string
+	Status    int
+	Retryable bool
+}
+
+//apiErrorCatalog maps each error code to how it is reported.  Retryable errors are those a caller may expect to
+//succeed when sending the same request again later
+var apiErrorCatalog = map[int]apiErrorType{
+	API_ERR_BAD_BLOCK:             {"bad_block", "Bad block value", http.StatusBadRequest, false},
+	API_ERR_DB_ERROR:              {"db_error", "Database unavailable", http.StatusInternalServerError, true},
+	API_ERR_BAD_DATA_MARSHALL:     {"marshal_error", "Unable to encode response", http.StatusInternalServerError, false},
+	API_ERR_BAD_DEBUG_HEADER:      {"bad_debug_session", "Bad debug session id", http.StatusBadRequest, false},
+	API_ERR_BLOBSTORE:             {"blobstore_unavailable", "Unable to store trace", http.StatusInternalServerError, true},
+	API_ERR_UNAUTHENTICATED:       {"unauthenticated", "Caller authentication failed", http.StatusUnauthorized, false},
+	API_ERR_UNAUTHORIZED:          {"unauthorized", "Caller not authorized", http.StatusForbidden, false},
+	API_ERR_UNKNOWN_SESSION:       {"unknown_session", "No active debug session", http.StatusNotFound, false},
+	API_ERR_UPLOAD_STAGE:          {"upload_stage_failed", "Unable to process trace", http.StatusInternalServerError, false},
+	API_ERR_TRACE_TOO_LARGE:       {"trace_too_large", "Trace too large", http.StatusRequestEntityTooLarge, false},
+	API_ERR_REDACTION:             {"redaction_failed", "Unable to redact trace", http.StatusUnprocessableEntity, false},
+	API_ERR_MALFORMED_TRACE:       {"malformed_trace", "Malformed trace", http.StatusUnprocessableEntity, false},
+	API_ERR_BAD_FILTER:            {"bad_filter", "Bad transactions filter", http.StatusBadRequest, false},
+	API_ERR_DEAD_LETTERS:          {"dead_letters_unavailable", "Dead-letter store unavailable", http.StatusInternalServerError, true},
+	API_ERR_BAD_CONFIG:            {"bad_config", "Invalid configuration", http.StatusInternalServerError, false},
+	API_ERR_NOT_READY:             {"not_ready", "Trace plugin not ready", http.StatusServiceUnavailable, true},
+	API_ERR_SESSION_DELETED:       {"session_deleted", "Debug session deleted", http.StatusGone, false},
+	API_ERR_NO_SUCH_DEAD_LETTER:   {"dead_letter_not_found", "No such dead letter", http.StatusNotFound, false},
+	API_ERR_UPLOAD_IN_PROGRESS:    {"upload_in_progress", "Upload in progress", http.StatusConflict, true},
+	API_ERR_DEAD_LETTERS_DISABLED: {"dead_letters_disabled", "Dead-letter store not enabled", http.StatusNotFound, false},
+	API_ERR_REPLAY_IN_PROGRESS:    {"replay_in_progress", "Dead-letter replay in progress", http.StatusConflict, true},
+}
+
+//unknownErrorType is reported for codes missing from the catalog
+var unknownErrorType = apiErrorType{"internal_error", "Internal error", http.StatusInternalServerError, false}
+
+//problemDetails is the RFC 7807 representation of an error, extended with the codes of errorResponse
+type problemDetails struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	ErrorCode int    `json:"errorCode"`
+	Retryable bool   `json:"retryable"`
+}
+
+//apiErrorTypeOf returns the catalog entry of an error code
+func apiErrorTypeOf(code int) apiErrorType {
+	if errType, ok := apiErrorCatalog[code]; ok {
+		return errType
+	}
+	return unknownErrorType
+}
+
+//wantsProblemJSON tells whether the caller prefers problem+json over plain JSON, going by the quality values of its
+//Accept header.  Wildcards select plain JSON, the format callers have always received, unless the version of the API
+//only sends problem details
+func wantsProblemJSON(r *http.Request) bool {
+	if r == nil {
+		return false
+	}
+	if requestAPIVersion(r).problemErrors {
+		return true
+	}
+	problemQ, jsonQ := 0.0, 0.0
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case problemContentType:
+			problemQ = q
+		case "application/json":
+			jsonQ = q
+		}
+	}
+	return problemQ > 0 && problemQ >= jsonQ
+}
+
+//writeError writes an error to the HTTP response, with the status of its code in the error catalog.  The detail is
+//shown to the caller, so it must describe what the caller did wrong rather than what failed internally; internal
+//errors are logged by the caller of writeError instead.  A nil request gets the plain JSON format
+func writeError(w http.ResponseWriter, r *http.Request, code int, detail string) {
+	errType := apiErrorTypeOf(code)
+	var body interface{}
+	contentType := "application/json"
+	if wantsProblemJSON(r) {
+		contentType = problemContentType
+		body = problemDetails{
+			Type:      problemTypePrefix + errType.Name,
+			Title:     errType.Title,
+			Status:    errType.Status,
+			Detail:    detail,
+			Instance:  r.URL.Path,
+			Code:      errType.Name,
+			ErrorCode: code,
+			Retryable: errType.Retryable,
+		}
+	} else {
+		body = errorResponse{
+			ErrorCode: code,
+			Reason:    detail,
+			Code:      errType.Name,
+			Retryable: errType.Retryable,
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(errType.Status)
+	bytes, err := json.Marshal(body)
+	if err != nil {
+		log.Errorf("unable to marshal error response: %v", err)
+	} else {
+		w.Write(bytes)
+	}
+	log.Debugf("sending %d error %s to client: %s", errType.Status, errType.Name, detail)
+}
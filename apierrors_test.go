@@ -0,0 +1,85 @@
+package apidGatewayTrace
+
+import (
+	"encoding/json"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("API errors", func() {
+
+	request := func(accept string) *http.Request {
+		r := httptest.NewRequest("GET", signalEndpoint, nil)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		return r
+	}
+
+	It("should describe every error code", func() {
+		names := map[string]bool{}
+		for code := API_ERR_BAD_BLOCK; code <= API_ERR_REPLAY_IN_PROGRESS; code++ {
+			errType, ok := apiErrorCatalog[code]
+			Expect(ok).To(BeTrue(), "code %d", code)
+			Expect(errType.Name).ToNot(BeEmpty())
+			Expect(names).ToNot(HaveKey(errType.Name))
+			names[errType.Name] = true
+		}
+		Expect(apiErrorTypeOf(0)).To(Equal(unknownErrorType))
+	})
+
+	It("should write the plain JSON format by default", func() {
+		for _, accept := range []string{"", "*/*", "application/json", "application/json, application/problem+json;q=0.5"} {
+			w := httptest.NewRecorder()
+			writeError(w, request(accept), API_ERR_NOT_READY, "not yet")
+			Expect(w.Code).To(Equal(http.StatusServiceUnavailable))
+			Expect(w.Header().Get("Content-Type")).To(Equal("application/json"), accept)
+			var resp errorResponse
+			Expect(json.Unmarshal(w.Body.Bytes(), &resp)).To(Succeed())
+			Expect(resp).To(Equal(errorResponse{ErrorCode: API_ERR_NOT_READY, Reason: "not yet", Code: "not_ready", Retryable: true}))
+		}
+
+		w := httptest.NewRecorder()
+		writeError(w, nil, API_ERR_SESSION_DELETED, "gone")
+		Expect(w.Code).To(Equal(http.StatusGone))
+		Expect(w.Header().Get("Content-Type")).To(Equal("application/json"))
+	})
+
+	It("should write problem details when the caller prefers them", func() {
+		for _, accept := range []string{"application/problem+json", "application/json;q=0.5, application/problem+json"} {
+			w := httptest.NewRecorder()
+			writeError(w, request(accept), API_ERR_TRACE_TOO_LARGE, "trace exceeds maximum size of 10 bytes")
+			Expect(w.Code).To(Equal(http.StatusRequestEntityTooLarge))
+			Expect(w.Header().Get("Content-Type")).To(Equal(problemContentType))
+			var problem problemDetails
+			Expect(json.Unmarshal(w.Body.Bytes(), &problem)).To(Succeed())
+			Expect(problem).To(Equal(problemDetails{
+				Type:      "urn:apidgatewaytrace:error:trace_too_large",
+				Title:     "Trace too large",
+				Status:    http.StatusRequestEntityTooLarge,
+				Detail:    "trace exceeds maximum size of 10 bytes",
+				Instance:  signalEndpoint,
+				Code:      "trace_too_large",
+				ErrorCode: API_ERR_TRACE_TOO_LARGE,
+				Retryable: false,
+			}))
+		}
+	})
+
+	It("should not expose internal errors", func() {
+		dbMan := &mockDbManager{}
+		dbMan.On("getTraceSignals").Return(getTraceSignalsResult{}, errors.New("no such table: secret_signals"))
+		apiMan := &apiManager{dbMan: dbMan}
+		w := httptest.NewRecorder()
+		apiMan.sendTraceSignals(request("application/problem+json"), nil, w)
+		Expect(w.Code).To(Equal(http.StatusInternalServerError))
+		Expect(w.Body.String()).ToNot(ContainSubstring("secret"))
+		var problem problemDetails
+		Expect(json.Unmarshal(w.Body.Bytes(), &problem)).To(Succeed())
+		Expect(problem.Code).To(Equal("db_error"))
+		Expect(problem.Retryable).To(BeTrue())
+	})
+})
@@ -0,0 +1,379 @@
+package apidGatewayTrace
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"github.com/apid/apid-core/util"
+	"github.com/pkg/errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	configAuthMode           = "apidgatewaytrace_auth_mode"
+	configAuthSharedSecret   = "apidgatewaytrace_auth_shared_secret"
+	configAuthHMACKeys       = "apidgatewaytrace_auth_hmac_keys"
+	configAuthHMACMaxSkew    = "apidgatewaytrace_auth_hmac_max_skew"
+	configAuthAllowedClients = "apidgatewaytrace_auth_allowed_clients"
+	configAuthClientCAFile   = "apidgatewaytrace_auth_client_ca_file"
+	configAuthScopes         = "apidgatewaytrace_auth_scopes"
+	configAdminToken         = "apidgatewaytrace_admin_token"
+
+	authModeNone         = "none"
+	authModeSharedSecret = "shared_secret"
+	authModeMTLS         = "mtls"
+	authModeHMAC         = "hmac"
+
+	AUTH_TOKEN_HEADER     = "X-Apigee-Trace-Token"
+	AUTH_KEY_ID_HEADER    = "X-Apigee-Trace-Key-ID"
+	AUTH_TIMESTAMP_HEADER = "X-Apigee-Trace-Timestamp"
+	AUTH_NONCE_HEADER     = "X-Apigee-Trace-Nonce"
+	AUTH_SIGNATURE_HEADER = "X-Apigee-Trace-Signature"
+	ADMIN_TOKEN_HEADER    = "X-Apigee-Trace-Admin-Token"
+
+	sharedSecretIdentity  = "shared-secret"
+	anonymousIdentity     = "anonymous"
+	defaultHMACMaxSkew    = 5 * time.Minute
+	authScopeWildcard     = "*"
+	callerIdentityContext = contextKey("callerIdentity")
+)
+
+//contextKey namespaces the values this plugin stores in a request context
+type contextKey string
+
+//callerScope grants a caller identity permission to upload traces for an org/env, any part of which may be "*"
+type callerScope struct {
+	identity     string
+	organization string
+	environment  string
+}
+
+//callerAuthenticator authenticates the MPs calling the plugin's endpoints, and authorizes their uploads against the
+//org/env encoded in the debug session ID.  Operators calling the admin endpoints are authenticated separately, with
+//the admin token, so that MP credentials never grant access to them
+type callerAuthenticator struct {
+	mode           string
+	sharedSecret   string
+	hmacKeys       map[string]string
+	maxSkew        time.Duration
+	allowedClients []string
+	clientCAs      *x509.CertPool
+	clientCAFile   string
+	nonces         *replayCache
+	scopes         []callerScope
+	adminToken     string
+	now            func() time.Time
+}
+
+//replayCache remembers the nonces of signed requests for at least window, so that a captured request cannot be sent
+//again while its timestamp is still accepted.  Nonces are kept in two generations, the older one being dropped as a
+//whole once the newer one is window old, which bounds memory without scanning entries
+type replayCache struct {
+	window   time.Duration
+	mux      sync.Mutex
+	current  map[string]struct{}
+	previous map[string]struct{}
+	rotated  time.Time
+}
+
+//newCallerAuthenticator creates a callerAuthenticator from the plugin configuration, rejecting incomplete settings
+//so that a misconfigured plugin fails closed at startup instead of silently accepting every caller
+func newCallerAuthenticator() (*callerAuthenticator, error) {
+	ca := &callerAuthenticator{
+		mode:           strings.ToLower(config.GetString(configAuthMode)),
+		sharedSecret:   config.GetString(configAuthSharedSecret),
+		hmacKeys:       make(map[string]string),
+		maxSkew:        defaultHMACMaxSkew,
+		allowedClients: splitConfigList(config.GetString(configAuthAllowedClients)),
+		adminToken:     config.GetString(configAdminToken),
+		now:            time.Now,
+	}
+	var err error
+	if ca.mode == "" {
+		ca.mode = authModeNone
+	}
+	if config.IsSet(configAuthHMACMaxSkew) {
+		ca.maxSkew = config.GetDuration(configAuthHMACMaxSkew)
+	}
+	//a nonce must be remembered for as long as the timestamp it was sent with is accepted, on either side of now
+	ca.nonces = newReplayCache(2 * ca.maxSkew)
+
+	for _, entry := range splitConfigList(config.GetString(configAuthHMACKeys)) {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("bad value for %s, expected keyId:secret pairs", configAuthHMACKeys)
+		}
+		ca.hmacKeys[parts[0]] = parts[1]
+	}
+
+	for _, entry := range splitConfigList(config.GetString(configAuthScopes)) {
+		scope, err := parseCallerScope(entry)
+		if err != nil {
+			return nil, err
+		}
+		ca.scopes = append(ca.scopes, scope)
+	}
+
+	switch ca.mode {
+	case authModeNone:
+	case authModeMTLS:
+		ca.clientCAFile = config.GetString(configAuthClientCAFile)
+		if ca.clientCAFile == "" {
+			return nil, fmt.Errorf("%s is required when %s is %s", configAuthClientCAFile, configAuthMode, ca.mode)
+		}
+		if ca.clientCAs, err = loadCertPool(ca.clientCAFile); err != nil {
+			return nil, err
+		}
+	case authModeSharedSecret:
+		if ca.sharedSecret == "" {
+			return nil, fmt.Errorf("%s is required when %s is %s", configAuthSharedSecret, configAuthMode, ca.mode)
+		}
+	case authModeHMAC:
+		if len(ca.hmacKeys) == 0 {
+			return nil, fmt.Errorf("%s is required when %s is %s", configAuthHMACKeys, configAuthMode, ca.mode)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported value for %s: %s", configAuthMode, ca.mode)
+	}
+	return ca, nil
+}
+
+//authSettings is the caller authentication configuration, as reported by the diagnostics endpoint
+type authSettings struct {
+	Mode           string            `json:"mode"`
+	SharedSecret   string            `json:"sharedSecret,omitempty"`
+	HMACKeys       map[string]string `json:"hmacKeys,omitempty"`
+	HMACMaxSkew    string            `json:"hmacMaxSkew"`
+	AllowedClients []string          `json:"allowedClients,omitempty"`
+	ClientCAFile   string            `json:"clientCaFile,omitempty"`
+	Scopes         []string          `json:"scopes,omitempty"`
+	AdminToken     string            `json:"adminToken,omitempty"`
+}
+
+//settings returns the configuration the authenticator was created from
+func (ca *callerAuthenticator) settings() authSettings {
+	settings := authSettings{
+		Mode:           ca.mode,
+		SharedSecret:   ca.sharedSecret,
+		HMACKeys:       make(map[string]string, len(ca.hmacKeys)),
+		HMACMaxSkew:    ca.maxSkew.String(),
+		AllowedClients: ca.allowedClients,
+		ClientCAFile:   ca.clientCAFile,
+		AdminToken:     ca.adminToken,
+	}
+	for keyId, secret := range ca.hmacKeys {
+		settings.HMACKeys[keyId] = secret
+	}
+	for _, scope := range ca.scopes {
+		settings.Scopes = append(settings.Scopes, scope.identity+":"+scope.organization+"/"+scope.environment)
+	}
+	return settings
+}
+
+//parseCallerScope parses an "identity:org/env" scope entry
+func parseCallerScope(entry string) (callerScope, error) {
+	parts := strings.SplitN(entry, ":", 2)
+	if len(parts) == 2 {
+		orgEnv := strings.Split(parts[1], "/")
+		if len(orgEnv) == 2 && parts[0] != "" && orgEnv[0] != "" && orgEnv[1] != "" {
+			return callerScope{identity: parts[0], organization: orgEnv[0], environment: orgEnv[1]}, nil
+		}
+	}
+	return callerScope{}, fmt.Errorf("bad value %s for %s, expected identity:org/env", entry, configAuthScopes)
+}
+
+//authenticate establishes the identity of the caller of a request according to the configured mode
+func (ca *callerAuthenticator) authenticate(r *http.Request) (string, error) {
+	switch ca.mode {
+	case authModeSharedSecret:
+		token := r.Header.Get(AUTH_TOKEN_HEADER)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(ca.sharedSecret)) != 1 {
+			return "", errors.New("missing or invalid shared secret")
+		}
+		return sharedSecretIdentity, nil
+	case authModeMTLS:
+		identity, err := ca.verifyClientCertificate(r)
+		if err != nil {
+			return "", err
+		}
+		if len(ca.allowedClients) > 0 && !util.Contains(ca.allowedClients, identity) {
+			return "", fmt.Errorf("client certificate %s is not allowed", identity)
+		}
+		return identity, nil
+	case authModeHMAC:
+		return ca.verifySignature(r)
+	}
+	return anonymousIdentity, nil
+}
+
+//verifyClientCertificate checks the client certificate of a request against the configured CA bundle, returning its
+//common name.  The apid listener does not verify client certificates, nor even request them unless its TLS
+//configuration sets ClientAuth, so the chain is verified here rather than trusting whatever certificate was presented
+func (ca *callerAuthenticator) verifyClientCertificate(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", errors.New("no client certificate presented")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range r.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	cert := r.TLS.PeerCertificates[0]
+	_, err := cert.Verify(x509.VerifyOptions{
+		Roots:         ca.clientCAs,
+		Intermediates: intermediates,
+		CurrentTime:   ca.now(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "client certificate %s not verified", cert.Subject.CommonName)
+	}
+	return cert.Subject.CommonName, nil
+}
+
+//verifySignature checks the HMAC-SHA256 request signature.  The body is not signed so that uploads can be streamed,
+//but the debug session header, which decides where the body is stored, is covered by the signature.  Each signed
+//request carries a nonce, which is rejected if it was seen before within the allowed clock skew
+func (ca *callerAuthenticator) verifySignature(r *http.Request) (string, error) {
+	keyId := r.Header.Get(AUTH_KEY_ID_HEADER)
+	key, ok := ca.hmacKeys[keyId]
+	if !ok {
+		return "", fmt.Errorf("unknown signing key id: %s", keyId)
+	}
+
+	timestamp := r.Header.Get(AUTH_TIMESTAMP_HEADER)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("bad value for %s: %s", AUTH_TIMESTAMP_HEADER, timestamp)
+	}
+	skew := ca.now().Sub(time.Unix(seconds, 0))
+	if skew > ca.maxSkew || skew < -ca.maxSkew {
+		return "", fmt.Errorf("request timestamp %s outside allowed skew of %v", timestamp, ca.maxSkew)
+	}
+
+	nonce := r.Header.Get(AUTH_NONCE_HEADER)
+	if nonce == "" {
+		return "", fmt.Errorf("missing %s", AUTH_NONCE_HEADER)
+	}
+
+	expected := signRequest(key, r.Method, r.URL.Path, timestamp, nonce, r.Header.Get(UPLOAD_TRACESESSION_HEADER))
+	signature, err := hex.DecodeString(r.Header.Get(AUTH_SIGNATURE_HEADER))
+	if err != nil || !hmac.Equal(signature, expected) {
+		return "", errors.New("invalid request signature")
+	}
+	//only requests with a valid signature are remembered, so that unsigned requests cannot burn the nonces of an MP
+	if ca.nonces.seen(keyId+"\n"+nonce, ca.now()) {
+		return "", fmt.Errorf("replayed request with nonce %s", nonce)
+	}
+	return keyId, nil
+}
+
+//signRequest computes the HMAC-SHA256 signature an MP must send for a request
+func signRequest(key, method, path, timestamp, nonce, sessionId string) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(strings.Join([]string{method, path, timestamp, nonce, sessionId}, "\n")))
+	return mac.Sum(nil)
+}
+
+//newReplayCache creates an empty replayCache
+func newReplayCache(window time.Duration) *replayCache {
+	return &replayCache{
+		window:   window,
+		current:  make(map[string]struct{}),
+		previous: make(map[string]struct{}),
+	}
+}
+
+//resize changes the window of the cache, keeping the nonces already recorded
+func (rc *replayCache) resize(window time.Duration) {
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+	rc.window = window
+}
+
+//seen records a nonce, reporting whether it was already recorded within the window
+func (rc *replayCache) seen(nonce string, now time.Time) bool {
+	rc.mux.Lock()
+	defer rc.mux.Unlock()
+	if now.Sub(rc.rotated) >= rc.window {
+		rc.previous, rc.current = rc.current, make(map[string]struct{})
+		rc.rotated = now
+	}
+	if _, ok := rc.current[nonce]; ok {
+		return true
+	}
+	if _, ok := rc.previous[nonce]; ok {
+		return true
+	}
+	rc.current[nonce] = struct{}{}
+	return false
+}
+
+//authorize reports whether identity may upload traces for org and env.  With no scopes configured every
+//authenticated caller is authorized
+func (ca *callerAuthenticator) authorize(identity, org, env string) bool {
+	if len(ca.scopes) == 0 {
+		return true
+	}
+	for _, scope := range ca.scopes {
+		if scopeMatches(scope.identity, identity) &&
+			scopeMatches(scope.organization, org) &&
+			scopeMatches(scope.environment, env) {
+			return true
+		}
+	}
+	return false
+}
+
+//authenticated wraps a handler so that it only runs for authenticated callers, whose identity is made available
+//to the handler through the request context
+func (ca *callerAuthenticator) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, err := ca.authenticate(r)
+		if err != nil {
+			metrics.inc(metricAuthRejectedUnauthenticated)
+			log.Errorf("rejected unauthenticated %s %s from %s: %v", r.Method, r.URL.Path, r.RemoteAddr, err)
+			writeError(w, r, API_ERR_UNAUTHENTICATED, "caller authentication failed")
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), callerIdentityContext, identity)))
+	}
+}
+
+//authenticateAdmin checks the admin token of a request.  Without a configured admin token the admin endpoints are
+//disabled, whatever the MP authentication mode
+func (ca *callerAuthenticator) authenticateAdmin(r *http.Request) error {
+	if ca.adminToken == "" {
+		return fmt.Errorf("admin endpoints are disabled, %s is not set", configAdminToken)
+	}
+	token := r.Header.Get(ADMIN_TOKEN_HEADER)
+	if subtle.ConstantTimeCompare([]byte(token), []byte(ca.adminToken)) != 1 {
+		return errors.New("missing or invalid admin token")
+	}
+	return nil
+}
+
+//authorizeUpload checks that the caller of an upload request may write traces for the org/env of its debug session,
+//writing a 403 to the client if not
+func (ca *callerAuthenticator) authorizeUpload(w http.ResponseWriter, r *http.Request, org, env string) bool {
+	identity, _ := r.Context().Value(callerIdentityContext).(string)
+	if ca.authorize(identity, org, env) {
+		return true
+	}
+	metrics.inc(metricAuthRejectedUnauthorized)
+	log.Errorf("rejected upload from %s (%s) for org %s env %s: not authorized", identity, r.RemoteAddr, org, env)
+	writeError(w, r, API_ERR_UNAUTHORIZED,
+		fmt.Sprintf("caller is not authorized to upload traces for %s/%s", org, env))
+	return false
+}
+
+func scopeMatches(pattern, value string) bool {
+	return pattern == authScopeWildcard || pattern == value
+}
@@ -0,0 +1,257 @@
+package apidGatewayTrace
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+//newTestCertificate creates a certificate for commonName, signed by parent or self-signed when parent is nil
+func newTestCertificate(commonName string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).To(Succeed())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	Expect(err).To(Succeed())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).To(Succeed())
+	return cert, key
+}
+
+var _ = Describe("Caller authentication", func() {
+
+	AfterEach(func() {
+		for _, key := range []string{configAuthMode, configAuthSharedSecret, configAuthHMACKeys,
+			configAuthAllowedClients, configAuthClientCAFile, configAuthScopes} {
+			config.Set(key, "")
+		}
+	})
+
+	Context("newCallerAuthenticator", func() {
+		It("should default to no authentication", func() {
+			ca, err := newCallerAuthenticator()
+			Expect(err).To(Succeed())
+			Expect(ca.mode).To(Equal(authModeNone))
+			identity, err := ca.authenticate(httptest.NewRequest("GET", "/tracesignals", nil))
+			Expect(err).To(Succeed())
+			Expect(identity).To(Equal(anonymousIdentity))
+		})
+
+		It("should reject incomplete configuration", func() {
+			config.Set(configAuthMode, "shared_secret")
+			_, err := newCallerAuthenticator()
+			Expect(err).ToNot(Succeed())
+
+			config.Set(configAuthMode, "hmac")
+			_, err = newCallerAuthenticator()
+			Expect(err).ToNot(Succeed())
+
+			config.Set(configAuthMode, "mtls")
+			_, err = newCallerAuthenticator()
+			Expect(err).ToNot(Succeed())
+
+			config.Set(configAuthMode, "kerberos")
+			_, err = newCallerAuthenticator()
+			Expect(err).ToNot(Succeed())
+
+			config.Set(configAuthMode, "none")
+			config.Set(configAuthScopes, "mp1:org")
+			_, err = newCallerAuthenticator()
+			Expect(err).ToNot(Succeed())
+		})
+	})
+
+	Context("authenticate", func() {
+		It("should check the shared secret", func() {
+			config.Set(configAuthMode, "shared_secret")
+			config.Set(configAuthSharedSecret, "s3cret")
+			ca, err := newCallerAuthenticator()
+			Expect(err).To(Succeed())
+
+			r := httptest.NewRequest("GET", "/tracesignals", nil)
+			_, err = ca.authenticate(r)
+			Expect(err).ToNot(Succeed())
+			r.Header.Set(AUTH_TOKEN_HEADER, "wrong")
+			_, err = ca.authenticate(r)
+			Expect(err).ToNot(Succeed())
+			r.Header.Set(AUTH_TOKEN_HEADER, "s3cret")
+			identity, err := ca.authenticate(r)
+			Expect(err).To(Succeed())
+			Expect(identity).To(Equal(sharedSecretIdentity))
+		})
+
+		It("should use the common name of verified client certificates as identity", func() {
+			caCert, caKey := newTestCertificate("trace-ca", nil, nil)
+			dir, err := ioutil.TempDir(testTempDirBase, "mtls")
+			Expect(err).To(Succeed())
+			caFile := filepath.Join(dir, "ca.pem")
+			Expect(ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}), 0600)).To(Succeed())
+
+			config.Set(configAuthMode, "mtls")
+			config.Set(configAuthClientCAFile, caFile)
+			config.Set(configAuthAllowedClients, "mp-1, mp-2")
+			ca, err := newCallerAuthenticator()
+			Expect(err).To(Succeed())
+			authenticate := func(certs ...*x509.Certificate) (string, error) {
+				r := httptest.NewRequest("GET", "/tracesignals", nil)
+				if len(certs) > 0 {
+					r.TLS = &tls.ConnectionState{PeerCertificates: certs}
+				}
+				return ca.authenticate(r)
+			}
+
+			_, err = authenticate()
+			Expect(err).ToNot(Succeed())
+
+			mp2, _ := newTestCertificate("mp-2", caCert, caKey)
+			identity, err := authenticate(mp2)
+			Expect(err).To(Succeed())
+			Expect(identity).To(Equal("mp-2"))
+
+			mp3, _ := newTestCertificate("mp-3", caCert, caKey)
+			_, err = authenticate(mp3)
+			Expect(err).ToNot(Succeed())
+
+			//a certificate naming an allowed client, but not issued by the configured CA
+			selfSigned, _ := newTestCertificate("mp-1", nil, nil)
+			_, err = authenticate(selfSigned)
+			Expect(err).ToNot(Succeed())
+			otherCA, otherKey := newTestCertificate("other-ca", nil, nil)
+			forged, _ := newTestCertificate("mp-1", otherCA, otherKey)
+			_, err = authenticate(forged, otherCA)
+			Expect(err).ToNot(Succeed())
+		})
+
+		It("should verify HMAC signatures and timestamps", func() {
+			config.Set(configAuthMode, "hmac")
+			config.Set(configAuthHMACKeys, "mp-1:key1,mp-2:key2")
+			ca, err := newCallerAuthenticator()
+			Expect(err).To(Succeed())
+			now := time.Unix(1500000000, 0)
+			ca.now = func() time.Time { return now }
+
+			nonce := 0
+			sign := func(r *http.Request, keyId, key string, at time.Time) {
+				nonce++
+				timestamp := strconv.FormatInt(at.Unix(), 10)
+				r.Header.Set(AUTH_KEY_ID_HEADER, keyId)
+				r.Header.Set(AUTH_TIMESTAMP_HEADER, timestamp)
+				r.Header.Set(AUTH_NONCE_HEADER, strconv.Itoa(nonce))
+				r.Header.Set(AUTH_SIGNATURE_HEADER, hex.EncodeToString(signRequest(key, r.Method, r.URL.Path,
+					timestamp, strconv.Itoa(nonce), r.Header.Get(UPLOAD_TRACESESSION_HEADER))))
+			}
+
+			r := httptest.NewRequest("POST", "/uploadtrace", nil)
+			r.Header.Set(UPLOAD_TRACESESSION_HEADER, "org__env__app__rev__testID")
+			sign(r, "mp-2", "key2", now)
+			identity, err := ca.authenticate(r)
+			Expect(err).To(Succeed())
+			Expect(identity).To(Equal("mp-2"))
+
+			//replayed within the allowed skew
+			_, err = ca.authenticate(r)
+			Expect(err).ToNot(Succeed())
+
+			//nonce removed
+			sign(r, "mp-2", "key2", now)
+			r.Header.Del(AUTH_NONCE_HEADER)
+			_, err = ca.authenticate(r)
+			Expect(err).ToNot(Succeed())
+
+			//signed with the wrong key
+			sign(r, "mp-2", "key1", now)
+			_, err = ca.authenticate(r)
+			Expect(err).ToNot(Succeed())
+
+			//replayed outside the allowed skew
+			sign(r, "mp-2", "key2", now.Add(-10*time.Minute))
+			_, err = ca.authenticate(r)
+			Expect(err).ToNot(Succeed())
+
+			//session header tampered with after signing
+			sign(r, "mp-2", "key2", now)
+			r.Header.Set(UPLOAD_TRACESESSION_HEADER, "other__env__app__rev__testID")
+			_, err = ca.authenticate(r)
+			Expect(err).ToNot(Succeed())
+		})
+	})
+
+	Context("replayCache", func() {
+		It("should remember nonces for at least the window", func() {
+			rc := newReplayCache(time.Minute)
+			start := time.Unix(1500000000, 0)
+			Expect(rc.seen("a", start)).To(BeFalse())
+			Expect(rc.seen("a", start.Add(30*time.Second))).To(BeTrue())
+			Expect(rc.seen("b", start.Add(90*time.Second))).To(BeFalse())
+			Expect(rc.seen("a", start.Add(100*time.Second))).To(BeTrue())
+			Expect(rc.seen("a", start.Add(200*time.Second))).To(BeFalse())
+		})
+	})
+
+	Context("authorize", func() {
+		It("should match org/env scopes with wildcards", func() {
+			config.Set(configAuthScopes, "mp-1:org1/prod,mp-1:org1/test,*:org2/*")
+			ca, err := newCallerAuthenticator()
+			Expect(err).To(Succeed())
+			Expect(ca.authorize("mp-1", "org1", "prod")).To(BeTrue())
+			Expect(ca.authorize("mp-1", "org1", "dev")).To(BeFalse())
+			Expect(ca.authorize("mp-2", "org1", "prod")).To(BeFalse())
+			Expect(ca.authorize("mp-2", "org2", "dev")).To(BeTrue())
+		})
+	})
+
+	Context("API integration", func() {
+		It("should reject and count unauthenticated and unauthorized callers", func() {
+			config.Set(configAuthMode, "shared_secret")
+			config.Set(configAuthSharedSecret, "s3cret")
+			config.Set(configAuthScopes, "shared-secret:org/prod")
+			ca, err := newCallerAuthenticator()
+			Expect(err).To(Succeed())
+			apiMan := apiManager{auth: ca}
+			handler := apiMan.authenticated(apiMan.apiUploadTraceDataEndpoint)
+
+			unauthenticated := metrics.get(metricAuthRejectedUnauthenticated)
+			r := httptest.NewRequest("POST", "/uploadtrace", nil)
+			r.Header.Set(UPLOAD_TRACESESSION_HEADER, "org__prod__app__rev__testID")
+			w := httptest.NewRecorder()
+			handler(w, r)
+			Expect(w.Code).To(Equal(http.StatusUnauthorized))
+			Expect(metrics.get(metricAuthRejectedUnauthenticated)).To(Equal(unauthenticated + 1))
+
+			unauthorized := metrics.get(metricAuthRejectedUnauthorized)
+			r = httptest.NewRequest("POST", "/uploadtrace", nil)
+			r.Header.Set(UPLOAD_TRACESESSION_HEADER, "org__test__app__rev__testID")
+			r.Header.Set(AUTH_TOKEN_HEADER, "s3cret")
+			w = httptest.NewRecorder()
+			handler(w, r)
+			Expect(w.Code).To(Equal(http.StatusForbidden))
+			Expect(metrics.get(metricAuthRejectedUnauthorized)).To(Equal(unauthorized + 1))
+		})
+	})
+})
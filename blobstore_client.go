@@ -2,6 +2,7 @@ package apidGatewayTrace
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/pkg/errors"
@@ -11,35 +12,35 @@ import (
 	"net/url"
 )
 
-func (bc *blobstoreClient) getSignedURL(blobMetadata blobCreationMetadata, blobServerURL string) (string, error) {
+func (bc *blobstoreClient) getSignedURL(blobMetadata blobCreationMetadata, route blobServerRoute) (*blobServerResponse, error) {
 
-	blobUri, err := url.Parse(blobServerURL)
+	blobUri, err := url.Parse(route.BaseURI)
 	if err != nil {
 		//do not panic here, apid should live even if trace plugin was misconfigured
-		return "", errors.Wrapf(err, "bad url value for config %s: %s", blobUri, err)
+		return nil, errors.Wrapf(err, "bad url value for config %s: %s", blobUri, err)
 	}
 
 	blobUri.Path += blobStoreUri
 	uri := blobUri.String()
 
-	surl, err := bc.postWithAuth(uri, blobMetadata)
+	surl, err := bc.postWithAuth(uri, route.authorization(), blobMetadata)
 	if err != nil {
-		return "", errors.Wrapf(err, "Unable to get signed URL from BlobServer %s: %v", uri, err)
+		return nil, errors.Wrapf(err, "Unable to get signed URL from BlobServer %s: %v", uri, err)
 	}
 	defer surl.Close()
 
 	body, err := ioutil.ReadAll(surl)
 	if err != nil {
-		return "", errors.Wrapf(err, "Invalid response from BlobServer for {%s} error: {%v}", uri, err)
+		return nil, errors.Wrapf(err, "Invalid response from BlobServer for {%s} error: {%v}", uri, err)
 	}
 	res := blobServerResponse{}
 	err = json.Unmarshal(body, &res)
 	log.Debugf("%+v\n", res)
 	if err != nil {
-		return "", errors.Wrapf(err, "Invalid response from BlobServer for {%s} error: {%v}", uri, err)
+		return nil, errors.Wrapf(err, "Invalid response from BlobServer for {%s} error: {%v}", uri, err)
 	}
 
-	return res.SignedUrl, nil
+	return &res, nil
 }
 
 func (bc *blobstoreClient) uploadToBlobstore(uriString string, data io.Reader) (*http.Response, error) {
@@ -49,7 +50,7 @@ func (bc *blobstoreClient) uploadToBlobstore(uriString string, data io.Reader) (
 	}
 
 	req.Header.Add("Content-Type", "application/octet-stream")
-	res, err := bc.httpClient.Do(req)
+	res, err := bc.storageClient.Do(req)
 	if err != nil {
 		return nil, errors.Wrap(err, "http error in attempt to upload to blobstore")
 	}
@@ -60,7 +61,7 @@ func (bc *blobstoreClient) uploadToBlobstore(uriString string, data io.Reader) (
 	return res, nil
 }
 
-func (bc *blobstoreClient) postWithAuth(uriString string, blobMetadata blobCreationMetadata) (io.ReadCloser, error) {
+func (bc *blobstoreClient) postWithAuth(uriString string, authorization string, blobMetadata blobCreationMetadata) (io.ReadCloser, error) {
 
 	b, err := json.Marshal(blobMetadata)
 	if err != nil {
@@ -72,7 +73,7 @@ func (bc *blobstoreClient) postWithAuth(uriString string, blobMetadata blobCreat
 		return nil, errors.Wrap(err, "failed to create new request via call to http.NewRequest")
 	}
 	// add Auth
-	req.Header.Add("Authorization", getBearerToken())
+	req.Header.Add("Authorization", authorization)
 	req.Header.Add("Content-Type", "application/json")
 	res, err := bc.httpClient.Do(req)
 	if err != nil {
@@ -85,6 +86,24 @@ func (bc *blobstoreClient) postWithAuth(uriString string, blobMetadata blobCreat
 	return res.Body, nil
 }
 
+//checkBlobServer tells whether the blob server of a route can be reached, returning the status code it answered with.
+//Any answer counts, as the base URI need not serve anything itself
+func (bc *blobstoreClient) checkBlobServer(route blobServerRoute) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), blobServerCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", route.BaseURI, nil)
+	if err != nil {
+		return 0, errors.Wrapf(err, "bad blob server url %s", route.BaseURI)
+	}
+	req.Header.Add("Authorization", route.authorization())
+	res, err := bc.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, errors.Wrapf(err, "blob server %s is unreachable", route.BaseURI)
+	}
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
 func getBearerToken() string {
 	return "Bearer " + config.GetString(configBearerToken)
 }
@@ -26,11 +26,14 @@ var _ = Describe("DBManager", func() {
 				return nil
 			},
 		},
+		storageClient: &http.Client{
+			Timeout: httpTimeout,
+		},
 	}
 	Context("getSignedUrl method", func() {
 
 		It("should panic with unparseable blobServerUrl", func() {
-			_, err := bsClient.getSignedURL(blobCreationMetadata{}, "NOT-A.UR$%L!!")
+			_, err := bsClient.getSignedURL(blobCreationMetadata{}, blobServerRoute{BaseURI: "NOT-A.UR$%L!!"})
 			Expect(err).ToNot(Succeed())
 			cause, ok := errors.Cause(err).(*url.Error)
 			Expect(ok).To(BeTrue())
@@ -43,10 +46,10 @@ var _ = Describe("DBManager", func() {
 			blobstore := httptest.NewServer(getHandler(func(w http.ResponseWriter, r *http.Request) {
 				w.WriteHeader(500)
 			}))
-			_, err1 := bsClient.postWithAuth(blobstore.URL+blobStoreUri, bcm)
+			_, err1 := bsClient.postWithAuth(blobstore.URL+blobStoreUri, getBearerToken(), bcm)
 			Expect(err1).ToNot(Succeed())
-			s, err2 := bsClient.getSignedURL(bcm, blobstore.URL)
-			Expect(s).To(Equal(""))
+			s, err2 := bsClient.getSignedURL(bcm, blobServerRoute{BaseURI: blobstore.URL})
+			Expect(s).To(BeNil())
 			Expect(err2).ToNot(Succeed())
 			//these should be the same error. This is testing proper error propagation
 			Expect(err1.Error()).To(Equal(errors.Cause(err2).Error()))
@@ -59,26 +62,28 @@ var _ = Describe("DBManager", func() {
 			blobstore := httptest.NewServer(getHandler(func(w http.ResponseWriter, r *http.Request) {
 				w.Write(nil)
 			}))
-			s, err2 := bsClient.getSignedURL(bcm, blobstore.URL)
-			Expect(s).To(Equal(""))
+			s, err2 := bsClient.getSignedURL(bcm, blobServerRoute{BaseURI: blobstore.URL})
+			Expect(s).To(BeNil())
 			Expect(err2).ToNot(Succeed())
 			blobstore.Close()
 		})
 
-		It("should return signed url on success", func() {
+		It("should return the blob and its signed url on success", func() {
 			config.Set(configBearerToken, "bearer_token")
 			bcm := blobCreationMetadata{}
 
 			blobstore := httptest.NewServer(getHandler(func(w http.ResponseWriter, r *http.Request) {
 				blobServerResponse := blobServerResponse{}
+				blobServerResponse.Id = "blobid"
 				blobServerResponse.SignedUrl = "signedurl"
 				bytes, _ := json.Marshal(blobServerResponse)
 				w.Write(bytes)
 			}))
 
-			s, err := bsClient.getSignedURL(bcm, blobstore.URL)
+			s, err := bsClient.getSignedURL(bcm, blobServerRoute{BaseURI: blobstore.URL})
 			Expect(err).To(Succeed())
-			Expect(s).To(Equal("signedurl"))
+			Expect(s.Id).To(Equal("blobid"))
+			Expect(s.SignedUrl).To(Equal("signedurl"))
 			blobstore.Close()
 		})
 	})
@@ -103,7 +108,7 @@ var _ = Describe("DBManager", func() {
 				Expect(recievedBcm).To(Equal(bcm))
 				w.Write([]byte("Success"))
 			}))
-			rc, err := bsClient.postWithAuth(blobstore.URL, bcm)
+			rc, err := bsClient.postWithAuth(blobstore.URL, getBearerToken(), bcm)
 			Expect(err).To(Succeed())
 			responseBytes, err := ioutil.ReadAll(rc)
 			Expect(err).To(Succeed())
@@ -124,7 +129,7 @@ var _ = Describe("DBManager", func() {
 				handlerCalled = true
 				w.WriteHeader(401)
 			}))
-			rc, err := bsClient.postWithAuth(blobstore.URL, bcm)
+			rc, err := bsClient.postWithAuth(blobstore.URL, getBearerToken(), bcm)
 			Expect(rc).To(BeNil())
 			Expect(err).ToNot(Succeed())
 			Expect(handlerCalled).To(BeTrue())
@@ -0,0 +1,68 @@
+//Command apidtracedecrypt opens trace envelopes uploaded by apidGatewayTrace with encryption enabled.  The key file
+//is either the PEM encoded RSA private key matching a configured publicKeyFile, or the AES key of a keyFile:
+//
+//	apidtracedecrypt -key private.pem < trace.blob > trace.xml
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/apid/apidGatewayTrace/envelope"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+func main() {
+	keyFile := flag.String("key", "", "PEM encoded RSA private key or AES key file")
+	in := flag.String("in", "", "envelope to decrypt, standard input if not set")
+	out := flag.String("out", "", "file to write the trace to, standard output if not set")
+	flag.Parse()
+	if *keyFile == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := decrypt(*keyFile, *in, *out); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+//decrypt opens the envelope read from in with the key of keyFile, writing the trace to out
+func decrypt(keyFile, in, out string) error {
+	keyData, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read key %s", keyFile)
+	}
+	unwrapKey, err := envelope.KeyFileUnwrapper(keyData)
+	if err != nil {
+		return errors.Wrapf(err, "bad key %s", keyFile)
+	}
+
+	var sealed []byte
+	if in == "" {
+		sealed, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		sealed, err = ioutil.ReadFile(in)
+	}
+	if err != nil {
+		return errors.Wrap(err, "unable to read envelope")
+	}
+	trace, err := envelope.Open(sealed, unwrapKey)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if out != "" {
+		f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return errors.Wrapf(err, "unable to create %s", out)
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = w.Write(trace)
+	return err
+}
@@ -0,0 +1,341 @@
+package apidGatewayTrace
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	configSignalEndpoint       = "apidgatewaytrace_signal_endpoint"
+	configUploadEndpoint       = "apidgatewaytrace_upload_endpoint"
+	configTransactionsEndpoint = "apidgatewaytrace_transactions_endpoint"
+	configSessionEndpoint      = "apidgatewaytrace_session_endpoint"
+	configDeadLettersEndpoint  = "apidgatewaytrace_dead_letters_endpoint"
+	configReloadEndpoint       = "apidgatewaytrace_config_reload_endpoint"
+	configDebugEndpoint        = "apidgatewaytrace_debug_endpoint"
+	configHealthEndpoint       = "apidgatewaytrace_health_endpoint"
+	configEndpointPrefix       = "apidgatewaytrace_endpoint_prefix"
+	configSignalAliases        = "apidgatewaytrace_signal_endpoint_aliases"
+	configUploadAliases        = "apidgatewaytrace_upload_endpoint_aliases"
+	metricConfigReloads        = "config_reloads"
+	metricConfigReloadFailures = "config_reload_failures"
+)
+
+//endpointsConfig holds the paths the plugin's API is served on.  They are registered once, so changing them takes
+//a restart of apid.  Prefix is prepended to every endpoint, but not to the aliases, which keep serving the signal and
+//upload endpoints on the exact paths deployed MPs use.  The paths are checked for conflicts among themselves only,
+//not with the paths of other apid plugins
+type endpointsConfig struct {
+	Prefix        string   `json:"prefix,omitempty"`
+	Signal        string   `json:"signal"`
+	Upload        string   `json:"upload"`
+	Transactions  string   `json:"transactions"`
+	Session       string   `json:"session"`
+	DeadLetters   string   `json:"deadLetters"`
+	Reload        string   `json:"reload"`
+	Debug         string   `json:"debug"`
+	Health        string   `json:"health"`
+	SignalAliases []string `json:"signalAliases,omitempty"`
+	UploadAliases []string `json:"uploadAliases,omitempty"`
+}
+
+//pluginConfig is the validated configuration of the plugin, together with the components built from it.  Everything
+//but the endpoints can be reloaded while apid is running.  The health probe interval is not part of it, and changing
+//it takes a restart of apid as well.  The exported fields are the effective configuration shown by the diagnostics
+//endpoint, once masked
+type pluginConfig struct {
+	Endpoints           endpointsConfig         `json:"endpoints"`
+	Auth                authSettings            `json:"auth"`
+	BlobServerTransport transportConfig         `json:"blobServerTransport"`
+	StorageTransport    transportConfig         `json:"storageTransport"`
+	Routing             *blobServerRoutesConfig `json:"routing,omitempty"`
+	SessionLimits       limitSettings           `json:"sessionLimits"`
+	OrgLimits           limitSettings           `json:"orgLimits"`
+	Validation          validationSettings      `json:"validation"`
+	Redaction           *redactionConfig        `json:"redaction,omitempty"`
+	EncryptionKeys      []encryptionKeyConfig   `json:"encryptionKeys,omitempty"`
+	Idempotency         idempotencySettings     `json:"idempotency"`
+	Destinations        []uploadDestination     `json:"destinations"`
+	DeadLetterDir       string                  `json:"deadLetterDir,omitempty"`
+	Retention           retentionSettings       `json:"retention"`
+	LoadedAt            time.Time               `json:"loadedAt"`
+
+	auth         *callerAuthenticator
+	router       *blobServerRouter
+	destinations []uploadDestination
+	deadLetters  *deadLetterStore
+	limiter      *uploadLimiter
+	stages       []uploadStage
+	idempotency  *idempotencyCache
+	bsClient     blobstoreClientInterface
+}
+
+//retentionSettings bound the data the plugin keeps on disk
+type retentionSettings struct {
+	TraceIndex           string `json:"traceIndex"`
+	DeadLetterMaxEntries int    `json:"deadLetterMaxEntries,omitempty"`
+	QuarantineMaxFiles   int    `json:"quarantineMaxFiles,omitempty"`
+}
+
+//loadPluginConfig reads and validates the whole plugin configuration, returning the first problem found
+func loadPluginConfig(dbMan dbManagerInterface) (*pluginConfig, error) {
+	cfg := &pluginConfig{
+		Endpoints: endpointsConfig{
+			Signal:        configString(configSignalEndpoint, signalEndpoint),
+			Upload:        configString(configUploadEndpoint, uploadEndpoint),
+			Transactions:  configString(configTransactionsEndpoint, transactionsEndpoint),
+			Session:       configString(configSessionEndpoint, sessionEndpoint),
+			DeadLetters:   configString(configDeadLettersEndpoint, deadLettersEndpoint),
+			Reload:        configString(configReloadEndpoint, reloadEndpoint),
+			Debug:         configString(configDebugEndpoint, debugEndpoint),
+			Health:        configString(configHealthEndpoint, healthEndpoint),
+			Prefix:        config.GetString(configEndpointPrefix),
+			SignalAliases: splitConfigList(config.GetString(configSignalAliases)),
+			UploadAliases: splitConfigList(config.GetString(configUploadAliases)),
+		},
+		BlobServerTransport: loadTransportConfig(configBlobServerTransportPrefix),
+		StorageTransport:    loadTransportConfig(configStorageTransportPrefix),
+		LoadedAt:            time.Now().UTC(),
+	}
+	if err := cfg.Endpoints.validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid endpoint configuration")
+	}
+
+	blobServerClient, err := newHTTPClient(cfg.BlobServerTransport,
+		func(req *http.Request, via []*http.Request) error {
+			//keep the credentials of the route the original request was sent with
+			req.Header.Set("Authorization", via[0].Header.Get("Authorization"))
+			return nil
+		})
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid blob server transport configuration")
+	}
+	storageClient, err := newHTTPClient(cfg.StorageTransport, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid storage transport configuration")
+	}
+	cfg.bsClient = &blobstoreClient{
+		httpClient:    blobServerClient,
+		storageClient: storageClient,
+	}
+
+	if cfg.router, err = newBlobServerRouter(); err != nil {
+		return nil, errors.Wrap(err, "invalid blob server routing configuration")
+	}
+	if cfg.destinations, err = newUploadDestinations(); err != nil {
+		return nil, errors.Wrap(err, "invalid upload destinations configuration")
+	}
+	if cfg.deadLetters, err = newDeadLetterStore(); err != nil {
+		return nil, errors.Wrap(err, "invalid dead-letter configuration")
+	}
+	if cfg.auth, err = newCallerAuthenticator(); err != nil {
+		return nil, errors.Wrap(err, "invalid caller authentication configuration")
+	}
+	if cfg.limiter, err = newUploadLimiter(dbMan); err != nil {
+		return nil, errors.Wrap(err, "invalid sampling or rate limit configuration")
+	}
+	if cfg.stages, err = newUploadStages(); err != nil {
+		return nil, errors.Wrap(err, "invalid upload pipeline configuration")
+	}
+	cfg.idempotency = newIdempotencyCache()
+
+	cfg.Auth = cfg.auth.settings()
+	cfg.Routing = cfg.router.routesConfig()
+	cfg.SessionLimits = cfg.limiter.session
+	cfg.OrgLimits = cfg.limiter.org
+	cfg.Validation = validationSettings{Mode: traceValidationOff}
+	for _, stage := range cfg.stages {
+		switch stage := stage.(type) {
+		case *validationStage:
+			cfg.Validation = stage.settings()
+		case *redactionStage:
+			cfg.Redaction = &stage.config
+		case *encryptionStage:
+			cfg.EncryptionKeys = stage.keyConfigs()
+		}
+	}
+	cfg.Idempotency = cfg.idempotency.settings()
+	cfg.Destinations = cfg.destinations
+	cfg.Retention = retentionSettings{
+		TraceIndex:         indexRetention().String(),
+		QuarantineMaxFiles: cfg.Validation.QuarantineMaxFiles,
+	}
+	if cfg.deadLetters != nil {
+		cfg.DeadLetterDir = cfg.deadLetters.dir
+		cfg.Retention.DeadLetterMaxEntries = cfg.deadLetters.maxEntries
+	}
+	return cfg, nil
+}
+
+//configString returns a string config value, or def if it is not set
+func configString(key, def string) string {
+	if value := config.GetString(key); value != "" {
+		return value
+	}
+	return def
+}
+
+//validate checks that every endpoint is an absolute path, and that no two endpoints are the same.  Endpoints which
+//only overlap, or clash with the versioned routes, are found when the routes are registered
+func (ec endpointsConfig) validate() error {
+	if ec.Prefix != "" && (!strings.HasPrefix(ec.Prefix, "/") || strings.HasSuffix(ec.Prefix, "/")) {
+		return fmt.Errorf("endpoint prefix %q must start with / and not end with /", ec.Prefix)
+	}
+	seen := make(map[string]string)
+	check := func(name, path, prefix string) error {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("%s endpoint %q must start with /", name, path)
+		}
+		path = prefix + path
+		if other, ok := seen[path]; ok {
+			return fmt.Errorf("%s and %s endpoints are both %s", other, name, path)
+		}
+		seen[path] = name
+		return nil
+	}
+	for _, endpoint := range []struct{ name, path string }{
+		{"signal", ec.Signal},
+		{"upload", ec.Upload},
+		{"transactions", ec.Transactions},
+		{"session", ec.Session},
+		{"dead letters", ec.DeadLetters},
+		{"reload", ec.Reload},
+		{"debug", ec.Debug},
+		{"health", ec.Health},
+		{"liveness", ec.Health + livenessSuffix},
+	} {
+		if err := check(endpoint.name, endpoint.path, ec.Prefix); err != nil {
+			return err
+		}
+	}
+	for _, alias := range ec.SignalAliases {
+		if err := check("signal alias", alias, ""); err != nil {
+			return err
+		}
+	}
+	for _, alias := range ec.UploadAliases {
+		if err := check("upload alias", alias, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//apiComponents are the reloadable components a request works with.  Requests take a snapshot of them when they
+//start, so that a reload neither swaps components out from under a request nor waits for requests to finish
+type apiComponents struct {
+	auth         *callerAuthenticator
+	router       *blobServerRouter
+	destinations []uploadDestination
+	deadLetters  *deadLetterStore
+	limiter      *uploadLimiter
+	stages       []uploadStage
+	idempotency  *idempotencyCache
+	bsClient     blobstoreClientInterface
+	config       *pluginConfig
+}
+
+//components returns a snapshot of the components in use, holding the config lock only to copy them
+func (a *apiManager) components() *apiComponents {
+	a.configMux.RLock()
+	defer a.configMux.RUnlock()
+	return &apiComponents{
+		auth:         a.auth,
+		router:       a.router,
+		destinations: a.destinations,
+		deadLetters:  a.deadLetters,
+		limiter:      a.limiter,
+		stages:       a.stages,
+		idempotency:  a.idempotency,
+		bsClient:     a.bsClient,
+		config:       a.config,
+	}
+}
+
+//applyConfig makes the apiManager use the components of cfg.  Requests already running keep the snapshot of the
+//previous components they took.  Sampling and rate limit state is kept, only the limiter's settings change, and so
+//are the nonces of signed requests, which could otherwise be replayed after a reload, and the transactions
+//remembered for deduplication
+func (a *apiManager) applyConfig(cfg *pluginConfig) {
+	a.configMux.Lock()
+	defer a.configMux.Unlock()
+	if a.config != nil && !reflect.DeepEqual(a.config.Endpoints, cfg.Endpoints) {
+		log.Warnf("endpoint changes take effect after a restart of apid")
+		cfg.Endpoints = a.config.Endpoints
+	}
+	if a.auth != nil && a.auth.nonces != nil {
+		a.auth.nonces.resize(cfg.auth.nonces.window)
+		cfg.auth.nonces = a.auth.nonces
+	}
+	a.auth = cfg.auth
+	a.router = cfg.router
+	a.destinations = cfg.destinations
+	a.deadLetters = cfg.deadLetters
+	a.stages = cfg.stages
+	a.bsClient = cfg.bsClient
+	if a.limiter != nil {
+		a.limiter.reconfigure(cfg.limiter.session, cfg.limiter.org)
+	} else {
+		a.limiter = cfg.limiter
+	}
+	switch {
+	case a.idempotency != nil && cfg.idempotency != nil:
+		a.idempotency.reconfigure(cfg.idempotency)
+	case a.idempotency != nil:
+		a.idempotency.stopPruning()
+		a.idempotency = nil
+	case cfg.idempotency != nil:
+		a.idempotency = cfg.idempotency
+		a.idempotency.startPruning()
+	}
+	a.config = cfg
+}
+
+//reloadConfig loads the plugin configuration again and applies it.  An invalid configuration is reported and
+//the previous one stays in effect
+func (a *apiManager) reloadConfig() error {
+	cfg, err := loadPluginConfig(a.dbMan)
+	if err != nil {
+		metrics.inc(metricConfigReloadFailures)
+		log.Errorf("keeping previous configuration: %v", err)
+		return err
+	}
+	a.applyConfig(cfg)
+	metrics.inc(metricConfigReloads)
+	log.Infof("configuration reloaded")
+	return nil
+}
+
+//reloadOnSignal reloads the configuration each time apid receives SIGHUP
+func (a *apiManager) reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			a.reloadConfig()
+		}
+	}()
+}
+
+//apiReloadConfigEndpoint is the API implementation reloading the plugin configuration
+func (a *apiManager) apiReloadConfigEndpoint(w http.ResponseWriter, r *http.Request) {
+	//the error names the files and settings at fault, and is only logged
+	if err := a.reloadConfig(); err != nil {
+		writeError(w, r, API_ERR_BAD_CONFIG, "invalid configuration, the previous one stays in effect")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, configReloadResult{Reloaded: true, LoadedAt: a.components().config.LoadedAt})
+}
+
+//configReloadResult is returned by the reload endpoint
+type configReloadResult struct {
+	Reloaded bool      `json:"reloaded"`
+	LoadedAt time.Time `json:"loadedAt"`
+}
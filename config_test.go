@@ -0,0 +1,270 @@
+package apidGatewayTrace
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/mock"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Plugin configuration", func() {
+
+	BeforeEach(func() {
+		config.Set(configSampleRate, 1)
+	})
+
+	AfterEach(func() {
+		for _, key := range []string{configUploadEndpoint, configSessionEndpoint, configOrgRateLimit, configAdminToken,
+			configEndpointPrefix, configSignalAliases, configUploadAliases, configAuthMode, configAuthHMACKeys,
+			configBlobServerTransportPrefix + configHTTPTimeout,
+			configBlobServerTransportPrefix + configMaxIdleConnsPerHost} {
+			config.Set(key, "")
+		}
+		config.Set(configSampleRate, 1)
+	})
+
+	It("should default to the built-in endpoints and transports", func() {
+		cfg, err := loadPluginConfig(nil)
+		Expect(err).To(Succeed())
+		Expect(cfg.Endpoints).To(Equal(endpointsConfig{
+			Signal:        signalEndpoint,
+			Upload:        uploadEndpoint,
+			Transactions:  transactionsEndpoint,
+			Session:       sessionEndpoint,
+			DeadLetters:   deadLettersEndpoint,
+			Reload:        reloadEndpoint,
+			Debug:         debugEndpoint,
+			Health:        healthEndpoint,
+			SignalAliases: []string{},
+			UploadAliases: []string{},
+		}))
+		client := cfg.bsClient.(*blobstoreClient)
+		Expect(client.httpClient.Timeout).To(Equal(httpTimeout))
+		Expect(client.httpClient.Transport.(*http.Transport).MaxIdleConnsPerHost).To(Equal(maxIdleConnsPerHost))
+		Expect(cfg.SessionLimits.SampleRate).To(Equal(1.0))
+		Expect(cfg.Destinations).To(Equal(defaultDestinations))
+	})
+
+	It("should apply configured endpoints, timeouts and pool sizes", func() {
+		config.Set(configUploadEndpoint, "/v1/uploadtrace")
+		config.Set(configBlobServerTransportPrefix+configHTTPTimeout, "5s")
+		config.Set(configBlobServerTransportPrefix+configMaxIdleConnsPerHost, 7)
+		cfg, err := loadPluginConfig(nil)
+		Expect(err).To(Succeed())
+		Expect(cfg.Endpoints.Upload).To(Equal("/v1/uploadtrace"))
+		client := cfg.bsClient.(*blobstoreClient)
+		Expect(client.httpClient.Timeout).To(Equal(5 * time.Second))
+		Expect(client.httpClient.Transport.(*http.Transport).MaxIdleConnsPerHost).To(Equal(7))
+	})
+
+	It("should prefix the endpoints but not their aliases", func() {
+		config.Set(configEndpointPrefix, "/trace")
+		config.Set(configSignalAliases, "/tracesignals, /legacy/tracesignals")
+		config.Set(configUploadAliases, "/uploadtrace")
+		cfg, err := loadPluginConfig(nil)
+		Expect(err).To(Succeed())
+		Expect(cfg.Endpoints.Prefix).To(Equal("/trace"))
+		Expect(cfg.Endpoints.Signal).To(Equal(signalEndpoint))
+		Expect(cfg.Endpoints.SignalAliases).To(Equal([]string{"/tracesignals", "/legacy/tracesignals"}))
+		Expect(cfg.Endpoints.UploadAliases).To(Equal([]string{"/uploadtrace"}))
+
+		config.Set(configEndpointPrefix, "")
+		_, err = loadPluginConfig(nil)
+		Expect(err.Error()).To(Equal("invalid endpoint configuration: signal and signal alias endpoints are both /tracesignals"))
+	})
+
+	It("should explain what is wrong with an invalid configuration", func() {
+		for key, value := range map[string]interface{}{
+			configUploadEndpoint:                                        "uploadtrace",
+			configSessionEndpoint:                                       uploadEndpoint,
+			configBlobServerTransportPrefix + configHTTPTimeout:         "-1s",
+			configBlobServerTransportPrefix + configMaxIdleConnsPerHost: -1,
+			configSampleRate:                                            2,
+			configEndpointPrefix:                                        "/trace/",
+			configUploadAliases:                                         "uploadtrace",
+		} {
+			config.Set(key, value)
+			_, err := loadPluginConfig(nil)
+			Expect(err).ToNot(Succeed(), key)
+			config.Set(key, "")
+			config.Set(configSampleRate, 1)
+		}
+
+		config.Set(configSessionEndpoint, uploadEndpoint)
+		_, err := loadPluginConfig(nil)
+		Expect(err.Error()).To(Equal("invalid endpoint configuration: upload and session endpoints are both /uploadtrace"))
+	})
+
+	It("should reload the configuration and keep the previous one when invalid", func() {
+		cfg, err := loadPluginConfig(nil)
+		Expect(err).To(Succeed())
+		apiMan := &apiManager{}
+		apiMan.applyConfig(cfg)
+		limiter := apiMan.limiter
+
+		config.Set(configOrgRateLimit, 5)
+		config.Set(configUploadEndpoint, "/moved")
+		Expect(apiMan.reloadConfig()).To(Succeed())
+		Expect(apiMan.limiter).To(BeIdenticalTo(limiter))
+		Expect(apiMan.limiter.org.Rate).To(Equal(5.0))
+		Expect(apiMan.config.OrgLimits.Rate).To(Equal(5.0))
+		Expect(apiMan.config.Endpoints.Upload).To(Equal(uploadEndpoint))
+
+		reloaded := apiMan.config
+		failures := metrics.get(metricConfigReloadFailures)
+		config.Set(configSampleRate, 2)
+		Expect(apiMan.reloadConfig()).ToNot(Succeed())
+		Expect(apiMan.config).To(BeIdenticalTo(reloaded))
+		Expect(apiMan.limiter.session.SampleRate).To(Equal(1.0))
+		Expect(metrics.get(metricConfigReloadFailures)).To(Equal(failures + 1))
+	})
+
+	It("should reconfigure deduplication, keeping the transactions already remembered", func() {
+		defer config.Set(configIdempotencyWindow, defaultIdempotencyWindow.String())
+		cfg, err := loadPluginConfig(nil)
+		Expect(err).To(Succeed())
+		apiMan := &apiManager{}
+		apiMan.applyConfig(cfg)
+		cache := apiMan.idempotency
+		Expect(cache).ToNot(BeNil())
+		_, owner, err := cache.begin(context.Background(), "org__env__app__rev__id", "tx1")
+		Expect(err).To(Succeed())
+		Expect(owner).To(BeTrue())
+
+		config.Set(configIdempotencyWindow, "1m")
+		Expect(apiMan.reloadConfig()).To(Succeed())
+		Expect(apiMan.idempotency).To(BeIdenticalTo(cache))
+		Expect(cache.window).To(Equal(time.Minute))
+		Expect(cache.results).To(HaveLen(1))
+
+		config.Set(configIdempotencyWindow, "0s")
+		Expect(apiMan.reloadConfig()).To(Succeed())
+		Expect(apiMan.idempotency).To(BeNil())
+		Expect(apiMan.components().idempotency).To(BeNil())
+
+		config.Set(configIdempotencyWindow, "1m")
+		Expect(apiMan.reloadConfig()).To(Succeed())
+		Expect(apiMan.idempotency).ToNot(BeNil())
+		apiMan.idempotency.stopPruning()
+	})
+
+	It("should keep the nonces of signed requests across reloads", func() {
+		config.Set(configAuthMode, authModeHMAC)
+		config.Set(configAuthHMACKeys, "mp-1:key1")
+		cfg, err := loadPluginConfig(nil)
+		Expect(err).To(Succeed())
+		apiMan := &apiManager{}
+		apiMan.applyConfig(cfg)
+
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		r := httptest.NewRequest("POST", uploadEndpoint, nil)
+		r.Header.Set(UPLOAD_TRACESESSION_HEADER, "org__env__app__rev__id")
+		r.Header.Set(AUTH_KEY_ID_HEADER, "mp-1")
+		r.Header.Set(AUTH_TIMESTAMP_HEADER, timestamp)
+		r.Header.Set(AUTH_NONCE_HEADER, "nonce")
+		r.Header.Set(AUTH_SIGNATURE_HEADER, hex.EncodeToString(signRequest("key1", r.Method, r.URL.Path, timestamp,
+			"nonce", "org__env__app__rev__id")))
+		_, err = apiMan.auth.authenticate(r)
+		Expect(err).To(Succeed())
+
+		config.Set(configAuthHMACMaxSkew, "10m")
+		defer config.Set(configAuthHMACMaxSkew, defaultHMACMaxSkew.String())
+		Expect(apiMan.reloadConfig()).To(Succeed())
+		Expect(apiMan.auth).ToNot(BeIdenticalTo(cfg.auth))
+		Expect(apiMan.auth.nonces.window).To(Equal(20 * time.Minute))
+		_, err = apiMan.auth.authenticate(r)
+		Expect(err).ToNot(Succeed())
+	})
+
+	It("should reload the configuration through the admin endpoint", func() {
+		cfg, err := loadPluginConfig(nil)
+		Expect(err).To(Succeed())
+		apiMan := &apiManager{}
+		apiMan.applyConfig(cfg)
+
+		w := httptest.NewRecorder()
+		apiMan.apiReloadConfigEndpoint(w, httptest.NewRequest("POST", reloadEndpoint, nil))
+		Expect(w.Code).To(Equal(200))
+		var result configReloadResult
+		Expect(json.Unmarshal(w.Body.Bytes(), &result)).To(Succeed())
+		Expect(result.Reloaded).To(BeTrue())
+		Expect(result.LoadedAt).To(Equal(apiMan.config.LoadedAt))
+
+		config.Set(configSampleRate, 2)
+		w = httptest.NewRecorder()
+		apiMan.apiReloadConfigEndpoint(w, httptest.NewRequest("POST", reloadEndpoint, nil))
+		Expect(w.Code).To(Equal(500))
+		var errResp errorResponse
+		Expect(json.Unmarshal(w.Body.Bytes(), &errResp)).To(Succeed())
+		Expect(errResp.ErrorCode).To(Equal(API_ERR_BAD_CONFIG))
+		Expect(errResp.Reason).To(Equal("invalid configuration, the previous one stays in effect"))
+	})
+
+	It("should only reload for callers presenting the admin token", func() {
+		config.Set(configAdminToken, "admin-secret")
+		cfg, err := loadPluginConfig(nil)
+		Expect(err).To(Succeed())
+		apiMan := &apiManager{}
+		apiMan.applyConfig(cfg)
+		reload := apiMan.administered(apiMan.apiReloadConfigEndpoint)
+
+		for _, token := range []string{"", "wrong"} {
+			r := httptest.NewRequest("POST", reloadEndpoint, nil)
+			r.Header.Set(ADMIN_TOKEN_HEADER, token)
+			w := httptest.NewRecorder()
+			reload(w, r)
+			Expect(w.Code).To(Equal(http.StatusUnauthorized))
+			Expect(apiMan.config).To(BeIdenticalTo(cfg))
+		}
+
+		r := httptest.NewRequest("POST", reloadEndpoint, nil)
+		r.Header.Set(ADMIN_TOKEN_HEADER, "admin-secret")
+		w := httptest.NewRecorder()
+		reload(w, r)
+		Expect(w.Code).To(Equal(200))
+		Expect(apiMan.config).ToNot(BeIdenticalTo(cfg))
+	})
+
+	It("should reload without waiting for requests in progress, which keep their components", func() {
+		cfg, err := loadPluginConfig(nil)
+		Expect(err).To(Succeed())
+		mockBsClient := &mockBlobstoreClient{}
+		cfg.bsClient = mockBsClient
+		apiMan := &apiManager{}
+		apiMan.applyConfig(cfg)
+
+		started, release := make(chan struct{}), make(chan struct{})
+		mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), mock.Anything).Return(&blobServerResponse{Id: "testblob", SignedUrl: "testurl"}, nil)
+		mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Run(func(args mock.Arguments) {
+			close(started)
+			<-release
+		}).Return(&http.Response{StatusCode: 200}, nil)
+		done := make(chan int)
+		go func() {
+			defer GinkgoRecover()
+			r := httptest.NewRequest("POST", uploadEndpoint, strings.NewReader("a trace"))
+			r.Header.Add(UPLOAD_TRACESESSION_HEADER, "org__env__app__rev__id")
+			w := httptest.NewRecorder()
+			apiMan.apiUploadTraceDataEndpoint(w, r)
+			done <- w.Code
+		}()
+		Eventually(started).Should(BeClosed())
+
+		reloaded := make(chan error)
+		go func() {
+			reloaded <- apiMan.reloadConfig()
+		}()
+		Eventually(reloaded).Should(Receive(BeNil()))
+		Expect(apiMan.bsClient).ToNot(BeIdenticalTo(mockBsClient))
+
+		close(release)
+		Eventually(done).Should(Receive(Equal(200)))
+	})
+})
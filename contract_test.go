@@ -0,0 +1,395 @@
+package apidGatewayTrace
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/apid/apid-core/util"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/mock"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fileOpenAPI = "schema/openapi.json"
+
+//openAPIOperation returns the operation of the OpenAPI document serving a method on a path
+func openAPIOperation(spec map[string]interface{}, method, path string) map[string]interface{} {
+	paths := spec["paths"].(map[string]interface{})
+	item, ok := paths[path].(map[string]interface{})
+	Expect(ok).To(BeTrue(), "no path %s in OpenAPI document", path)
+	_, item = resolveRef(spec, item)
+	op, ok := item[strings.ToLower(method)].(map[string]interface{})
+	Expect(ok).To(BeTrue(), "no operation %s %s in OpenAPI document", method, path)
+	return op
+}
+
+//validateParameter checks the string value of a header or query parameter against its schema
+func validateParameter(spec, schema map[string]interface{}, value, path string) []string {
+	_, resolved := resolveRef(spec, schema)
+	var decoded interface{} = value
+	if resolved["type"] == "integer" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return []string{fmt.Sprintf("%s: %s is not an integer", path, value)}
+		}
+		decoded = float64(n)
+	}
+	if pattern, ok := resolved["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(value) {
+		return []string{fmt.Sprintf("%s: %s does not match %s", path, value, pattern)}
+	}
+	return validateSchema(spec, resolved, decoded, path)
+}
+
+//validateRequest checks the parameters and body of a request against its operation
+func validateRequest(spec, op map[string]interface{}, r *http.Request, body []byte) []string {
+	var errs []string
+	params, _ := op["parameters"].([]interface{})
+	for _, p := range params {
+		_, param := resolveRef(spec, p.(map[string]interface{}))
+		name := param["name"].(string)
+		var value string
+		var present bool
+		switch param["in"] {
+		case "query":
+			values, ok := r.URL.Query()[name]
+			present = ok
+			if ok {
+				value = values[0]
+			}
+		case "header":
+			value = r.Header.Get(name)
+			present = value != ""
+		}
+		if !present {
+			if param["required"] == true {
+				errs = append(errs, "missing parameter "+name)
+			}
+			continue
+		}
+		errs = append(errs, validateParameter(spec, param["schema"].(map[string]interface{}), value, name)...)
+	}
+	if requestBody, ok := op["requestBody"].(map[string]interface{}); ok {
+		if _, requestBody = resolveRef(spec, requestBody); requestBody["required"] == true && len(body) == 0 {
+			errs = append(errs, "missing request body")
+		}
+	}
+	return errs
+}
+
+//openAPIResponse returns the response of an operation documenting a status code, checking the exact code, then
+//its range, then the default response
+func openAPIResponse(spec, op map[string]interface{}, status int) map[string]interface{} {
+	responses := op["responses"].(map[string]interface{})
+	for _, key := range []string{strconv.Itoa(status), strconv.Itoa(status/100) + "XX", "default"} {
+		if response, ok := responses[key].(map[string]interface{}); ok {
+			_, response = resolveRef(spec, response)
+			return response
+		}
+	}
+	return nil
+}
+
+//validateResponse checks the status, headers and body of a recorded response against its operation
+func validateResponse(spec, op map[string]interface{}, w *httptest.ResponseRecorder) []string {
+	response := openAPIResponse(spec, op, w.Code)
+	if response == nil {
+		return []string{fmt.Sprintf("undocumented status %d", w.Code)}
+	}
+	var errs []string
+	headers, _ := response["headers"].(map[string]interface{})
+	for name, h := range headers {
+		_, header := resolveRef(spec, h.(map[string]interface{}))
+		value := w.Header().Get(name)
+		if value == "" {
+			if header["required"] == true {
+				errs = append(errs, "missing header "+name)
+			}
+			continue
+		}
+		errs = append(errs, validateParameter(spec, header["schema"].(map[string]interface{}), value, name)...)
+	}
+
+	content, _ := response["content"].(map[string]interface{})
+	if content == nil {
+		if w.Body.Len() > 0 {
+			errs = append(errs, fmt.Sprintf("unexpected body for status %d", w.Code))
+		}
+		return errs
+	}
+	mediaType, _, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil {
+		return append(errs, "bad Content-Type "+w.Header().Get("Content-Type"))
+	}
+	media, ok := content[mediaType].(map[string]interface{})
+	if !ok {
+		return append(errs, fmt.Sprintf("undocumented Content-Type %s for status %d", mediaType, w.Code))
+	}
+	var body interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		return append(errs, "body is not JSON: "+err.Error())
+	}
+	return append(errs, validateSchema(spec, media["schema"].(map[string]interface{}), body, "$")...)
+}
+
+var _ = Describe("OpenAPI contract", func() {
+
+	var spec map[string]interface{}
+	var dbMan *dbManager
+	var bsClient *mockBlobstoreClient
+	var apiMan *apiManager
+
+	BeforeEach(func() {
+		spec = readSchema(fileOpenAPI)
+		dir, err := ioutil.TempDir(testTempDirBase, "sqlite3")
+		Expect(err).To(Succeed())
+		services.Config().Set("local_storage_path", dir)
+		dbMan = &dbManager{data: services.Data(), dbMux: sync.RWMutex{}}
+		Expect(dbMan.setDbVersion(dir)).To(Succeed())
+		setupTestDb(dbMan.getDb())
+		bsClient = &mockBlobstoreClient{}
+		apiMan = &apiManager{
+			dbMan:          dbMan,
+			bsClient:       bsClient,
+			newSignal:      make(chan interface{}),
+			addSubscriber:  make(chan chan interface{}),
+			apiInitialized: true,
+		}
+		go util.DistributeEvents(apiMan.newSignal, apiMan.addSubscriber)
+	})
+
+	//exchange sends a request through the same handler chain as the registered endpoint and validates both the
+	//request and the response against the OpenAPI document.  It returns the problems found with the request, which
+	//the spec must reject exactly when the handler does
+	exchange := func(method, path string, header http.Header, body string) (*httptest.ResponseRecorder, []string) {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		for name, values := range header {
+			for _, value := range values {
+				r.Header.Add(name, value)
+			}
+		}
+		op := openAPIOperation(spec, method, r.URL.Path)
+		requestErrs := validateRequest(spec, op, r, []byte(body))
+
+		handlers := map[string]http.HandlerFunc{
+			signalEndpoint: apiMan.parkUntilReady(apiMan.apiGetTraceSignalEndpoint),
+			uploadEndpoint: apiMan.whenReady(apiMan.apiUploadTraceDataEndpoint),
+		}
+		handler := handlers[r.URL.Path]
+		for _, version := range apiVersions {
+			if endpoint := strings.TrimPrefix(r.URL.Path, "/"+version.name); endpoint != r.URL.Path && handlers[endpoint] != nil {
+				handler = versioned(version, handlers[endpoint])
+			}
+		}
+		Expect(handler).ToNot(BeNil(), "no handler for %s", r.URL.Path)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		Expect(validateResponse(spec, op, w)).To(BeEmpty(), "%s %s answered %d %s", method, path, w.Code, w.Body.String())
+		return w, requestErrs
+	}
+
+	Context("GET "+signalEndpoint, func() {
+
+		It("should send the signals at once without If-None-Match", func() {
+			w, reqErrs := exchange("GET", signalEndpoint, nil, "")
+			Expect(reqErrs).To(BeEmpty())
+			Expect(w.Code).To(Equal(200))
+		})
+
+		It("should answer 304 when If-None-Match is current and block is absent", func() {
+			for _, etag := range []string{"0,1,2,3,4", `"0,1,2,3,4"`} {
+				w, reqErrs := exchange("GET", signalEndpoint, http.Header{"If-None-Match": {etag}}, "")
+				Expect(reqErrs).To(BeEmpty())
+				Expect(w.Code).To(Equal(304))
+				Expect(w.Header().Get("ETag")).To(Equal(`"0,1,2,3,4"`))
+			}
+		})
+
+		It("should send the signals when If-None-Match is stale", func() {
+			w, reqErrs := exchange("GET", signalEndpoint+"?block=5", http.Header{"If-None-Match": {"0,1,9"}}, "")
+			Expect(reqErrs).To(BeEmpty())
+			Expect(w.Code).To(Equal(200))
+		})
+
+		It("should answer 304 when nothing changes while blocking", func() {
+			start := time.Now()
+			w, reqErrs := exchange("GET", signalEndpoint+"?block=1", http.Header{"If-None-Match": {"0,1,2,3,4"}}, "")
+			Expect(reqErrs).To(BeEmpty())
+			Expect(w.Code).To(Equal(304))
+			Expect(time.Since(start)).To(BeNumerically(">=", time.Second))
+		})
+
+		It("should reject a bad block value", func() {
+			for _, accept := range []string{"", problemContentType} {
+				w, reqErrs := exchange("GET", signalEndpoint+"?block=abc", http.Header{"Accept": {accept}}, "")
+				Expect(reqErrs).ToNot(BeEmpty())
+				Expect(w.Code).To(Equal(400))
+			}
+		})
+
+		It("should answer 500 when the signals cannot be read", func() {
+			apiMan.dbMan = &dbManager{}
+			w, reqErrs := exchange("GET", signalEndpoint, nil, "")
+			Expect(reqErrs).To(BeEmpty())
+			Expect(w.Code).To(Equal(500))
+		})
+
+		It("should answer 503 before the first snapshot", func() {
+			apiMan.apiInitialized = false
+			w, reqErrs := exchange("GET", signalEndpoint, nil, "")
+			Expect(reqErrs).To(BeEmpty())
+			Expect(w.Code).To(Equal(503))
+		})
+	})
+
+	Context("POST "+uploadEndpoint, func() {
+
+		validId := http.Header{UPLOAD_TRACESESSION_HEADER: {"org__env__proxy__rev__0"}}
+
+		storedBlob := func() {
+			bsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), defaultBlobServerRoute()).Return(&blobServerResponse{
+				Id: "blob", Self: "https://blobs/blob", Store: "gcs", SignedUrl: "signed"}, nil)
+			bsClient.On("uploadToBlobstore", "signed", mock.Anything).Return(&http.Response{StatusCode: 201}, nil)
+		}
+
+		It("should pass the status of the storage service through", func() {
+			storedBlob()
+			header := http.Header{
+				UPLOAD_TRACESESSION_HEADER:     {"v1:org__env__proxy_name__rev__0"},
+				UPLOAD_MP_HOST_HEADER:          {"mp1"},
+				UPLOAD_TRANSACTION_TIME_HEADER: {"2026-10-19T10:00:00Z"},
+				UPLOAD_STATUS_CODE_HEADER:      {"200"},
+			}
+			w, reqErrs := exchange("POST", uploadEndpoint, header, "a trace")
+			Expect(reqErrs).To(BeEmpty())
+			Expect(w.Code).To(Equal(201))
+		})
+
+		It("should replay the result of a repeated transaction", func() {
+			storedBlob()
+			apiMan.idempotency = newIdempotencyCache()
+			header := http.Header{UPLOAD_TRACESESSION_HEADER: validId[UPLOAD_TRACESESSION_HEADER], TRANSACTION_ID_HEADER: {"tx"}}
+			exchange("POST", uploadEndpoint, header, "a trace")
+			w, reqErrs := exchange("POST", uploadEndpoint, header, "a trace")
+			Expect(reqErrs).To(BeEmpty())
+			Expect(w.Code).To(Equal(201))
+			Expect(w.Header().Get(IDEMPOTENT_REPLAY_HEADER)).To(Equal("true"))
+		})
+
+		It("should answer 202 to dropped uploads", func() {
+			apiMan.limiter = &uploadLimiter{
+				dbMan:    dbMan,
+				session:  limitSettings{SampleRate: 0},
+				sessions: make(map[string]*sessionLimits),
+				orgs:     make(map[string]*tokenBucket),
+				now:      time.Now,
+				random:   func() float64 { return 0.5 },
+			}
+			w, reqErrs := exchange("POST", uploadEndpoint, validId, "a trace")
+			Expect(reqErrs).To(BeEmpty())
+			Expect(w.Code).To(Equal(202))
+		})
+
+		It("should reject a missing or malformed debug session id", func() {
+			for _, header := range []http.Header{nil, {UPLOAD_TRACESESSION_HEADER: {"invalid"}},
+				{UPLOAD_TRACESESSION_HEADER: {"org__env__proxy__rev__"}, "Accept": {problemContentType}}} {
+				w, reqErrs := exchange("POST", uploadEndpoint, header, "a trace")
+				Expect(reqErrs).ToNot(BeEmpty())
+				Expect(w.Code).To(Equal(400))
+			}
+		})
+
+		It("should answer 404 for unknown debug sessions", func() {
+			apiMan.sessions = &sessionValidator{dbMan: dbMan, deleted: make(map[string]time.Time), now: time.Now}
+			w, reqErrs := exchange("POST", uploadEndpoint, http.Header{UPLOAD_TRACESESSION_HEADER: {"org__env__proxy__rev__99"}}, "a trace")
+			Expect(reqErrs).To(BeEmpty())
+			Expect(w.Code).To(Equal(404))
+		})
+
+		It("should answer 413 to traces which are too large", func() {
+			config.Set(configMaxTraceSize, 4)
+			defer config.Set(configMaxTraceSize, defaultMaxTraceSize)
+			//uploads without a transaction id are buffered when they are deduplicated by their content
+			config.Set(configIdempotencyHash, true)
+			defer config.Set(configIdempotencyHash, false)
+			apiMan.idempotency = newIdempotencyCache()
+			w, reqErrs := exchange("POST", uploadEndpoint, validId, "a trace")
+			Expect(reqErrs).To(BeEmpty())
+			Expect(w.Code).To(Equal(413))
+		})
+
+		It("should answer 500 when the trace cannot be stored", func() {
+			bsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), defaultBlobServerRoute()).Return((*blobServerResponse)(nil), errors.New("unavailable"))
+			w, reqErrs := exchange("POST", uploadEndpoint, validId, "a trace")
+			Expect(reqErrs).To(BeEmpty())
+			Expect(w.Code).To(Equal(500))
+		})
+
+		It("should answer 503 before the first snapshot", func() {
+			apiMan.apiInitialized = false
+			w, reqErrs := exchange("POST", uploadEndpoint, validId, "a trace")
+			Expect(reqErrs).To(BeEmpty())
+			Expect(w.Code).To(Equal(503))
+		})
+	})
+
+	Context("v2", func() {
+
+		It("should send the signals with an opaque ETag", func() {
+			w, reqErrs := exchange("GET", versionedPath(apiV2, signalEndpoint), nil, "")
+			Expect(reqErrs).To(BeEmpty())
+			Expect(w.Code).To(Equal(200))
+
+			w, reqErrs = exchange("GET", versionedPath(apiV2, signalEndpoint), http.Header{"If-None-Match": {w.Header().Get("ETag")}}, "")
+			Expect(reqErrs).To(BeEmpty())
+			Expect(w.Code).To(Equal(304))
+		})
+
+		It("should send errors as problem details", func() {
+			w, _ := exchange("GET", versionedPath(apiV2, signalEndpoint)+"?block=abc", nil, "")
+			Expect(w.Code).To(Equal(400))
+			w, _ = exchange("POST", versionedPath(apiV2, uploadEndpoint), nil, "a trace")
+			Expect(w.Code).To(Equal(400))
+		})
+
+		It("should answer 503 before the first snapshot", func() {
+			apiMan.apiInitialized = false
+			w, _ := exchange("GET", versionedPath(apiV2, signalEndpoint), nil, "")
+			Expect(w.Code).To(Equal(503))
+		})
+
+		It("should pass the status of the storage service through", func() {
+			bsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), defaultBlobServerRoute()).Return(&blobServerResponse{
+				Id: "blob", SignedUrl: "signed"}, nil)
+			bsClient.On("uploadToBlobstore", "signed", mock.Anything).Return(&http.Response{StatusCode: 200}, nil)
+			w, reqErrs := exchange("POST", versionedPath(apiV2, uploadEndpoint),
+				http.Header{UPLOAD_TRACESESSION_HEADER: {"org__env__proxy__rev__0"}}, "a trace")
+			Expect(reqErrs).To(BeEmpty())
+			Expect(w.Code).To(Equal(200))
+		})
+	})
+
+	It("should serve v1 as the unversioned routes", func() {
+		w, reqErrs := exchange("GET", versionedPath(apiV1, signalEndpoint), http.Header{"If-None-Match": {"0,1,2,3,4"}}, "")
+		Expect(reqErrs).To(BeEmpty())
+		Expect(w.Code).To(Equal(304))
+		Expect(w.Header().Get("ETag")).To(Equal(`"0,1,2,3,4"`))
+	})
+
+	It("should document every error code", func() {
+		_, codes := resolveRef(spec, map[string]interface{}{"$ref": "#/components/schemas/ErrorCode"})
+		names := []string{unknownErrorType.Name}
+		for _, errType := range apiErrorCatalog {
+			names = append(names, errType.Name)
+		}
+		Expect(toStrings(codes["enum"])).To(ConsistOf(names))
+	})
+})
@@ -1,24 +1,105 @@
 package apidGatewayTrace
 
 import (
+	"fmt"
 	"github.com/apid/apid-core"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 const (
-	TRACESIGNAL_DB_QUERY = `SELECT id, uri FROM metadata_trace;`
+	TRACESIGNAL_DB_QUERY    = `SELECT id, uri FROM metadata_trace;`
+	TRACESIGNAL_FIND_QUERY  = `SELECT id, uri FROM metadata_trace WHERE id IN (%s);`
+	TRACESIGNAL_COUNT_QUERY = `SELECT COUNT(*) FROM metadata_trace;`
+	TRACE_INDEX_DB_ID       = "apidGatewayTrace"
+	signalsErrorSkipped     = "signals_skipped"
+	metricDbSwitchFailures  = "db_switch_failures"
+	metricTraceIndexPruned  = "trace_index_pruned"
+	configIndexRetention    = "apidgatewaytrace_trace_index_retention"
+	defaultIndexRetention   = 7 * 24 * time.Hour
+	maxIndexPruneInterval   = time.Hour
+	TRACE_INDEX_DDL         = `CREATE TABLE IF NOT EXISTS trace_index (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		session_id TEXT NOT NULL,
+		blob_id TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		size INTEGER NOT NULL,
+		uri TEXT NOT NULL,
+		status_code INTEGER NOT NULL,
+		blob_self TEXT NOT NULL,
+		blob_store TEXT NOT NULL
+	);
+	CREATE INDEX IF NOT EXISTS trace_index_session ON trace_index (session_id, created_at);
+	CREATE INDEX IF NOT EXISTS trace_index_created ON trace_index (created_at);`
+	TRACE_INDEX_INSERT = `INSERT INTO trace_index (session_id, blob_id, created_at, size, uri, status_code,
+		blob_self, blob_store) VALUES (?, ?, ?, ?, ?, ?, ?, ?);`
+	TRACE_INDEX_PRUNE = `DELETE FROM trace_index WHERE created_at < ?;`
+	TRACE_INDEX_QUERY = `SELECT id, session_id, blob_id, created_at, size, uri, status_code, blob_self, blob_store
+		FROM trace_index WHERE %s ORDER BY created_at, id LIMIT ? OFFSET ?;`
 )
 
-//setDbVersion updates the database version so that our database connection connects to the correct sqlite database
-func (dbc *dbManager) setDbVersion(version string) {
+//setDbVersion updates the database version so that our database connection connects to the correct sqlite database.
+//If the new version cannot be opened the previous one stays in use, and the error is kept for health checks until a
+//later snapshot succeeds.  The previous version is released once the queries still running on it finish
+func (dbc *dbManager) setDbVersion(version string) error {
 	db, err := dbc.data.DBVersion(version)
 	if err != nil {
-		log.Panicf("Unable to access database: %v", err)
+		err = errors.Wrapf(err, "unable to access database version %s", version)
+		metrics.inc(metricDbSwitchFailures)
+		dbc.dbMux.Lock()
+		dbc.versionErr = err
+		dbc.dbMux.Unlock()
+		return err
 	}
+
 	dbc.dbMux.Lock()
+	previousVersion, previousQueries := dbc.version, dbc.queries
 	dbc.db = db
+	dbc.version = version
+	dbc.queries = &sync.WaitGroup{}
+	dbc.versionErr = nil
 	dbc.dbMux.Unlock()
+
+	if previousQueries != nil && previousVersion != version {
+		go func() {
+			previousQueries.Wait()
+			log.Debugf("queries on database version %s finished, releasing it", previousVersion)
+			dbc.data.ReleaseDB(previousVersion)
+		}()
+	}
+	return nil
+}
+
+//getDbVersion returns the version of the DB currently in use, empty before the first snapshot
+func (dbc *dbManager) getDbVersion() string {
+	dbc.dbMux.RLock()
+	defer dbc.dbMux.RUnlock()
+	return dbc.version
+}
+
+//getDbError returns why the DB could not be switched to the version of the last snapshot, nil if it was
+func (dbc *dbManager) getDbError() error {
+	dbc.dbMux.RLock()
+	defer dbc.dbMux.RUnlock()
+	return dbc.versionErr
+}
+
+//acquireDb returns the database in use, with a function which must be called once the query on it, including the
+//reading of its rows, is done
+func (dbc *dbManager) acquireDb() (apid.DB, func(), error) {
+	dbc.dbMux.RLock()
+	defer dbc.dbMux.RUnlock()
+	if dbc.db == nil {
+		return nil, nil, errors.New("no snapshot was received yet")
+	}
+	if dbc.queries == nil {
+		return dbc.db, func() {}, nil
+	}
+	dbc.queries.Add(1)
+	return dbc.db, dbc.queries.Done, nil
 }
 
 //getDb is a mutex protected access method to the database client
@@ -28,32 +109,226 @@ func (dbc *dbManager) getDb() apid.DB {
 	return dbc.db
 }
 
-//initDb currently does nothing, but is here as scaffolding in case database manipulation is desired or useful in the future
+//initDb opens the plugin's own database and creates the trace index in it.  The index lives outside the versioned
+//databases maintained by apidApigeeSync, so that it survives the switch to a new snapshot
 func (dbc *dbManager) initDb() error {
+	db, err := dbc.data.DBForID(TRACE_INDEX_DB_ID)
+	if err != nil {
+		return errors.Wrap(err, "unable to open trace index database")
+	}
+	if _, err = db.Exec(TRACE_INDEX_DDL); err != nil {
+		return errors.Wrap(err, "unable to create trace index")
+	}
+	dbc.indexDb = db
 	return nil
 }
 
-//getTraceSignals issues a SQL query to retrieve all trace signals known to apid
+//getTraceSignals issues a SQL query to retrieve all trace signals known to apid.  Rows which cannot be read are
+//skipped and reported in the error of the result, so that a single bad row does not hide every other signal
 func (dbc *dbManager) getTraceSignals() (result getTraceSignalsResult, err error) {
 
 	signals := make([]traceSignal, 0)
 
-	rows, err := dbc.getDb().Query(TRACESIGNAL_DB_QUERY)
+	db, release, err := dbc.acquireDb()
+	if err != nil {
+		return result, err
+	}
+	defer release()
+	rows, err := db.Query(TRACESIGNAL_DB_QUERY)
 	if err != nil {
-		return result, errors.Wrapf(err, "DB Query \"%s\" failed %v", TRACESIGNAL_DB_QUERY)
+		return result, errors.Wrapf(err, "DB Query \"%s\" failed", TRACESIGNAL_DB_QUERY)
 	}
 	defer rows.Close()
 	for rows.Next() {
 		var id, uri string
-		err = rows.Scan(&id, &uri)
-		if err != nil {
-			err = errors.Wrap(err, "failed to scan row")
-			return getTraceSignalsResult{Err: err}, err
+		if err := rows.Scan(&id, &uri); err != nil {
+			log.Errorf("failed to scan trace signal: %v", err)
+			if result.Error == nil {
+				result.Error = &signalsError{Code: signalsErrorSkipped, Message: "some trace signals could not be read"}
+			}
+			result.Error.Skipped++
+			continue
 		}
 		signals = append(signals, traceSignal{Id: id, Uri: uri})
 	}
+	if err = rows.Err(); err != nil {
+		return result, errors.Wrap(err, "failed to read trace signals")
+	}
 
 	result.Signals = signals
+	result.Version = signalsVersion(signals)
+	result.GeneratedAt = time.Now().UTC()
 	log.Debugf("Trace commands %v", signals)
 	return
 }
+
+//countTraceSignals counts the trace signals known to apid, without reading them
+func (dbc *dbManager) countTraceSignals() (int, error) {
+	db, release, err := dbc.acquireDb()
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	var count int
+	if err = db.QueryRow(TRACESIGNAL_COUNT_QUERY).Scan(&count); err != nil {
+		return 0, errors.Wrapf(err, "DB Query \"%s\" failed", TRACESIGNAL_COUNT_QUERY)
+	}
+	return count, nil
+}
+
+//signalsVersion identifies a list of trace signals by the csv of their ids, which is what clients send back as
+//If-None-Match
+func signalsVersion(signals []traceSignal) string {
+	ids := make([]string, len(signals))
+	for i, signal := range signals {
+		ids[i] = signal.Id
+	}
+	return strings.Join(ids, ",")
+}
+
+//findTraceSignal looks up the first active trace signal whose id is one of ids, returning nil if there is none
+func (dbc *dbManager) findTraceSignal(ids ...string) (*traceSignal, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	placeholders := make([]string, len(ids))
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+	query := fmt.Sprintf(TRACESIGNAL_FIND_QUERY, strings.Join(placeholders, ","))
+
+	db, release, err := dbc.acquireDb()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DB Query \"%s\" failed", query)
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	signal := &traceSignal{}
+	if err = rows.Scan(&signal.Id, &signal.Uri); err != nil {
+		return nil, errors.Wrap(err, "failed to scan row")
+	}
+	return signal, nil
+}
+
+//insertTraceRecord adds an uploaded trace to the trace index
+func (dbc *dbManager) insertTraceRecord(record *traceRecord) error {
+	if dbc.indexDb == nil {
+		return errors.New("trace index is not initialized")
+	}
+	res, err := dbc.indexDb.Exec(TRACE_INDEX_INSERT, record.SessionId, record.BlobId,
+		record.Timestamp.UnixNano()/int64(time.Millisecond), record.Size, record.URI, record.StatusCode, record.BlobSelf,
+		record.BlobStore)
+	if err != nil {
+		return errors.Wrap(err, "unable to insert trace record")
+	}
+	record.Id, err = res.LastInsertId()
+	return err
+}
+
+//pruneTraceRecords removes the records of traces uploaded before a time, returning how many were removed
+func (dbc *dbManager) pruneTraceRecords(before time.Time) (int64, error) {
+	if dbc.indexDb == nil {
+		return 0, errors.New("trace index is not initialized")
+	}
+	res, err := dbc.indexDb.Exec(TRACE_INDEX_PRUNE, before.UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to prune trace index")
+	}
+	return res.RowsAffected()
+}
+
+//indexRetention returns how long trace index records are kept, zero keeping every record
+func indexRetention() time.Duration {
+	if config.IsSet(configIndexRetention) {
+		return config.GetDuration(configIndexRetention)
+	}
+	return defaultIndexRetention
+}
+
+//startIndexPruning removes the records older than the configured retention right away and then periodically, so
+//that the trace index does not grow without bound.  The retention is read again before each pass, so that it can be
+//changed by reloading the configuration, and a retention of zero keeps every record
+func (dbc *dbManager) startIndexPruning() {
+	go func() {
+		for {
+			retention := indexRetention()
+			interval := maxIndexPruneInterval
+			if retention > 0 {
+				if retention < interval {
+					interval = retention
+				}
+				pruned, err := dbc.pruneTraceRecords(time.Now().Add(-retention))
+				if err != nil {
+					log.Errorf("%v", err)
+				} else if pruned > 0 {
+					log.Debugf("removed %d trace index records older than %v", pruned, retention)
+					metrics.add(metricTraceIndexPruned, pruned)
+				}
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+//getTraceRecords lists the indexed traces of a session which match the filter, oldest first
+func (dbc *dbManager) getTraceRecords(filter traceRecordFilter) ([]traceRecord, error) {
+	if dbc.indexDb == nil {
+		return nil, errors.New("trace index is not initialized")
+	}
+	conditions := []string{"session_id = ?"}
+	args := []interface{}{filter.SessionId}
+	if filter.URI != "" {
+		conditions = append(conditions, "uri LIKE ? ESCAPE '\\'")
+		args = append(args, escapeLike(filter.URI)+"%")
+	}
+	if filter.MinStatusCode != 0 {
+		conditions = append(conditions, "status_code >= ?")
+		args = append(args, filter.MinStatusCode)
+	}
+	if filter.MaxStatusCode != 0 {
+		conditions = append(conditions, "status_code <= ?")
+		args = append(args, filter.MaxStatusCode)
+	}
+	if !filter.From.IsZero() {
+		conditions = append(conditions, "created_at >= ?")
+		args = append(args, filter.From.UnixNano()/int64(time.Millisecond))
+	}
+	if !filter.To.IsZero() {
+		conditions = append(conditions, "created_at < ?")
+		args = append(args, filter.To.UnixNano()/int64(time.Millisecond))
+	}
+	args = append(args, filter.Limit, filter.Offset)
+	query := fmt.Sprintf(TRACE_INDEX_QUERY, strings.Join(conditions, " AND "))
+
+	rows, err := dbc.indexDb.Query(query, args...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "DB Query \"%s\" failed", query)
+	}
+	defer rows.Close()
+	records := make([]traceRecord, 0)
+	for rows.Next() {
+		var record traceRecord
+		var createdAt int64
+		if err = rows.Scan(&record.Id, &record.SessionId, &record.BlobId, &createdAt, &record.Size, &record.URI,
+			&record.StatusCode, &record.BlobSelf, &record.BlobStore); err != nil {
+			return nil, errors.Wrap(err, "failed to scan row")
+		}
+		record.Timestamp = time.Unix(0, createdAt*int64(time.Millisecond)).UTC()
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+//escapeLike escapes the wildcards of a SQL LIKE pattern
+func escapeLike(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(value)
+}
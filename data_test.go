@@ -1,12 +1,13 @@
 package apidGatewayTrace
 
 import (
+	"github.com/apid/apid-core"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
-	"github.com/apid/apid-core"
 	"io/ioutil"
 	"strconv"
 	"sync"
+	"time"
 )
 
 var _ = Describe("DBManager", func() {
@@ -35,19 +36,191 @@ var _ = Describe("DBManager", func() {
 			Expect(err).To(Succeed())
 			dbMan.setDbVersion(dataTestTempDir)
 			Expect(dbShouldEqual).To(Equal(dbMan.getDb()))
+			Expect(dbMan.getDbVersion()).To(Equal(dataTestTempDir))
+
+		})
+
+		It("should keep the previous DB when a version cannot be opened", func() {
+			db := dbMan.getDb()
+			failures := metrics.get(metricDbSwitchFailures)
+			Expect(dbMan.setDbVersion("base")).ToNot(Succeed())
+			Expect(dbMan.getDb()).To(Equal(db))
+			Expect(dbMan.getDbVersion()).To(Equal(dataTestTempDir))
+			Expect(dbMan.getDbError()).ToNot(BeNil())
+			Expect(metrics.get(metricDbSwitchFailures)).To(Equal(failures + 1))
+			result, err := dbMan.getTraceSignals()
+			Expect(err).To(Succeed())
+			Expect(result.Signals).ToNot(BeEmpty())
+
+			Expect(dbMan.setDbVersion(dataTestTempDir)).To(Succeed())
+			Expect(dbMan.getDbError()).To(BeNil())
+		})
+
+		It("should let queries finish on the previous DB", func() {
+			previous, release, err := dbMan.acquireDb()
+			Expect(err).To(Succeed())
+			queries := dbMan.queries
+			next, err := ioutil.TempDir(testTempDirBase, "sqlite3")
+			Expect(err).To(Succeed())
+			Expect(dbMan.setDbVersion(next)).To(Succeed())
+			Expect(dbMan.getDb()).ToNot(Equal(previous))
+
+			drained := make(chan bool)
+			go func() {
+				queries.Wait()
+				close(drained)
+			}()
+			Consistently(drained).ShouldNot(BeClosed())
+			rows, err := previous.Query(TRACESIGNAL_DB_QUERY)
+			Expect(err).To(Succeed())
+			rows.Close()
+			release()
+			Eventually(drained).Should(BeClosed())
+		})
+
+		It("should release the previous version once its queries finished", func() {
+			data := &releaseRecorder{DataService: dbMan.data, released: make(chan string, 1)}
+			dbMan.data = data
+			_, release, err := dbMan.acquireDb()
+			Expect(err).To(Succeed())
+			next, err := ioutil.TempDir(testTempDirBase, "sqlite3")
+			Expect(err).To(Succeed())
+			Expect(dbMan.setDbVersion(next)).To(Succeed())
+			Consistently(data.released).ShouldNot(Receive())
+			release()
+			Eventually(data.released).Should(Receive(Equal(dataTestTempDir)))
+
+			//switching to the version in use releases nothing
+			Expect(dbMan.setDbVersion(next)).To(Succeed())
+			Consistently(data.released).ShouldNot(Receive())
+		})
 
+		It("should fail queries before the first snapshot", func() {
+			_, err := (&dbManager{}).getTraceSignals()
+			Expect(err).ToNot(Succeed())
 		})
 
 		It("should fetch data", func() {
 			result, err := dbMan.getTraceSignals()
 			Expect(err).To(Succeed())
-			Expect(result.Err).To(Succeed())
+			Expect(result.Error).To(BeNil())
+			Expect(result.Version).To(Equal("0,1,2,3,4"))
 			Expect(result.Signals).ToNot(BeNil())
 			for index, signal := range result.Signals {
 				Expect(signal.Id).To(Equal(strconv.Itoa(index)))
 				Expect(signal.Uri).To(Equal("uri" + strconv.Itoa(index)))
 			}
 		})
+
+		It("should count trace signals", func() {
+			count, err := dbMan.countTraceSignals()
+			Expect(err).To(Succeed())
+			Expect(count).To(Equal(5))
+			_, err = (&dbManager{}).countTraceSignals()
+			Expect(err).ToNot(Succeed())
+		})
+
+		It("should skip trace signals which cannot be read", func() {
+			_, err := dbMan.getDb().Exec("INSERT INTO metadata_trace (id, uri) VALUES ('5', NULL);")
+			Expect(err).To(Succeed())
+			result, err := dbMan.getTraceSignals()
+			Expect(err).To(Succeed())
+			Expect(result.Signals).To(HaveLen(5))
+			Expect(result.Error).To(Equal(&signalsError{Code: signalsErrorSkipped, Message: "some trace signals could not be read", Skipped: 1}))
+		})
+	})
+
+	Context("Trace index", func() {
+
+		var dbMan *dbManager
+		base := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+
+		BeforeEach(func() {
+			dbMan = &dbManager{
+				data:  services.Data(),
+				dbMux: sync.RWMutex{},
+			}
+			Expect(dbMan.initDb()).To(Succeed())
+			_, err := dbMan.indexDb.Exec("DELETE FROM trace_index;")
+			Expect(err).To(Succeed())
+
+			for i, status := range []int{200, 404, 500, 201} {
+				record := &traceRecord{
+					SessionId:  "org__env__app__rev__id",
+					BlobId:     "blob" + strconv.Itoa(i),
+					Timestamp:  base.Add(time.Duration(i) * time.Minute),
+					Size:       int64(100 * i),
+					URI:        "/v" + strconv.Itoa(i%2+1) + "/orders_" + strconv.Itoa(i),
+					StatusCode: status,
+					BlobSelf:   "/blobs/blob" + strconv.Itoa(i),
+					BlobStore:  "gcs",
+				}
+				Expect(dbMan.insertTraceRecord(record)).To(Succeed())
+				Expect(record.Id).ToNot(BeZero())
+			}
+			Expect(dbMan.insertTraceRecord(&traceRecord{SessionId: "other", BlobId: "blob", Timestamp: base})).To(Succeed())
+		})
+
+		blobIds := func(records []traceRecord) []string {
+			ids := make([]string, len(records))
+			for i, record := range records {
+				ids[i] = record.BlobId
+			}
+			return ids
+		}
+
+		It("should list the records of a session in upload order", func() {
+			records, err := dbMan.getTraceRecords(traceRecordFilter{SessionId: "org__env__app__rev__id", Limit: 10})
+			Expect(err).To(Succeed())
+			Expect(blobIds(records)).To(Equal([]string{"blob0", "blob1", "blob2", "blob3"}))
+			Expect(records[1].Timestamp).To(Equal(base.Add(time.Minute)))
+			Expect(records[1].Size).To(Equal(int64(100)))
+			Expect(records[1].URI).To(Equal("/v2/orders_1"))
+			Expect(records[1].StatusCode).To(Equal(404))
+			Expect(records[1].BlobSelf).To(Equal("/blobs/blob1"))
+			Expect(records[1].BlobStore).To(Equal("gcs"))
+		})
+
+		It("should prune records older than the retention", func() {
+			pruned, err := dbMan.pruneTraceRecords(base.Add(2 * time.Minute))
+			Expect(err).To(Succeed())
+			Expect(pruned).To(Equal(int64(3)))
+			records, err := dbMan.getTraceRecords(traceRecordFilter{SessionId: "org__env__app__rev__id", Limit: 10})
+			Expect(err).To(Succeed())
+			Expect(blobIds(records)).To(Equal([]string{"blob2", "blob3"}))
+			records, err = dbMan.getTraceRecords(traceRecordFilter{SessionId: "other", Limit: 10})
+			Expect(err).To(Succeed())
+			Expect(records).To(BeEmpty())
+		})
+
+		It("should page through records", func() {
+			records, err := dbMan.getTraceRecords(traceRecordFilter{SessionId: "org__env__app__rev__id", Limit: 3, Offset: 2})
+			Expect(err).To(Succeed())
+			Expect(blobIds(records)).To(Equal([]string{"blob2", "blob3"}))
+		})
+
+		It("should filter records", func() {
+			filter := traceRecordFilter{SessionId: "org__env__app__rev__id", Limit: 10, MinStatusCode: 400, MaxStatusCode: 599}
+			records, err := dbMan.getTraceRecords(filter)
+			Expect(err).To(Succeed())
+			Expect(blobIds(records)).To(Equal([]string{"blob1", "blob2"}))
+
+			filter = traceRecordFilter{SessionId: "org__env__app__rev__id", Limit: 10, URI: "/v1/"}
+			records, err = dbMan.getTraceRecords(filter)
+			Expect(err).To(Succeed())
+			Expect(blobIds(records)).To(Equal([]string{"blob0", "blob2"}))
+
+			filter = traceRecordFilter{SessionId: "org__env__app__rev__id", Limit: 10, URI: "/v1/orders%"}
+			records, err = dbMan.getTraceRecords(filter)
+			Expect(err).To(Succeed())
+			Expect(records).To(BeEmpty())
+
+			filter = traceRecordFilter{SessionId: "org__env__app__rev__id", Limit: 10,
+				From: base.Add(time.Minute), To: base.Add(3 * time.Minute)}
+			records, err = dbMan.getTraceRecords(filter)
+			Expect(err).To(Succeed())
+			Expect(blobIds(records)).To(Equal([]string{"blob1", "blob2"}))
+		})
 	})
 
 })
@@ -60,3 +233,13 @@ func setupTestDb(db apid.DB) {
 	_, err = db.Exec(query)
 	Expect(err).Should(Succeed())
 }
+
+//releaseRecorder reports the database versions released through it
+type releaseRecorder struct {
+	apid.DataService
+	released chan string
+}
+
+func (rr *releaseRecorder) ReleaseDB(version string) {
+	rr.released <- version
+}
@@ -0,0 +1,339 @@
+package apidGatewayTrace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	configDeadLetterDir         = "apidgatewaytrace_dead_letter_dir"
+	configDeadLetterMaxEntries  = "apidgatewaytrace_dead_letter_max_entries"
+	defaultDeadLetterMaxEntries = 100
+	deadLetterEntrySuffix       = ".json"
+	deadLetterPayloadSuffix     = ".trace"
+	metricDeadLettersWritten    = "dead_letters_written"
+	metricDeadLettersEvicted    = "dead_letters_evicted"
+	metricDeadLettersReplayed   = "dead_letters_replayed"
+)
+
+//deadLetterEntry describes an upload which blobstore did not accept.  Its payload, the trace as it left the upload
+//stages, is kept next to it in a file of its own.  Stored names the destinations which did get the trace, and are
+//skipped when it is replayed
+type deadLetterEntry struct {
+	Id           string               `json:"id"`
+	SessionId    string               `json:"sessionId"`
+	Metadata     blobCreationMetadata `json:"metadata"`
+	Stored       []string             `json:"stored,omitempty"`
+	Error        string               `json:"error"`
+	Attempts     int                  `json:"attempts"`
+	Size         int64                `json:"size"`
+	FirstFailure time.Time            `json:"firstFailure"`
+	LastFailure  time.Time            `json:"lastFailure"`
+}
+
+//deadLetterReplayResult reports the outcome of replaying one dead letter
+type deadLetterReplayResult struct {
+	Id       string `json:"id"`
+	Replayed bool   `json:"replayed"`
+	BlobId   string `json:"blobId,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+//deadLetterBatchResult acknowledges the replay of several dead letters, which goes on in the background
+type deadLetterBatchResult struct {
+	Queued int `json:"queued"`
+}
+
+//deadLetterFilter selects the dead letters of an org and env, an empty one matching any
+type deadLetterFilter struct {
+	Organization string
+	Environment  string
+}
+
+//deadLetterFilterOf reads the filter of a dead-letter request from its org and env query parameters
+func deadLetterFilterOf(r *http.Request) deadLetterFilter {
+	query := r.URL.Query()
+	return deadLetterFilter{Organization: query.Get("org"), Environment: query.Get("env")}
+}
+
+//matches tells whether a dead letter passes the filter
+func (filter deadLetterFilter) matches(entry *deadLetterEntry) bool {
+	return (filter.Organization == "" || filter.Organization == entry.Metadata.Organization) &&
+		(filter.Environment == "" || filter.Environment == entry.Metadata.Environment)
+}
+
+//deadLetterStore keeps failed uploads in a directory, evicting the oldest entries beyond the configured maximum
+type deadLetterStore struct {
+	dir        string
+	maxEntries int
+	mux        sync.Mutex
+	replayMux  sync.Mutex
+	batching   bool
+	now        func() time.Time
+}
+
+//newDeadLetterStore creates the deadLetterStore, returning nil if no dead-letter directory is configured
+func newDeadLetterStore() (*deadLetterStore, error) {
+	dir := config.GetString(configDeadLetterDir)
+	if dir == "" {
+		return nil, nil
+	}
+	maxEntries := defaultDeadLetterMaxEntries
+	if config.IsSet(configDeadLetterMaxEntries) {
+		maxEntries = config.GetInt(configDeadLetterMaxEntries)
+	}
+	if maxEntries < 1 {
+		return nil, fmt.Errorf("%s must be at least 1", configDeadLetterMaxEntries)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "unable to create dead-letter directory %s", dir)
+	}
+	return &deadLetterStore{dir: dir, maxEntries: maxEntries, now: time.Now}, nil
+}
+
+//add stores a failed upload.  Entry ids start with the time of the failure, so that they sort oldest first
+func (ds *deadLetterStore) add(upload *traceUpload, payload []byte, uploadErr error) (*deadLetterEntry, error) {
+	now := ds.now().UTC()
+	entry := &deadLetterEntry{
+		Id:           fmt.Sprintf("%019d-%s", now.UnixNano(), sanitizeFileName(upload.sessionId.Raw)),
+		SessionId:    upload.sessionId.Raw,
+		Metadata:     upload.metadata,
+		Stored:       upload.stored,
+		Error:        uploadErr.Error(),
+		Attempts:     1,
+		Size:         int64(len(payload)),
+		FirstFailure: now,
+		LastFailure:  now,
+	}
+	if ue, ok := uploadErr.(*uploadError); ok && ue.cause != nil {
+		entry.Error = ue.cause.Error()
+	}
+
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+	if err := ioutil.WriteFile(ds.path(entry.Id, deadLetterPayloadSuffix), payload, 0600); err != nil {
+		return nil, err
+	}
+	if err := ds.write(entry); err != nil {
+		os.Remove(ds.path(entry.Id, deadLetterPayloadSuffix))
+		return nil, err
+	}
+	metrics.inc(metricDeadLettersWritten)
+
+	ids, err := ds.ids()
+	if err != nil {
+		return entry, err
+	}
+	for len(ids) > ds.maxEntries {
+		log.Errorf("dead-letter directory full, dropping %s", ids[0])
+		ds.remove(ids[0])
+		metrics.inc(metricDeadLettersEvicted)
+		ids = ids[1:]
+	}
+	return entry, nil
+}
+
+//list returns the dead letters which match the filter, oldest first
+func (ds *deadLetterStore) list(filter deadLetterFilter) ([]deadLetterEntry, error) {
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+	ids, err := ds.ids()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]deadLetterEntry, 0, len(ids))
+	for _, id := range ids {
+		entry, err := ds.read(id)
+		if err != nil {
+			log.Errorf("skipping unreadable dead letter %s: %v", id, err)
+			continue
+		}
+		if !filter.matches(entry) {
+			continue
+		}
+		entries = append(entries, *entry)
+	}
+	return entries, nil
+}
+
+//count returns the number of dead letters, without reading them
+func (ds *deadLetterStore) count() (int, error) {
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+	ids, err := ds.ids()
+	return len(ids), err
+}
+
+//get returns a dead letter and its payload, or a nil entry if there is no such dead letter
+func (ds *deadLetterStore) get(id string) (*deadLetterEntry, []byte, error) {
+	if id == "" || sanitizeFileName(id) != id {
+		return nil, nil, nil
+	}
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+	entry, err := ds.read(id)
+	if os.IsNotExist(errors.Cause(err)) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	payload, err := ioutil.ReadFile(ds.path(id, deadLetterPayloadSuffix))
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "unable to read payload of dead letter %s", id)
+	}
+	return entry, payload, nil
+}
+
+//failed records another unsuccessful attempt at uploading a dead letter
+func (ds *deadLetterStore) failed(entry *deadLetterEntry, err error) error {
+	entry.Attempts++
+	entry.LastFailure = ds.now().UTC()
+	entry.Error = err.Error()
+	if ue, ok := err.(*uploadError); ok && ue.cause != nil {
+		entry.Error = ue.cause.Error()
+	}
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+	return ds.write(entry)
+}
+
+//delete removes a dead letter once it was replayed
+func (ds *deadLetterStore) delete(id string) {
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+	ds.remove(id)
+}
+
+//startBatch claims the replay of a batch of dead letters, returning false if another batch is still running
+func (ds *deadLetterStore) startBatch() bool {
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+	if ds.batching {
+		return false
+	}
+	ds.batching = true
+	return true
+}
+
+//endBatch releases the claim of startBatch
+func (ds *deadLetterStore) endBatch() {
+	ds.mux.Lock()
+	defer ds.mux.Unlock()
+	ds.batching = false
+}
+
+//ids lists the ids of the stored dead letters, oldest first.  Callers must hold the mutex
+func (ds *deadLetterStore) ids() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(ds.dir, "*"+deadLetterEntrySuffix))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(files))
+	for i, file := range files {
+		ids[i] = strings.TrimSuffix(filepath.Base(file), deadLetterEntrySuffix)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (ds *deadLetterStore) read(id string) (*deadLetterEntry, error) {
+	data, err := ioutil.ReadFile(ds.path(id, deadLetterEntrySuffix))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	entry := &deadLetterEntry{}
+	if err = json.Unmarshal(data, entry); err != nil {
+		return nil, errors.Wrapf(err, "invalid dead letter %s", id)
+	}
+	return entry, nil
+}
+
+//write saves an entry through a temporary file, so that a crash never leaves a truncated entry behind
+func (ds *deadLetterStore) write(entry *deadLetterEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	tmp := ds.path(entry.Id, deadLetterEntrySuffix+".tmp")
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, ds.path(entry.Id, deadLetterEntrySuffix))
+}
+
+func (ds *deadLetterStore) remove(id string) {
+	os.Remove(ds.path(id, deadLetterEntrySuffix))
+	os.Remove(ds.path(id, deadLetterPayloadSuffix))
+}
+
+func (ds *deadLetterStore) path(id, suffix string) string {
+	return filepath.Join(ds.dir, id+suffix)
+}
+
+//replayDeadLetter uploads a dead letter again to the upload destinations which did not store it, deleting it once
+//every required destination did
+func (a *apiManager) replayDeadLetter(c *apiComponents, id string) (deadLetterReplayResult, error) {
+	c.deadLetters.replayMux.Lock()
+	defer c.deadLetters.replayMux.Unlock()
+
+	result := deadLetterReplayResult{Id: id}
+	entry, payload, err := c.deadLetters.get(id)
+	if err != nil || entry == nil {
+		return result, err
+	}
+	sessionId, err := parseDebugSessionId(entry.SessionId)
+	if err != nil {
+		return result, errors.Wrapf(err, "invalid session of dead letter %s", id)
+	}
+	upload := &traceUpload{sessionId: sessionId, metadata: entry.Metadata, body: bytes.NewReader(payload),
+		stored: entry.Stored}
+
+	stored, size, err := a.fanOut(c, upload)
+	if err != nil {
+		result.Error = err.Error()
+		entry.Stored = upload.stored
+		if ferr := c.deadLetters.failed(entry, err); ferr != nil {
+			log.Errorf("unable to update dead letter %s: %v", id, ferr)
+		}
+		return result, nil
+	}
+	metrics.inc(metricDeadLettersReplayed)
+	c.deadLetters.delete(id)
+	result.Replayed = true
+	if stored == nil {
+		log.Infof("replayed dead letter %s of %s, already stored by every required destination", id, entry.SessionId)
+		return result, nil
+	}
+	stored.close()
+	log.Infof("replayed dead letter %s of %s as blob %s", id, entry.SessionId, stored.blob.Id)
+	a.indexUpload(upload, stored.blob, size)
+	result.BlobId = stored.blob.Id
+	return result, nil
+}
+
+//replayDeadLetters replays a batch of dead letters one after the other, ending the batch once done.  Outcomes are
+//logged, and failures recorded in the entries
+func (a *apiManager) replayDeadLetters(c *apiComponents, ids []string) {
+	defer c.deadLetters.endBatch()
+	replayed := 0
+	for _, id := range ids {
+		result, err := a.replayDeadLetter(c, id)
+		if err != nil {
+			log.Errorf("unable to replay dead letter %s: %v", id, err)
+		} else if result.Replayed {
+			replayed++
+		}
+	}
+	log.Infof("replayed %d of %d dead letters", replayed, len(ids))
+}
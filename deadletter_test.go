@@ -0,0 +1,236 @@
+package apidGatewayTrace
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/gorilla/mux"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Dead letters", func() {
+
+	var dir string
+	var mockBsClient *mockBlobstoreClient
+	var apiMan *apiManager
+
+	//each request is routed by a router of its own, with the routes of the apiManager of the running test
+	serveAs := func(token, method, path string) *httptest.ResponseRecorder {
+		router := mux.NewRouter()
+		for _, route := range apiMan.routes() {
+			router.HandleFunc(route.path, route.handler).Methods(route.method)
+		}
+		r := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			r.Header.Set(ADMIN_TOKEN_HEADER, token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		return serveAs("admin-secret", method, path)
+	}
+
+	upload := func(trace string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/uploadtrace", strings.NewReader(trace))
+		r.Header.Add(UPLOAD_TRACESESSION_HEADER, "org__env__app__rev__id")
+		w := httptest.NewRecorder()
+		apiMan.apiUploadTraceDataEndpoint(w, r)
+		return w
+	}
+
+	list := func(query string) []deadLetterEntry {
+		w := serve("GET", deadLettersEndpoint+query)
+		Expect(w.Code).To(Equal(200))
+		var entries []deadLetterEntry
+		Expect(json.Unmarshal(w.Body.Bytes(), &entries)).To(Succeed())
+		return entries
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir(testTempDirBase, "deadletters")
+		Expect(err).To(Succeed())
+		config.Set(configDeadLetterDir, dir)
+		config.Set(configDeadLetterMaxEntries, 2)
+		store, err := newDeadLetterStore()
+		Expect(err).To(Succeed())
+		mockBsClient = &mockBlobstoreClient{}
+		mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), defaultBlobServerRoute()).Return(&blobServerResponse{Id: "testblob", SignedUrl: "testurl"}, nil)
+		apiMan = &apiManager{
+			bsClient:            mockBsClient,
+			deadLetters:         store,
+			deadLettersEndpoint: deadLettersEndpoint,
+			auth:                &callerAuthenticator{mode: authModeNone, adminToken: "admin-secret"},
+		}
+	})
+
+	AfterEach(func() {
+		config.Set(configDeadLetterDir, "")
+		config.Set(configDeadLetterMaxEntries, defaultDeadLetterMaxEntries)
+	})
+
+	It("should keep failed uploads and replay them", func() {
+		mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Return((*http.Response)(nil), errors.New("storage unavailable")).Once()
+		Expect(upload("a trace").Code).To(Equal(500))
+
+		entries := list("")
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].SessionId).To(Equal("org__env__app__rev__id"))
+		Expect(entries[0].Error).To(ContainSubstring("storage unavailable"))
+		Expect(entries[0].Attempts).To(Equal(1))
+		Expect(entries[0].Size).To(Equal(int64(7)))
+		Expect(entries[0].Metadata.Organization).To(Equal("org"))
+
+		mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Return((*http.Response)(nil), errors.New("still unavailable")).Once()
+		w := serve("POST", deadLettersEndpoint+"/"+entries[0].Id+"/replay")
+		Expect(w.Code).To(Equal(200))
+		Expect(w.Body.String()).To(ContainSubstring(`"replayed":false`))
+		entries = list("")
+		Expect(entries[0].Attempts).To(Equal(2))
+		Expect(entries[0].Error).To(ContainSubstring("still unavailable"))
+
+		replayed := make(chan string, 1)
+		mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Run(func(args mock.Arguments) {
+			b, _ := ioutil.ReadAll(args.Get(1).(io.Reader))
+			replayed <- string(b)
+		}).Return(&http.Response{StatusCode: 200}, nil).Once()
+		w = serve("POST", deadLettersEndpoint+"/replay")
+		Expect(w.Code).To(Equal(http.StatusAccepted))
+		Expect(w.Body.String()).To(MatchJSON(`{"queued":1}`))
+		Eventually(replayed).Should(Receive(Equal("a trace")))
+		Eventually(func() []deadLetterEntry { return list("") }).Should(BeEmpty())
+	})
+
+	It("should replay only to the destinations which did not store the trace", func() {
+		routeTo := func(baseURI string) interface{} {
+			return mock.MatchedBy(func(route blobServerRoute) bool { return route.BaseURI == baseURI })
+		}
+		destinations, err := checkUploadDestinations([]uploadDestination{
+			{Name: "legacy", BaseURI: "https://legacy", Required: true},
+			{Name: "new", BaseURI: "https://new"},
+		})
+		Expect(err).To(Succeed())
+		apiMan.destinations = destinations
+		mockBsClient = &mockBlobstoreClient{}
+		apiMan.bsClient = mockBsClient
+		for _, name := range []string{"legacy", "new"} {
+			mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), routeTo("https://"+name)).Return(
+				&blobServerResponse{Id: name + "-blob", SignedUrl: "signed-" + name}, nil)
+		}
+		mockBsClient.On("uploadToBlobstore", "signed-new", mock.Anything).Return(&http.Response{StatusCode: 200}, nil).Once()
+		mockBsClient.On("uploadToBlobstore", "signed-legacy", mock.Anything).Return((*http.Response)(nil), errors.New("storage unavailable")).Once()
+		Expect(upload("a trace").Code).To(Equal(500))
+		entries := list("")
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Stored).To(Equal([]string{"new"}))
+
+		mockBsClient.On("uploadToBlobstore", "signed-legacy", mock.Anything).Return(&http.Response{StatusCode: 200}, nil).Once()
+		w := serve("POST", deadLettersEndpoint+"/"+entries[0].Id+"/replay")
+		Expect(w.Code).To(Equal(200))
+		Expect(w.Body.String()).To(MatchJSON(`[{"id":"` + entries[0].Id + `","replayed":true,"blobId":"legacy-blob"}]`))
+		mockBsClient.AssertNumberOfCalls(GinkgoT(), "uploadToBlobstore", 3)
+		mockBsClient.AssertNumberOfCalls(GinkgoT(), "getSignedURL", 3)
+		Expect(list("")).To(BeEmpty())
+	})
+
+	It("should replay one batch of dead letters at a time", func() {
+		mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Return((*http.Response)(nil), errors.New("storage unavailable")).Once()
+		Expect(upload("a trace").Code).To(Equal(500))
+
+		release := make(chan struct{})
+		mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Run(func(args mock.Arguments) {
+			<-release
+		}).Return(&http.Response{StatusCode: 200}, nil).Once()
+		Expect(serve("POST", deadLettersEndpoint+"/replay").Code).To(Equal(http.StatusAccepted))
+		w := serve("POST", deadLettersEndpoint+"/replay")
+		Expect(w.Code).To(Equal(http.StatusConflict))
+		var errResp errorResponse
+		Expect(json.Unmarshal(w.Body.Bytes(), &errResp)).To(Succeed())
+		Expect(errResp.ErrorCode).To(Equal(API_ERR_REPLAY_IN_PROGRESS))
+
+		close(release)
+		Eventually(func() []deadLetterEntry { return list("") }).Should(BeEmpty())
+		Eventually(func() int { return serve("POST", deadLettersEndpoint+"/replay").Code }).Should(Equal(http.StatusAccepted))
+	})
+
+	It("should evict the oldest entries beyond the maximum", func() {
+		now := time.Now()
+		apiMan.deadLetters.now = func() time.Time {
+			now = now.Add(time.Millisecond)
+			return now
+		}
+		mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Return((*http.Response)(nil), errors.New("storage unavailable"))
+		for _, trace := range []string{"first", "second", "third"} {
+			upload(trace)
+		}
+		entries := list("")
+		Expect(entries).To(HaveLen(2))
+		_, payload, err := apiMan.deadLetters.get(entries[0].Id)
+		Expect(err).To(Succeed())
+		Expect(string(payload)).To(Equal("second"))
+	})
+
+	It("should list and replay the dead letters of an org and env", func() {
+		mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Return((*http.Response)(nil), errors.New("storage unavailable")).Once()
+		Expect(upload("a trace").Code).To(Equal(500))
+
+		Expect(list("?org=org&env=env")).To(HaveLen(1))
+		Expect(list("?org=org")).To(HaveLen(1))
+		Expect(list("?org=other")).To(BeEmpty())
+		Expect(list("?org=org&env=other")).To(BeEmpty())
+
+		w := serve("POST", deadLettersEndpoint+"/replay?org=other")
+		Expect(w.Code).To(Equal(http.StatusAccepted))
+		Expect(w.Body.String()).To(MatchJSON(`{"queued":0}`))
+		Consistently(func() []deadLetterEntry { return list("") }).Should(HaveLen(1))
+	})
+
+	It("should only serve callers presenting the admin token", func() {
+		for _, request := range []struct{ method, path string }{
+			{"GET", deadLettersEndpoint},
+			{"POST", deadLettersEndpoint + "/replay"},
+			{"POST", deadLettersEndpoint + "/some-id/replay"},
+		} {
+			Expect(serveAs("", request.method, request.path).Code).To(Equal(http.StatusUnauthorized))
+			Expect(serveAs("wrong", request.method, request.path).Code).To(Equal(http.StatusUnauthorized))
+		}
+
+		apiMan.auth = &callerAuthenticator{mode: authModeNone}
+		Expect(serve("GET", deadLettersEndpoint).Code).To(Equal(http.StatusUnauthorized))
+		apiMan.auth = nil
+		Expect(serve("GET", deadLettersEndpoint).Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should not keep uploads rejected before reaching blobstore", func() {
+		apiMan.stages = []uploadStage{&validationStage{}}
+		Expect(upload("<Completed>").Code).To(Equal(http.StatusUnprocessableEntity))
+		Expect(list("")).To(BeEmpty())
+	})
+
+	It("should report unknown entries and a disabled store", func() {
+		Expect(serve("POST", deadLettersEndpoint+"/unknown/replay").Code).To(Equal(404))
+		entry, _, err := apiMan.deadLetters.get("../escape")
+		Expect(err).To(Succeed())
+		Expect(entry).To(BeNil())
+		apiMan.deadLetters = nil
+		for _, w := range []*httptest.ResponseRecorder{
+			serve("GET", deadLettersEndpoint),
+			serve("POST", deadLettersEndpoint+"/unknown/replay"),
+		} {
+			Expect(w.Code).To(Equal(404))
+			var errResp errorResponse
+			Expect(json.Unmarshal(w.Body.Bytes(), &errResp)).To(Succeed())
+			Expect(errResp.ErrorCode).To(Equal(API_ERR_DEAD_LETTERS_DISABLED))
+		}
+	})
+})
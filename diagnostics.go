@@ -0,0 +1,212 @@
+package apidGatewayTrace
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	metricBlockedSubscribers  = "blocked_subscribers"
+	metricAsyncUploadsPending = "async_uploads_pending"
+	metricLastSnapshotTime    = "last_snapshot_time_ms"
+	metricLastChangeListTime  = "last_changelist_time_ms"
+	blobServerCheckTimeout    = 5 * time.Second
+	maskedSecret              = "****"
+)
+
+//diagnosticsResult describes the internal state of the plugin, for operators investigating it in production
+type diagnosticsResult struct {
+	DbVersion          string             `json:"dbVersion"`
+	DbError            string             `json:"dbError,omitempty"`
+	ApiInitialized     bool               `json:"apiInitialized"`
+	BlockedSubscribers int64              `json:"blockedSubscribers"`
+	ActiveSignals      int                `json:"activeSignals"`
+	SignalsError       string             `json:"signalsError,omitempty"`
+	LastSnapshot       *time.Time         `json:"lastSnapshot,omitempty"`
+	LastChangeList     *time.Time         `json:"lastChangeList,omitempty"`
+	BlobServers        []blobServerStatus `json:"blobServers"`
+	LastProbe          *time.Time         `json:"lastProbe,omitempty"`
+	Queues             queueDepths        `json:"queues"`
+	Config             *pluginConfig      `json:"config,omitempty"`
+	Metrics            map[string]int64   `json:"metrics"`
+}
+
+//blobServerStatus tells whether one blob server answered.  Any HTTP status counts as reachable.  Required blob
+//servers are those a required destination uploads to
+type blobServerStatus struct {
+	BaseURI    string `json:"baseUri"`
+	Required   bool   `json:"required"`
+	Reachable  bool   `json:"reachable"`
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+//queueDepths counts the traces the plugin holds on to
+type queueDepths struct {
+	DeadLetters  int   `json:"deadLetters"`
+	AsyncUploads int64 `json:"asyncUploads"`
+}
+
+//apiGetDiagnosticsEndpoint is the API implementation reporting the internal state of the plugin.  Blob servers are
+//reported as of the last probe of the health monitor rather than probed again, so that the endpoint stays cheap
+func (a *apiManager) apiGetDiagnosticsEndpoint(w http.ResponseWriter, r *http.Request) {
+	c := a.components()
+	values := metrics.snapshot()
+	result := diagnosticsResult{
+		ApiInitialized:     a.isReady(),
+		BlockedSubscribers: values[metricBlockedSubscribers],
+		LastSnapshot:       metricTime(values[metricLastSnapshotTime]),
+		LastChangeList:     metricTime(values[metricLastChangeListTime]),
+		Queues:             queueDepths{AsyncUploads: values[metricAsyncUploadsPending]},
+		Metrics:            values,
+	}
+	result.BlobServers, result.LastProbe = a.healthMonitor.lastStatuses()
+	if a.dbMan != nil {
+		result.DbVersion = a.dbMan.getDbVersion()
+		if err := a.dbMan.getDbError(); err != nil {
+			result.DbError = err.Error()
+		}
+		signals, err := a.dbMan.countTraceSignals()
+		if err != nil {
+			log.Errorf("unable to count trace signals: %v", err)
+			result.SignalsError = "unable to read trace signals"
+		}
+		result.ActiveSignals = signals
+	}
+	if c.deadLetters != nil {
+		count, err := c.deadLetters.count()
+		if err != nil {
+			log.Errorf("unable to count dead letters: %v", err)
+		}
+		result.Queues.DeadLetters = count
+	}
+	if c.config != nil {
+		result.Config = c.config.masked()
+	}
+	writeJSON(w, r, http.StatusOK, result)
+}
+
+//checkBlobServers checks every blob server uploads may be sent to, concurrently
+func checkBlobServers(c *apiComponents) []blobServerStatus {
+	destinations := c.destinations
+	if len(destinations) == 0 {
+		destinations = defaultDestinations
+	}
+	//the servers of the routing table are used by every destination without a base URI
+	routedRequired := false
+	for _, dest := range destinations {
+		routedRequired = routedRequired || (dest.BaseURI == "" && dest.Required)
+	}
+	routes := c.router.blobServers()
+	required := make([]bool, len(routes))
+	for i := range required {
+		required[i] = routedRequired
+	}
+	for _, dest := range destinations {
+		if dest.BaseURI != "" {
+			routes = append(routes, dest.route())
+			required = append(required, dest.Required)
+		}
+	}
+
+	seen := make(map[string]int)
+	statuses := make([]blobServerStatus, 0, len(routes))
+	checked := make([]blobServerRoute, 0, len(routes))
+	for i, route := range routes {
+		if j, ok := seen[route.BaseURI]; ok {
+			statuses[j].Required = statuses[j].Required || required[i]
+			continue
+		}
+		seen[route.BaseURI] = len(statuses)
+		statuses = append(statuses, blobServerStatus{BaseURI: route.BaseURI, Required: required[i]})
+		checked = append(checked, route)
+	}
+	if c.bsClient == nil {
+		return statuses
+	}
+
+	wg := sync.WaitGroup{}
+	for i := range checked {
+		wg.Add(1)
+		go func(status *blobServerStatus, route blobServerRoute) {
+			defer wg.Done()
+			code, err := c.bsClient.checkBlobServer(route)
+			if err != nil {
+				status.Error = err.Error()
+				return
+			}
+			status.Reachable = true
+			status.StatusCode = code
+		}(&statuses[i], checked[i])
+	}
+	wg.Wait()
+	return statuses
+}
+
+//metricTime converts a time recorded as epoch milliseconds, nil if it was never recorded
+func metricTime(ms int64) *time.Time {
+	if ms == 0 {
+		return nil
+	}
+	t := time.Unix(0, ms*int64(time.Millisecond)).UTC()
+	return &t
+}
+
+//masked returns a copy of the configuration which can be shown to operators, with its secrets replaced
+func (cfg *pluginConfig) masked() *pluginConfig {
+	masked := *cfg
+	masked.Auth = cfg.Auth.masked()
+	masked.BlobServerTransport = cfg.BlobServerTransport.masked()
+	masked.StorageTransport = cfg.StorageTransport.masked()
+	masked.Destinations = make([]uploadDestination, len(cfg.Destinations))
+	for i, dest := range cfg.Destinations {
+		dest.BearerToken = maskSecret(dest.BearerToken)
+		masked.Destinations[i] = dest
+	}
+	if cfg.Routing != nil {
+		routing := blobServerRoutesConfig{Routes: make([]blobServerRoute, len(cfg.Routing.Routes))}
+		for i, route := range cfg.Routing.Routes {
+			route.BearerToken = maskSecret(route.BearerToken)
+			routing.Routes[i] = route
+		}
+		if cfg.Routing.Default != nil {
+			defaultRoute := *cfg.Routing.Default
+			defaultRoute.BearerToken = maskSecret(defaultRoute.BearerToken)
+			routing.Default = &defaultRoute
+		}
+		masked.Routing = &routing
+	}
+	return &masked
+}
+
+func (as authSettings) masked() authSettings {
+	as.SharedSecret = maskSecret(as.SharedSecret)
+	as.AdminToken = maskSecret(as.AdminToken)
+	hmacKeys := make(map[string]string, len(as.HMACKeys))
+	for keyId, secret := range as.HMACKeys {
+		hmacKeys[keyId] = maskSecret(secret)
+	}
+	as.HMACKeys = hmacKeys
+	return as
+}
+
+func (tc transportConfig) masked() transportConfig {
+	tc.ProxyPassword = maskSecret(tc.ProxyPassword)
+	if proxyURL, err := url.Parse(tc.ProxyURL); err == nil && proxyURL.User != nil {
+		if _, ok := proxyURL.User.Password(); ok {
+			proxyURL.User = url.UserPassword(proxyURL.User.Username(), maskedSecret)
+			tc.ProxyURL = proxyURL.String()
+		}
+	}
+	return tc
+}
+
+//maskSecret hides a secret, while still showing whether it is set
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return maskedSecret
+}
@@ -0,0 +1,136 @@
+package apidGatewayTrace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/apid/apidGatewayTrace/envelope"
+	"github.com/pkg/errors"
+	"io/ioutil"
+)
+
+const (
+	configEncryptionKeysFile = "apidgatewaytrace_encryption_keys_file"
+)
+
+//encryptionKeyConfig selects the key used to encrypt traces for an org/env, either of which may be "*".  Exactly one
+//of PublicKeyFile, a PEM encoded RSA public key, or KeyFile, a 32 byte AES key (raw or base64), must be set
+type encryptionKeyConfig struct {
+	Id            string `json:"id"`
+	Organization  string `json:"organization"`
+	Environment   string `json:"environment"`
+	PublicKeyFile string `json:"publicKeyFile"`
+	KeyFile       string `json:"keyFile"`
+}
+
+//encryptionKey is a loaded encryptionKeyConfig
+type encryptionKey struct {
+	encryptionKeyConfig
+	wrapKey envelope.KeyWrapper
+}
+
+//encryptionStage is the uploadStage encrypting traces with a per-blob data key before they leave the gateway, in
+//the format of the envelope package
+type encryptionStage struct {
+	keys []*encryptionKey
+}
+
+//newEncryptionStage loads the encryption keys file, returning nil if none is configured
+func newEncryptionStage() (*encryptionStage, error) {
+	file := config.GetString(configEncryptionKeysFile)
+	if file == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read encryption keys %s", file)
+	}
+	keysConfig := struct {
+		Keys []encryptionKeyConfig `json:"keys"`
+	}{}
+	if err = json.Unmarshal(data, &keysConfig); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse encryption keys %s", file)
+	}
+
+	es := &encryptionStage{}
+	for _, kc := range keysConfig.Keys {
+		key, err := loadEncryptionKey(kc)
+		if err != nil {
+			return nil, err
+		}
+		es.keys = append(es.keys, key)
+	}
+	return es, nil
+}
+
+//keyConfigs returns the configuration of the keys the stage encrypts with
+func (es *encryptionStage) keyConfigs() []encryptionKeyConfig {
+	configs := make([]encryptionKeyConfig, 0, len(es.keys))
+	for _, key := range es.keys {
+		configs = append(configs, key.encryptionKeyConfig)
+	}
+	return configs
+}
+
+//loadEncryptionKey reads the key material referenced by an encryptionKeyConfig
+func loadEncryptionKey(kc encryptionKeyConfig) (*encryptionKey, error) {
+	if kc.Id == "" || kc.Organization == "" || kc.Environment == "" {
+		return nil, errors.New("encryption keys require an id, organization and environment")
+	}
+	key := &encryptionKey{encryptionKeyConfig: kc}
+	switch {
+	case kc.PublicKeyFile != "" && kc.KeyFile == "":
+		data, err := ioutil.ReadFile(kc.PublicKeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read public key for %s", kc.Id)
+		}
+		publicKey, err := envelope.ParseRSAPublicKey(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad public key for %s", kc.Id)
+		}
+		key.wrapKey = envelope.RSAKeyWrapper(publicKey)
+	case kc.KeyFile != "" && kc.PublicKeyFile == "":
+		data, err := ioutil.ReadFile(kc.KeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to read key file for %s", kc.Id)
+		}
+		kek, err := envelope.ParseAESKey(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad key file for %s", kc.Id)
+		}
+		key.wrapKey = envelope.AESKeyWrapper(kek)
+	default:
+		return nil, fmt.Errorf("encryption key %s needs exactly one of publicKeyFile or keyFile", kc.Id)
+	}
+	return key, nil
+}
+
+//process replaces the trace with an encrypted envelope and records the key id in the blob metadata.  Traces for an
+//org/env without a configured key are uploaded as they are
+func (es *encryptionStage) process(upload *traceUpload) error {
+	key := es.keyFor(upload.sessionId.Organization, upload.sessionId.Environment)
+	if key == nil {
+		return nil
+	}
+	data, err := upload.bufferBody()
+	if err != nil {
+		return err
+	}
+	sealed, err := envelope.Seal(data, key.Id, key.wrapKey)
+	if err != nil {
+		return errors.Wrapf(err, "unable to encrypt trace with key %s", key.Id)
+	}
+	upload.body = bytes.NewReader(sealed)
+	upload.metadata.EncryptionKeyId = key.Id
+	return nil
+}
+
+//keyFor returns the first key configured for org and env
+func (es *encryptionStage) keyFor(org, env string) *encryptionKey {
+	for _, key := range es.keys {
+		if scopeMatches(key.Organization, org) && scopeMatches(key.Environment, env) {
+			return key
+		}
+	}
+	return nil
+}
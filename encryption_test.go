@@ -0,0 +1,138 @@
+package apidGatewayTrace
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"github.com/apid/apidGatewayTrace/envelope"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+var _ = Describe("Encryption", func() {
+
+	var dir string
+	var privateKey *rsa.PrivateKey
+	var kek []byte
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir(testTempDirBase, "encryption")
+		Expect(err).To(Succeed())
+
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).To(Succeed())
+		publicKeyBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+		Expect(err).To(Succeed())
+		publicKeyPem := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKeyBytes})
+		Expect(ioutil.WriteFile(filepath.Join(dir, "public.pem"), publicKeyPem, 0600)).To(Succeed())
+
+		kek = make([]byte, envelope.DataKeySize)
+		_, err = rand.Read(kek)
+		Expect(err).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "kek"), []byte(base64.StdEncoding.EncodeToString(kek)), 0600)).To(Succeed())
+
+		keys := fmt.Sprintf(`{"keys":[
+			{"id":"acme-prod","organization":"acme","environment":"prod","publicKeyFile":"%s"},
+			{"id":"acme-other","organization":"acme","environment":"*","keyFile":"%s"}]}`,
+			filepath.Join(dir, "public.pem"), filepath.Join(dir, "kek"))
+		Expect(ioutil.WriteFile(filepath.Join(dir, "keys.json"), []byte(keys), 0600)).To(Succeed())
+		config.Set(configEncryptionKeysFile, filepath.Join(dir, "keys.json"))
+	})
+
+	AfterEach(func() {
+		config.Set(configEncryptionKeysFile, "")
+	})
+
+	encrypt := func(es *encryptionStage, sessionId string) (*traceUpload, []byte) {
+		upload := &traceUpload{sessionId: mustParseSessionId(sessionId), body: strings.NewReader("a trace")}
+		Expect(es.process(upload)).To(Succeed())
+		sealed, err := ioutil.ReadAll(upload.body)
+		Expect(err).To(Succeed())
+		return upload, sealed
+	}
+
+	It("should wrap data keys with a public key", func() {
+		es, err := newEncryptionStage()
+		Expect(err).To(Succeed())
+		upload, sealed := encrypt(es, "acme__prod__app__rev__id")
+		Expect(upload.metadata.EncryptionKeyId).To(Equal("acme-prod"))
+		Expect(string(sealed)).ToNot(ContainSubstring("a trace"))
+
+		trace, err := envelope.Open(sealed, envelope.RSAKeyUnwrapper(privateKey))
+		Expect(err).To(Succeed())
+		Expect(string(trace)).To(Equal("a trace"))
+
+		_, err = envelope.Open(sealed, envelope.AESKeyUnwrapper(kek))
+		Expect(err).ToNot(Succeed())
+	})
+
+	It("should wrap data keys with a local key", func() {
+		es, err := newEncryptionStage()
+		Expect(err).To(Succeed())
+		upload, sealed := encrypt(es, "acme__test__app__rev__id")
+		Expect(upload.metadata.EncryptionKeyId).To(Equal("acme-other"))
+
+		trace, err := envelope.Open(sealed, envelope.AESKeyUnwrapper(kek))
+		Expect(err).To(Succeed())
+		Expect(string(trace)).To(Equal("a trace"))
+	})
+
+	It("should use a fresh data key for every blob", func() {
+		es, err := newEncryptionStage()
+		Expect(err).To(Succeed())
+		_, first := encrypt(es, "acme__test__app__rev__id")
+		_, second := encrypt(es, "acme__test__app__rev__id")
+		Expect(first).ToNot(Equal(second))
+	})
+
+	It("should leave traces for orgs without a key unencrypted", func() {
+		es, err := newEncryptionStage()
+		Expect(err).To(Succeed())
+		upload, trace := encrypt(es, "other__prod__app__rev__id")
+		Expect(upload.metadata.EncryptionKeyId).To(Equal(""))
+		Expect(string(trace)).To(Equal("a trace"))
+	})
+
+	It("should detect tampering with the envelope", func() {
+		es, err := newEncryptionStage()
+		Expect(err).To(Succeed())
+		_, sealed := encrypt(es, "acme__test__app__rev__id")
+		sealed[len(sealed)-1] ^= 1
+		_, err = envelope.Open(sealed, envelope.AESKeyUnwrapper(kek))
+		Expect(err).ToNot(Succeed())
+
+		_, err = envelope.Open([]byte("a trace"), envelope.AESKeyUnwrapper(kek))
+		Expect(err).ToNot(Succeed())
+	})
+
+	It("should reject incomplete key configuration", func() {
+		_, err := loadEncryptionKey(encryptionKeyConfig{Id: "k", Organization: "*", Environment: "*"})
+		Expect(err).ToNot(Succeed())
+		_, err = loadEncryptionKey(encryptionKeyConfig{Organization: "*", Environment: "*", KeyFile: filepath.Join(dir, "kek")})
+		Expect(err).ToNot(Succeed())
+		_, err = loadEncryptionKey(encryptionKeyConfig{Id: "k", Organization: "*", Environment: "*",
+			KeyFile: filepath.Join(dir, "keys.json")})
+		Expect(err).ToNot(Succeed())
+	})
+
+	It("should run after validation and redaction", func() {
+		config.Set(configRedactionRulesFile, filepath.Join(dir, "rules.json"))
+		defer config.Set(configRedactionRulesFile, "")
+		Expect(ioutil.WriteFile(filepath.Join(dir, "rules.json"), []byte(`{"default":{"headers":["Authorization"]}}`), 0600)).To(Succeed())
+		config.Set(configTraceValidation, traceValidationReject)
+		defer config.Set(configTraceValidation, "")
+		stages, err := newUploadStages()
+		Expect(err).To(Succeed())
+		Expect(stages).To(HaveLen(3))
+		Expect(stages[0]).To(BeAssignableToTypeOf(&validationStage{}))
+		Expect(stages[1]).To(BeAssignableToTypeOf(&redactionStage{}))
+		Expect(stages[2]).To(BeAssignableToTypeOf(&encryptionStage{}))
+	})
+})
@@ -0,0 +1,258 @@
+//Package envelope implements the format apidGatewayTrace encrypts traces with, so that tests and tooling can open
+//the blobs it uploads.  An envelope is Magic, the big endian uint32 length of the JSON Header, the header, and the
+//trace sealed with AES-GCM under a fresh data key.  The header carries the data key, wrapped either with an RSA
+//public key or with a local AES key, and is authenticated as additional data so that it cannot be altered
+package envelope
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"strings"
+)
+
+const (
+	Magic       = "APIDTRC1"
+	Algorithm   = "AES-256-GCM"
+	KeyWrapRSA  = "RSA-OAEP-SHA256"
+	KeyWrapAES  = "AES-256-GCM"
+	DataKeySize = 32
+)
+
+//Header describes how an envelope was encrypted
+type Header struct {
+	KeyId      string `json:"keyId"`
+	Algorithm  string `json:"algorithm"`
+	KeyWrap    string `json:"keyWrap"`
+	WrappedKey string `json:"wrappedKey"`
+	Nonce      string `json:"nonce"`
+}
+
+//KeyWrapper wraps the data key of an envelope for the key keyId, returning the key wrap used and the wrapped key
+type KeyWrapper func(keyId string, dataKey []byte) (keyWrap string, wrapped []byte, err error)
+
+//KeyUnwrapper is given the header and the wrapped data key of an envelope, and must return the data key
+type KeyUnwrapper func(header Header, wrapped []byte) ([]byte, error)
+
+//Seal encrypts data with a fresh data key, wrapped for the key keyId by wrapKey
+func Seal(data []byte, keyId string, wrapKey KeyWrapper) ([]byte, error) {
+	dataKey := make([]byte, DataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, err
+	}
+
+	header := Header{KeyId: keyId, Algorithm: Algorithm}
+	keyWrap, wrapped, err := wrapKey(keyId, dataKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to wrap data key")
+	}
+	header.KeyWrap = keyWrap
+	header.WrappedKey = base64.StdEncoding.EncodeToString(wrapped)
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	header.Nonce = base64.StdEncoding.EncodeToString(nonce)
+
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	envelope := bytes.NewBufferString(Magic)
+	binary.Write(envelope, binary.BigEndian, uint32(len(headerBytes)))
+	envelope.Write(headerBytes)
+	envelope.Write(gcm.Seal(nil, nonce, data, headerBytes))
+	return envelope.Bytes(), nil
+}
+
+//Open decrypts an envelope, unwrapping its data key with unwrapKey
+func Open(envelope []byte, unwrapKey KeyUnwrapper) ([]byte, error) {
+	prefix := len(Magic) + 4
+	if len(envelope) < prefix || string(envelope[:len(Magic)]) != Magic {
+		return nil, errors.New("not a trace envelope")
+	}
+	headerLength := int(binary.BigEndian.Uint32(envelope[len(Magic):prefix]))
+	if len(envelope) < prefix+headerLength {
+		return nil, errors.New("truncated trace envelope")
+	}
+	headerBytes := envelope[prefix : prefix+headerLength]
+
+	header := Header{}
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, errors.Wrap(err, "bad trace envelope header")
+	}
+	if header.Algorithm != Algorithm {
+		return nil, fmt.Errorf("unsupported envelope algorithm %s", header.Algorithm)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(header.WrappedKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad wrapped key")
+	}
+	nonce, err := base64.StdEncoding.DecodeString(header.Nonce)
+	if err != nil {
+		return nil, errors.Wrap(err, "bad nonce")
+	}
+
+	dataKey, err := unwrapKey(header, wrapped)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to unwrap data key %s", header.KeyId)
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errors.New("bad nonce")
+	}
+	return gcm.Open(nil, nonce, envelope[prefix+headerLength:], headerBytes)
+}
+
+//RSAKeyWrapper wraps data keys with publicKey using OAEP, the key id being the label
+func RSAKeyWrapper(publicKey *rsa.PublicKey) KeyWrapper {
+	return func(keyId string, dataKey []byte) (string, []byte, error) {
+		wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, publicKey, dataKey, []byte(keyId))
+		return KeyWrapRSA, wrapped, err
+	}
+}
+
+//AESKeyWrapper wraps data keys with the local key kek using AES-GCM, the key id being the additional data
+func AESKeyWrapper(kek []byte) KeyWrapper {
+	return func(keyId string, dataKey []byte) (string, []byte, error) {
+		wrapped, err := sealAESGCM(kek, dataKey, []byte(keyId))
+		return KeyWrapAES, wrapped, err
+	}
+}
+
+//RSAKeyUnwrapper unwraps data keys wrapped with the public half of privateKey
+func RSAKeyUnwrapper(privateKey *rsa.PrivateKey) KeyUnwrapper {
+	return func(header Header, wrapped []byte) ([]byte, error) {
+		if header.KeyWrap != KeyWrapRSA {
+			return nil, fmt.Errorf("expected key wrap %s, found %s", KeyWrapRSA, header.KeyWrap)
+		}
+		return rsa.DecryptOAEP(sha256.New(), rand.Reader, privateKey, wrapped, []byte(header.KeyId))
+	}
+}
+
+//AESKeyUnwrapper unwraps data keys wrapped with the local key kek
+func AESKeyUnwrapper(kek []byte) KeyUnwrapper {
+	return func(header Header, wrapped []byte) ([]byte, error) {
+		if header.KeyWrap != KeyWrapAES {
+			return nil, fmt.Errorf("expected key wrap %s, found %s", KeyWrapAES, header.KeyWrap)
+		}
+		return openAESGCM(kek, wrapped, []byte(header.KeyId))
+	}
+}
+
+//KeyFileUnwrapper returns the unwrapper for the contents of a key file, either a PEM encoded RSA private key or a
+//32 byte AES key, raw or base64 encoded
+func KeyFileUnwrapper(data []byte) (KeyUnwrapper, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		privateKey, err := parseRSAPrivateKey(block)
+		if err != nil {
+			return nil, err
+		}
+		return RSAKeyUnwrapper(privateKey), nil
+	}
+	kek, err := ParseAESKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return AESKeyUnwrapper(kek), nil
+}
+
+//ParseRSAPublicKey parses a PEM encoded PKIX or PKCS#1 RSA public key
+func ParseRSAPublicKey(data []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("public key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+//parseRSAPrivateKey parses a PKCS#1 or PKCS#8 RSA private key
+func parseRSAPrivateKey(block *pem.Block) (*rsa.PrivateKey, error) {
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+//ParseAESKey accepts a 32 byte key either raw or base64 encoded
+func ParseAESKey(data []byte) ([]byte, error) {
+	if len(data) == DataKeySize {
+		return data, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err == nil && len(decoded) == DataKeySize {
+		return decoded, nil
+	}
+	return nil, fmt.Errorf("key must be %d bytes, raw or base64 encoded", DataKeySize)
+}
+
+//sealAESGCM encrypts plaintext with key, prefixing the random nonce to the result
+func sealAESGCM(key, plaintext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+//openAESGCM reverses sealAESGCM
+func openAESGCM(key, sealed, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
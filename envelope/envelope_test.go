@@ -0,0 +1,103 @@
+package envelope
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Envelope", func() {
+
+	var privateKey *rsa.PrivateKey
+	var kek []byte
+
+	BeforeEach(func() {
+		var err error
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).To(Succeed())
+		kek = make([]byte, DataKeySize)
+		_, err = rand.Read(kek)
+		Expect(err).To(Succeed())
+	})
+
+	It("should open envelopes sealed with either key wrap", func() {
+		sealed, err := Seal([]byte("a trace"), "rsa", RSAKeyWrapper(&privateKey.PublicKey))
+		Expect(err).To(Succeed())
+		Expect(string(sealed[:len(Magic)])).To(Equal(Magic))
+		trace, err := Open(sealed, RSAKeyUnwrapper(privateKey))
+		Expect(err).To(Succeed())
+		Expect(string(trace)).To(Equal("a trace"))
+		_, err = Open(sealed, AESKeyUnwrapper(kek))
+		Expect(err).ToNot(Succeed())
+
+		sealed, err = Seal([]byte("a trace"), "aes", AESKeyWrapper(kek))
+		Expect(err).To(Succeed())
+		trace, err = Open(sealed, AESKeyUnwrapper(kek))
+		Expect(err).To(Succeed())
+		Expect(string(trace)).To(Equal("a trace"))
+	})
+
+	It("should detect tampering with the header and the payload", func() {
+		sealed, err := Seal([]byte("a trace"), "aes", AESKeyWrapper(kek))
+		Expect(err).To(Succeed())
+
+		payload := append([]byte{}, sealed...)
+		payload[len(payload)-1] ^= 1
+		_, err = Open(payload, AESKeyUnwrapper(kek))
+		Expect(err).ToNot(Succeed())
+
+		//the key id is authenticated with the rest of the header
+		header := append([]byte{}, sealed...)
+		headerStart := len(Magic) + 4
+		headerLength := int(binary.BigEndian.Uint32(header[len(Magic):headerStart]))
+		for i := headerStart; i < headerStart+headerLength-3; i++ {
+			if string(header[i:i+3]) == "aes" {
+				copy(header[i:], "AES")
+				break
+			}
+		}
+		_, err = Open(header, AESKeyUnwrapper(kek))
+		Expect(err).ToNot(Succeed())
+
+		_, err = Open([]byte("a trace"), AESKeyUnwrapper(kek))
+		Expect(err).ToNot(Succeed())
+		_, err = Open(sealed[:len(Magic)+8], AESKeyUnwrapper(kek))
+		Expect(err).ToNot(Succeed())
+	})
+
+	It("should read unwrappers from key files", func() {
+		pkcs8, err := x509.MarshalPKCS8PrivateKey(privateKey)
+		Expect(err).To(Succeed())
+		keyFiles := [][]byte{
+			pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}),
+			pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}),
+		}
+		sealed, err := Seal([]byte("a trace"), "rsa", RSAKeyWrapper(&privateKey.PublicKey))
+		Expect(err).To(Succeed())
+		for _, keyFile := range keyFiles {
+			unwrapKey, err := KeyFileUnwrapper(keyFile)
+			Expect(err).To(Succeed())
+			trace, err := Open(sealed, unwrapKey)
+			Expect(err).To(Succeed())
+			Expect(string(trace)).To(Equal("a trace"))
+		}
+
+		sealed, err = Seal([]byte("a trace"), "aes", AESKeyWrapper(kek))
+		Expect(err).To(Succeed())
+		for _, keyFile := range [][]byte{kek, []byte(base64.StdEncoding.EncodeToString(kek) + "\n")} {
+			unwrapKey, err := KeyFileUnwrapper(keyFile)
+			Expect(err).To(Succeed())
+			trace, err := Open(sealed, unwrapKey)
+			Expect(err).To(Succeed())
+			Expect(string(trace)).To(Equal("a trace"))
+		}
+
+		_, err = KeyFileUnwrapper([]byte("too short"))
+		Expect(err).ToNot(Succeed())
+	})
+})
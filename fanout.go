@@ -0,0 +1,363 @@
+package apidGatewayTrace
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+const (
+	configDestinationsFile        = "apidgatewaytrace_destinations_file"
+	configAsyncUploadLimit        = "apidgatewaytrace_async_upload_limit"
+	defaultAsyncUploadLimit       = 64
+	metricDestinationUploadFailed = "destination_upload_failed_"
+	metricAsyncUploadsDropped     = "async_uploads_dropped_"
+	metricBlobsAbandoned          = "blobs_abandoned_"
+)
+
+//errDestinationDone tells the tee that a destination stopped reading the trace
+var errDestinationDone = errors.New("destination finished reading the trace")
+
+//uploadDestination is one of the places each trace is stored.  Destinations without a base URI use the blob server
+//routing table.  The MP is told the upload succeeded only if every required destination stored the trace, while
+//best-effort destinations are merely logged when they fail.  Async destinations are written after the MP has been
+//answered, from a copy of the trace kept in memory, and so cannot be required.  Copies are only kept while the async
+//upload queue has room and the trace fits the maximum trace size, and are dropped otherwise
+type uploadDestination struct {
+	Name            string `json:"name"`
+	BaseURI         string `json:"baseUri,omitempty"`
+	BearerToken     string `json:"bearerToken,omitempty"`
+	BearerTokenFile string `json:"bearerTokenFile,omitempty"`
+	Required        bool   `json:"required"`
+	Async           bool   `json:"async"`
+}
+
+//destinationsConfig is the format of the destinations file.  The first required destination is the primary one,
+//whose blob is reported to the MP and recorded in the trace index
+type destinationsConfig struct {
+	Destinations []uploadDestination `json:"destinations"`
+}
+
+//defaultDestinations stores traces only on the routed blob server, as the plugin did before fan-out
+var defaultDestinations = []uploadDestination{{Name: "default", Required: true}}
+
+//newUploadDestinations loads the destinations from the configured file, defaulting to the routed blob server alone
+func newUploadDestinations() ([]uploadDestination, error) {
+	file := config.GetString(configDestinationsFile)
+	if file == "" {
+		return defaultDestinations, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read upload destinations %s", file)
+	}
+	var destConfig destinationsConfig
+	if err = json.Unmarshal(data, &destConfig); err != nil {
+		return nil, errors.Wrapf(err, "invalid upload destinations %s", file)
+	}
+	return checkUploadDestinations(destConfig.Destinations)
+}
+
+//checkUploadDestinations validates the policies of the destinations and loads the bearer tokens kept in files
+func checkUploadDestinations(destinations []uploadDestination) ([]uploadDestination, error) {
+	destinations = append([]uploadDestination(nil), destinations...)
+	names := make(map[string]bool)
+	hasRequired := false
+	for i, dest := range destinations {
+		if dest.Name == "" || names[dest.Name] {
+			return nil, fmt.Errorf("upload destination %d must have a unique name", i)
+		}
+		names[dest.Name] = true
+		if dest.Required && dest.Async {
+			return nil, fmt.Errorf("upload destination %s cannot be both required and async", dest.Name)
+		}
+		hasRequired = hasRequired || dest.Required
+		if dest.BaseURI != "" || dest.BearerTokenFile != "" {
+			route, err := loadBlobServerRoute(dest.route())
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid upload destination %s", dest.Name)
+			}
+			destinations[i].BearerToken = route.BearerToken
+		}
+	}
+	if !hasRequired {
+		return nil, errors.New("at least one upload destination must be required")
+	}
+	return destinations, nil
+}
+
+//route returns the blob server route of a destination with its own base URI
+func (dest uploadDestination) route() blobServerRoute {
+	return blobServerRoute{
+		Organization:    "*",
+		Environment:     "*",
+		BaseURI:         dest.BaseURI,
+		BearerToken:     dest.BearerToken,
+		BearerTokenFile: dest.BearerTokenFile,
+	}
+}
+
+//destinationUpload tracks the upload of a trace to one destination
+type destinationUpload struct {
+	destination uploadDestination
+	blob        *blobServerResponse
+	res         *http.Response
+	err         error
+	pipe        *io.PipeReader
+	buffer      *boundedBuffer
+}
+
+//close releases the response of the destination once its status was read
+func (du *destinationUpload) close() {
+	if du != nil && du.res != nil && du.res.Body != nil {
+		io.Copy(ioutil.Discard, du.res.Body)
+		du.res.Body.Close()
+	}
+}
+
+//asyncUploadQueue bounds the number of async uploads in flight, and so the copies of traces held in memory for them
+type asyncUploadQueue struct {
+	slots chan struct{}
+}
+
+//newAsyncUploadQueue creates the asyncUploadQueue with the configured number of slots
+func newAsyncUploadQueue() *asyncUploadQueue {
+	limit := defaultAsyncUploadLimit
+	if config.IsSet(configAsyncUploadLimit) {
+		limit = config.GetInt(configAsyncUploadLimit)
+	}
+	return &asyncUploadQueue{slots: make(chan struct{}, limit)}
+}
+
+//acquire takes a slot for an async upload without waiting, returning false when the queue is full.  A nil queue is
+//always full
+func (q *asyncUploadQueue) acquire() bool {
+	if q == nil {
+		return false
+	}
+	select {
+	case q.slots <- struct{}{}:
+		metrics.add(metricAsyncUploadsPending, 1)
+		return true
+	default:
+		return false
+	}
+}
+
+//release gives back the slot of an async upload which finished or was abandoned
+func (q *asyncUploadQueue) release() {
+	<-q.slots
+	metrics.add(metricAsyncUploadsPending, -1)
+}
+
+//boundedBuffer keeps a copy of a trace up to a maximum size.  Writes past the maximum are dropped rather than failing,
+//so that the other destinations fed by the tee still receive the whole trace
+type boundedBuffer struct {
+	buf      bytes.Buffer
+	max      int64
+	overflow bool
+}
+
+func (bb *boundedBuffer) Write(p []byte) (int, error) {
+	if !bb.overflow {
+		if int64(bb.buf.Len()+len(p)) > bb.max {
+			bb.overflow = true
+			bb.buf = bytes.Buffer{}
+		} else {
+			bb.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+//fanOut stores the trace in every destination it is not yet stored at, reading its body once.  Sync destinations are
+//streamed through pipes fed by a tee, while async ones get a copy which is uploaded in the background.  The upload
+//to the primary destination is returned, or an uploadError if a required destination failed, and the destinations
+//which got the trace are added to those of the upload either way.  The primary upload is nil if every required
+//destination was skipped, and must otherwise be closed by the caller once it has read its response
+func (a *apiManager) fanOut(c *apiComponents, upload *traceUpload) (*destinationUpload, int64, error) {
+	destinations := c.destinations
+	if len(destinations) == 0 {
+		destinations = defaultDestinations
+	}
+
+	//signed URLs are fetched for the required destinations first, so that failing to get one of them leaves as few
+	//blobs as possible created at the blob servers with nothing uploaded to them
+	ordered := make([]uploadDestination, 0, len(destinations))
+	for _, dest := range destinations {
+		if dest.Required {
+			ordered = append(ordered, dest)
+		}
+	}
+	for _, dest := range destinations {
+		if !dest.Required {
+			ordered = append(ordered, dest)
+		}
+	}
+
+	uploads := make([]*destinationUpload, 0, len(destinations))
+	for _, dest := range ordered {
+		if upload.storedAt(dest.Name) {
+			continue
+		}
+		route := c.router.route(upload.sessionId.Organization, upload.sessionId.Environment)
+		if dest.BaseURI != "" {
+			route = dest.route()
+		}
+		blob, err := c.bsClient.getSignedURL(upload.metadata, route)
+		if err != nil {
+			err = errors.Wrapf(err, "Unable to fetch signed upload URL for destination %s", dest.Name)
+			log.Errorf("%v", err)
+			if dest.Required {
+				abandonBlobs(upload, uploads)
+				return nil, 0, &uploadError{code: API_ERR_BLOBSTORE,
+					reason: "Unable fetch signed upload URL", cause: err}
+			}
+			metrics.inc(metricDestinationUploadFailed + dest.Name)
+			continue
+		}
+		uploads = append(uploads, &destinationUpload{destination: dest, blob: blob})
+	}
+
+	maxSize := int64(defaultMaxTraceSize)
+	if config.IsSet(configMaxTraceSize) {
+		maxSize = int64(config.GetInt(configMaxTraceSize))
+	}
+	writers := make([]io.Writer, 0, len(uploads))
+	wg := sync.WaitGroup{}
+	for _, du := range uploads {
+		if du.destination.Async {
+			if !a.asyncUploads.acquire() {
+				log.Errorf("async upload queue is full, dropping trace of %s for destination %s",
+					upload.sessionId.Raw, du.destination.Name)
+				metrics.inc(metricAsyncUploadsDropped + du.destination.Name)
+				continue
+			}
+			du.buffer = &boundedBuffer{max: maxSize}
+			writers = append(writers, du.buffer)
+			continue
+		}
+		pr, pw := io.Pipe()
+		du.pipe = pr
+		writers = append(writers, &teeWriter{w: pw})
+		wg.Add(1)
+		go func(du *destinationUpload) {
+			defer wg.Done()
+			du.res, du.err = c.bsClient.uploadToBlobstore(du.blob.SignedUrl, du.pipe)
+			du.pipe.CloseWithError(errDestinationDone)
+		}(du)
+	}
+
+	body := &countingReader{r: upload.body}
+	_, copyErr := io.Copy(io.MultiWriter(writers...), body)
+	for _, writer := range writers {
+		if tw, ok := writer.(*teeWriter); ok {
+			tw.w.CloseWithError(copyErr)
+		}
+	}
+	wg.Wait()
+	//an upload stage rejected the trace while it was read, which aborted every sync destination
+	if ue, ok := copyErr.(*uploadError); ok {
+		for _, du := range uploads {
+			if du.buffer != nil {
+				a.asyncUploads.release()
+			}
+			du.close()
+		}
+		return nil, body.n, ue
+	}
+
+	var primary *destinationUpload
+	var failed error
+	for _, du := range uploads {
+		if du.destination.Async {
+			if du.buffer == nil {
+				continue
+			}
+			if copyErr != nil || du.buffer.overflow {
+				if du.buffer.overflow {
+					log.Errorf("trace of %s exceeds %d bytes, dropping it for destination %s", upload.sessionId.Raw,
+						maxSize, du.destination.Name)
+					metrics.inc(metricAsyncUploadsDropped + du.destination.Name)
+				}
+				a.asyncUploads.release()
+				continue
+			}
+			upload.stored = append(upload.stored, du.destination.Name)
+			go uploadAsync(c.bsClient, a.asyncUploads, upload, du)
+			continue
+		}
+		if du.err == nil && copyErr != nil {
+			du.err = copyErr
+		}
+		if du.err != nil {
+			err := errors.Wrapf(du.err, "Unable to use signed url for upload to destination %s", du.destination.Name)
+			log.Errorf("%v", err)
+			metrics.inc(metricDestinationUploadFailed + du.destination.Name)
+			if du.destination.Required {
+				failed = &uploadError{code: API_ERR_BLOBSTORE,
+					reason: "Unable to use signed url for upload", cause: err}
+			}
+			du.close()
+			continue
+		}
+		upload.stored = append(upload.stored, du.destination.Name)
+		if du.destination.Required && primary == nil {
+			primary = du
+			continue
+		}
+		du.close()
+	}
+	if failed != nil {
+		primary.close()
+		return nil, body.n, failed
+	}
+	return primary, body.n, nil
+}
+
+//abandonBlobs counts the blobs created for an upload which fails before anything was sent to them.  The blob
+//servers offer no way to delete them, so they are logged for operators to clean up
+func abandonBlobs(upload *traceUpload, uploads []*destinationUpload) {
+	for _, du := range uploads {
+		log.Errorf("abandoning blob %s created for the trace of %s at destination %s", du.blob.Id,
+			upload.sessionId.Raw, du.destination.Name)
+		metrics.inc(metricBlobsAbandoned + du.destination.Name)
+	}
+}
+
+//uploadAsync uploads the copy of a trace kept for an async destination.  It runs after the request was answered, so
+//it is handed the client rather than reading it from the apiManager, whose components may be reloaded meanwhile
+func uploadAsync(bsClient blobstoreClientInterface, queue *asyncUploadQueue, upload *traceUpload,
+	du *destinationUpload) {
+	defer queue.release()
+	var err error
+	du.res, err = bsClient.uploadToBlobstore(du.blob.SignedUrl, bytes.NewReader(du.buffer.buf.Bytes()))
+	du.close()
+	if err != nil {
+		log.Errorf("unable to upload trace of %s to destination %s: %v", upload.sessionId.Raw, du.destination.Name, err)
+		metrics.inc(metricDestinationUploadFailed + du.destination.Name)
+		return
+	}
+	log.Debugf("stored trace of %s in destination %s as blob %s", upload.sessionId.Raw, du.destination.Name, du.blob.Id)
+}
+
+//teeWriter feeds one sync destination.  Once the destination stops reading, its writes are dropped so that the
+//other destinations still receive the whole trace
+type teeWriter struct {
+	w    *io.PipeWriter
+	done bool
+}
+
+func (tw *teeWriter) Write(p []byte) (int, error) {
+	if !tw.done {
+		if _, err := tw.w.Write(p); err != nil {
+			tw.done = true
+		}
+	}
+	return len(p), nil
+}
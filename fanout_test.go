@@ -0,0 +1,247 @@
+package apidGatewayTrace
+
+import (
+	"encoding/json"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var _ = Describe("Upload fan-out", func() {
+
+	var mockBsClient *mockBlobstoreClient
+	var received map[string]string
+	var receivedMux sync.Mutex
+	var asyncUploads *asyncUploadQueue
+
+	routeTo := func(baseURI string) interface{} {
+		return mock.MatchedBy(func(route blobServerRoute) bool { return route.BaseURI == baseURI })
+	}
+
+	expectDestination := func(name string, status int, err error) {
+		mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), routeTo("https://"+name)).Return(
+			&blobServerResponse{Id: name + "-blob", SignedUrl: "signed-" + name}, nil)
+		mockBsClient.On("uploadToBlobstore", "signed-"+name, mock.Anything).Run(func(args mock.Arguments) {
+			if err != nil {
+				return
+			}
+			b, _ := ioutil.ReadAll(args.Get(1).(io.Reader))
+			receivedMux.Lock()
+			received[name] = string(b)
+			receivedMux.Unlock()
+		}).Return(&http.Response{StatusCode: status}, err)
+	}
+
+	upload := func(destinations []uploadDestination, trace string) *httptest.ResponseRecorder {
+		if destinations != nil {
+			var err error
+			destinations, err = checkUploadDestinations(destinations)
+			Expect(err).To(Succeed())
+		}
+		apiMan := apiManager{bsClient: mockBsClient, destinations: destinations, asyncUploads: asyncUploads}
+		r := httptest.NewRequest("POST", "/uploadtrace", strings.NewReader(trace))
+		r.Header.Add(UPLOAD_TRACESESSION_HEADER, "org__env__app__rev__id")
+		w := httptest.NewRecorder()
+		apiMan.apiUploadTraceDataEndpoint(w, r)
+		return w
+	}
+
+	receivedBy := func(name string) func() string {
+		return func() string {
+			receivedMux.Lock()
+			defer receivedMux.Unlock()
+			return received[name]
+		}
+	}
+
+	BeforeEach(func() {
+		mockBsClient = &mockBlobstoreClient{}
+		received = make(map[string]string)
+		asyncUploads = newAsyncUploadQueue()
+	})
+
+	It("should stream the trace to every sync destination", func() {
+		expectDestination("legacy", 201, nil)
+		expectDestination("new", 200, nil)
+		trace := strings.Repeat("a trace ", 10000)
+		w := upload([]uploadDestination{
+			{Name: "legacy", BaseURI: "https://legacy", Required: true},
+			{Name: "new", BaseURI: "https://new"},
+		}, trace)
+		Expect(w.Code).To(Equal(201))
+		var result uploadTraceResult
+		Expect(json.Unmarshal(w.Body.Bytes(), &result)).To(Succeed())
+		Expect(result.BlobId).To(Equal("legacy-blob"))
+		Expect(received["legacy"]).To(Equal(trace))
+		Expect(received["new"]).To(Equal(trace))
+	})
+
+	It("should succeed when only a best-effort destination fails", func() {
+		expectDestination("legacy", 200, nil)
+		expectDestination("new", 0, errors.New("storage unavailable"))
+		w := upload([]uploadDestination{
+			{Name: "legacy", BaseURI: "https://legacy", Required: true},
+			{Name: "new", BaseURI: "https://new"},
+		}, "a trace")
+		Expect(w.Code).To(Equal(200))
+		Expect(received["legacy"]).To(Equal("a trace"))
+	})
+
+	It("should skip best-effort destinations which cannot provide a signed url", func() {
+		expectDestination("legacy", 200, nil)
+		mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), routeTo("https://new")).Return(
+			(*blobServerResponse)(nil), errors.New("blob server unavailable"))
+		w := upload([]uploadDestination{
+			{Name: "legacy", BaseURI: "https://legacy", Required: true},
+			{Name: "new", BaseURI: "https://new"},
+		}, "a trace")
+		Expect(w.Code).To(Equal(200))
+	})
+
+	It("should fail when a required destination fails", func() {
+		expectDestination("legacy", 0, errors.New("storage unavailable"))
+		expectDestination("new", 200, nil)
+		w := upload([]uploadDestination{
+			{Name: "legacy", BaseURI: "https://legacy", Required: true},
+			{Name: "new", BaseURI: "https://new"},
+		}, "a trace")
+		Expect(w.Code).To(Equal(500))
+		Expect(received["new"]).To(Equal("a trace"))
+	})
+
+	It("should fetch signed urls for required destinations first", func() {
+		mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), routeTo("https://legacy")).Return(
+			(*blobServerResponse)(nil), errors.New("blob server unavailable"))
+		w := upload([]uploadDestination{
+			{Name: "new", BaseURI: "https://new"},
+			{Name: "legacy", BaseURI: "https://legacy", Required: true},
+		}, "a trace")
+		Expect(w.Code).To(Equal(500))
+		mockBsClient.AssertNumberOfCalls(GinkgoT(), "getSignedURL", 1)
+	})
+
+	It("should count the blobs abandoned when a required destination has no signed url", func() {
+		expectDestination("legacy", 200, nil)
+		mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), routeTo("https://new")).Return(
+			(*blobServerResponse)(nil), errors.New("blob server unavailable"))
+		abandoned := metrics.get(metricBlobsAbandoned + "legacy")
+		w := upload([]uploadDestination{
+			{Name: "legacy", BaseURI: "https://legacy", Required: true},
+			{Name: "new", BaseURI: "https://new", Required: true},
+		}, "a trace")
+		Expect(w.Code).To(Equal(500))
+		Expect(metrics.get(metricBlobsAbandoned + "legacy")).To(Equal(abandoned + 1))
+		mockBsClient.AssertNotCalled(GinkgoT(), "uploadToBlobstore", mock.Anything, mock.Anything)
+	})
+
+	It("should upload to async destinations in the background", func() {
+		expectDestination("legacy", 200, nil)
+		expectDestination("archive", 200, nil)
+		w := upload([]uploadDestination{
+			{Name: "legacy", BaseURI: "https://legacy", Required: true},
+			{Name: "archive", BaseURI: "https://archive", Async: true},
+		}, "a trace")
+		Expect(w.Code).To(Equal(200))
+		Eventually(receivedBy("archive")).Should(Equal("a trace"))
+	})
+
+	It("should drop async uploads when the queue is full or the trace too large", func() {
+		expectDestination("legacy", 200, nil)
+		mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), routeTo("https://archive")).Return(
+			&blobServerResponse{Id: "archive-blob", SignedUrl: "signed-archive"}, nil)
+		destinations := []uploadDestination{
+			{Name: "legacy", BaseURI: "https://legacy", Required: true},
+			{Name: "archive", BaseURI: "https://archive", Async: true},
+		}
+		dropped := metrics.get(metricAsyncUploadsDropped + "archive")
+
+		asyncUploads = &asyncUploadQueue{slots: make(chan struct{}, 1)}
+		Expect(asyncUploads.acquire()).To(BeTrue())
+		Expect(upload(destinations, "a trace").Code).To(Equal(200))
+		asyncUploads.release()
+
+		config.Set(configMaxTraceSize, 4)
+		defer config.Set(configMaxTraceSize, defaultMaxTraceSize)
+		Expect(upload(destinations, "a trace").Code).To(Equal(200))
+		Expect(asyncUploads.slots).To(BeEmpty())
+
+		Expect(metrics.get(metricAsyncUploadsDropped + "archive")).To(Equal(dropped + 2))
+		mockBsClient.AssertNotCalled(GinkgoT(), "uploadToBlobstore", "signed-archive", mock.Anything)
+	})
+
+	It("should close the responses of the destinations", func() {
+		bodies := make([]*closeTracker, 2)
+		for i, name := range []string{"legacy", "new"} {
+			bodies[i] = &closeTracker{Reader: strings.NewReader("stored")}
+			mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), routeTo("https://"+name)).Return(
+				&blobServerResponse{Id: name + "-blob", SignedUrl: "signed-" + name}, nil)
+			mockBsClient.On("uploadToBlobstore", "signed-"+name, mock.Anything).Return(
+				&http.Response{StatusCode: 201, Body: bodies[i]}, nil)
+		}
+		w := upload([]uploadDestination{
+			{Name: "legacy", BaseURI: "https://legacy", Required: true},
+			{Name: "new", BaseURI: "https://new"},
+		}, "a trace")
+		Expect(w.Code).To(Equal(201))
+		for _, body := range bodies {
+			Expect(body.closed).To(BeTrue())
+		}
+	})
+
+	It("should use the routing table for destinations without a base uri", func() {
+		config.Set(configBlobServerBaseURI, "https://routed")
+		defer config.Set(configBlobServerBaseURI, "")
+		expectDestination("routed", 200, nil)
+		w := upload(nil, "a trace")
+		Expect(w.Code).To(Equal(200))
+		Expect(received["routed"]).To(Equal("a trace"))
+	})
+
+	It("should reject invalid destination policies", func() {
+		for _, bad := range [][]uploadDestination{
+			{},
+			{{Name: "best-effort", BaseURI: "https://b"}},
+			{{Name: "async", BaseURI: "https://a", Required: true, Async: true}},
+			{{Name: "same", Required: true}, {Name: "same"}},
+			{{Required: true}},
+			{{Name: "token", Required: true, BearerTokenFile: "missing"}},
+		} {
+			_, err := checkUploadDestinations(bad)
+			Expect(err).ToNot(Succeed())
+		}
+	})
+
+	It("should load destinations from the configured file", func() {
+		dir, err := ioutil.TempDir(testTempDirBase, "destinations")
+		Expect(err).To(Succeed())
+		file := filepath.Join(dir, "destinations.json")
+		Expect(ioutil.WriteFile(file, []byte(`{"destinations":[{"name":"legacy","required":true},
+			{"name":"new","baseUri":"https://new","bearerToken":"t","async":true}]}`), 0600)).To(Succeed())
+		config.Set(configDestinationsFile, file)
+		defer config.Set(configDestinationsFile, "")
+
+		destinations, err := newUploadDestinations()
+		Expect(err).To(Succeed())
+		Expect(destinations).To(HaveLen(2))
+		Expect(destinations[1].route().authorization()).To(Equal("Bearer t"))
+	})
+})
+
+//closeTracker is a response body remembering whether it was closed
+type closeTracker struct {
+	io.Reader
+	closed bool
+}
+
+func (ct *closeTracker) Close() error {
+	ct.closed = true
+	return nil
+}
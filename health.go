@@ -0,0 +1,168 @@
+package apidGatewayTrace
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	configHealthProbeInterval   = "apidgatewaytrace_health_probe_interval"
+	defaultHealthProbeInterval  = 30 * time.Second
+	healthStatusStarting        = "starting"
+	healthStatusOK              = "ok"
+	healthStatusDegraded        = "degraded"
+	healthStatusUnavailable     = "unavailable"
+	metricHealthDegraded        = "health_degraded"
+	metricHealthUnavailable     = "health_unavailable"
+	metricHealthSnapshot        = "health_snapshot_received"
+	metricBlobServerUnreachable = "blob_servers_unreachable"
+	metricRequiredUnreachable   = "required_blob_servers_unreachable"
+	metricBlobServerProbes      = "blob_server_probes"
+	healthDbError               = "unable to open the database of the last snapshot, the previous one is still in use"
+)
+
+//healthResult is returned by the health endpoint.  The plugin is starting until its first snapshot arrives, and
+//unavailable while a blob server of a required destination is unreachable.  It is only degraded, and still ready,
+//while the blob servers of best-effort or async destinations are unreachable, as uploads keep succeeding without
+//them, or while the DB of the last snapshot could not be opened, as the previous one keeps serving.  As the endpoint
+//is not authenticated, DbError only says that the DB could not be opened, diagnostics giving the reason
+type healthResult struct {
+	Status           string             `json:"status"`
+	SnapshotReceived bool               `json:"snapshotReceived"`
+	DbError          string             `json:"dbError,omitempty"`
+	BlobServers      []blobServerStatus `json:"blobServers"`
+	LastProbe        *time.Time         `json:"lastProbe,omitempty"`
+}
+
+//healthMonitor periodically probes the blob servers, so that health checks answer from the last probe instead of
+//waiting on the network
+type healthMonitor struct {
+	interval    time.Duration
+	mux         sync.Mutex
+	blobServers []blobServerStatus
+	lastProbe   time.Time
+	now         func() time.Time
+}
+
+//newHealthMonitor creates the healthMonitor, which does not probe if the interval is configured as zero.  The
+//interval is only read when the plugin starts
+func newHealthMonitor() *healthMonitor {
+	interval := defaultHealthProbeInterval
+	if config.IsSet(configHealthProbeInterval) {
+		interval = config.GetDuration(configHealthProbeInterval)
+	}
+	return &healthMonitor{interval: interval, now: time.Now}
+}
+
+//start probes the blob servers of the apiManager right away and then at every interval
+func (hm *healthMonitor) start(a *apiManager) {
+	if hm.interval <= 0 {
+		return
+	}
+	go func() {
+		for {
+			hm.probe(a)
+			time.Sleep(hm.interval)
+		}
+	}()
+}
+
+//probe checks the blob servers once and records the outcome
+func (hm *healthMonitor) probe(a *apiManager) {
+	statuses := checkBlobServers(a.components())
+
+	unreachable, requiredUnreachable := 0, 0
+	for _, status := range statuses {
+		if !status.Reachable {
+			log.Errorf("blob server %s is unreachable: %s", status.BaseURI, status.Error)
+			unreachable++
+			if status.Required {
+				requiredUnreachable++
+			}
+		}
+	}
+	metrics.inc(metricBlobServerProbes)
+	metrics.set(metricBlobServerUnreachable, int64(unreachable))
+	metrics.set(metricRequiredUnreachable, int64(requiredUnreachable))
+
+	hm.mux.Lock()
+	defer hm.mux.Unlock()
+	hm.blobServers = statuses
+	hm.lastProbe = hm.now().UTC()
+}
+
+//lastStatuses returns the blob server statuses of the last probe, and when it ran.  A monitor which has not probed
+//yet, or never probes, reports no blob servers
+func (hm *healthMonitor) lastStatuses() ([]blobServerStatus, *time.Time) {
+	if hm == nil {
+		return nil, nil
+	}
+	hm.mux.Lock()
+	defer hm.mux.Unlock()
+	if hm.lastProbe.IsZero() {
+		return hm.blobServers, nil
+	}
+	lastProbe := hm.lastProbe
+	return hm.blobServers, &lastProbe
+}
+
+//health reports the current health of the plugin, and records whether it is degraded in the metrics
+func (a *apiManager) health() healthResult {
+	result := healthResult{Status: healthStatusOK}
+	if a.dbMan != nil {
+		result.SnapshotReceived = a.dbMan.getDbVersion() != ""
+		if err := a.dbMan.getDbError(); err != nil {
+			result.Status = healthStatusDegraded
+			result.DbError = healthDbError
+		}
+	}
+	result.BlobServers, result.LastProbe = a.healthMonitor.lastStatuses()
+
+	for _, status := range result.BlobServers {
+		if status.Reachable {
+			continue
+		}
+		if status.Required {
+			result.Status = healthStatusUnavailable
+		} else if result.Status == healthStatusOK {
+			result.Status = healthStatusDegraded
+		}
+	}
+	if !result.SnapshotReceived {
+		result.Status = healthStatusStarting
+	}
+
+	degraded, unavailable := int64(0), int64(0)
+	if result.Status == healthStatusDegraded {
+		degraded = 1
+	}
+	if result.Status == healthStatusUnavailable {
+		unavailable = 1
+	}
+	snapshot := int64(0)
+	if result.SnapshotReceived {
+		snapshot = 1
+	}
+	metrics.set(metricHealthDegraded, degraded)
+	metrics.set(metricHealthUnavailable, unavailable)
+	metrics.set(metricHealthSnapshot, snapshot)
+	return result
+}
+
+//apiGetHealthEndpoint is the API implementation of the readiness check, answering 503 unless the plugin is ok or
+//merely degraded.  It is registered when the plugin starts, so that it answers before the first snapshot
+func (a *apiManager) apiGetHealthEndpoint(w http.ResponseWriter, r *http.Request) {
+	result := a.health()
+	status := http.StatusOK
+	if result.Status != healthStatusOK && result.Status != healthStatusDegraded {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, r, status, result)
+}
+
+//apiGetLivenessEndpoint is the API implementation of the liveness check.  The plugin has no state it cannot recover
+//from, so it is alive as long as apid serves requests
+func (a *apiManager) apiGetLivenessEndpoint(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, map[string]string{"status": healthStatusOK})
+}
@@ -0,0 +1,117 @@
+package apidGatewayTrace
+
+import (
+	"encoding/json"
+	"errors"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/mock"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("Health", func() {
+
+	var dbMan *mockDbManager
+	var bsClient *mockBlobstoreClient
+	var apiMan *apiManager
+
+	check := func() (int, healthResult) {
+		w := httptest.NewRecorder()
+		apiMan.apiGetHealthEndpoint(w, httptest.NewRequest("GET", healthEndpoint, nil))
+		var result healthResult
+		Expect(json.Unmarshal(w.Body.Bytes(), &result)).To(Succeed())
+		return w.Code, result
+	}
+
+	BeforeEach(func() {
+		dbMan = &mockDbManager{}
+		bsClient = &mockBlobstoreClient{}
+		router, err := newBlobServerRouterFromConfig(blobServerRoutesConfig{Default: &blobServerRoute{BaseURI: "https://blobs"}})
+		Expect(err).To(Succeed())
+		apiMan = &apiManager{dbMan: dbMan, bsClient: bsClient, router: router, healthMonitor: &healthMonitor{now: time.Now}}
+	})
+
+	It("should be starting until the first snapshot arrives", func() {
+		dbMan.On("getDbVersion").Return("")
+		dbMan.On("getDbError").Return(nil)
+		code, result := check()
+		Expect(code).To(Equal(503))
+		Expect(result.Status).To(Equal(healthStatusStarting))
+		Expect(result.SnapshotReceived).To(BeFalse())
+		Expect(metrics.get(metricHealthSnapshot)).To(Equal(int64(0)))
+	})
+
+	It("should be unavailable while a blob server of a required destination is unreachable", func() {
+		dbMan.On("getDbVersion").Return("snapshot")
+		dbMan.On("getDbError").Return(nil)
+		bsClient.On("checkBlobServer", mock.AnythingOfType("blobServerRoute")).Return(0, errors.New("connection refused")).Once()
+		apiMan.healthMonitor.probe(apiMan)
+		code, result := check()
+		Expect(code).To(Equal(503))
+		Expect(result.Status).To(Equal(healthStatusUnavailable))
+		Expect(result.LastProbe).ToNot(BeNil())
+		Expect(metrics.get(metricHealthUnavailable)).To(Equal(int64(1)))
+		Expect(metrics.get(metricBlobServerUnreachable)).To(Equal(int64(1)))
+		Expect(metrics.get(metricRequiredUnreachable)).To(Equal(int64(1)))
+
+		bsClient.On("checkBlobServer", mock.AnythingOfType("blobServerRoute")).Return(200, nil)
+		apiMan.healthMonitor.probe(apiMan)
+		code, result = check()
+		Expect(code).To(Equal(200))
+		Expect(result.Status).To(Equal(healthStatusOK))
+		Expect(result.BlobServers).To(Equal([]blobServerStatus{{BaseURI: "https://blobs", Required: true, Reachable: true, StatusCode: 200}}))
+		Expect(metrics.get(metricHealthUnavailable)).To(Equal(int64(0)))
+	})
+
+	It("should stay ready but degraded while only best-effort and async blob servers are unreachable", func() {
+		dbMan.On("getDbVersion").Return("snapshot")
+		dbMan.On("getDbError").Return(nil)
+		apiMan.destinations = []uploadDestination{
+			{Name: "default", Required: true},
+			{Name: "mirror", BaseURI: "https://mirror"},
+			{Name: "archive", BaseURI: "https://archive", Async: true},
+		}
+		bsClient.On("checkBlobServer", mock.MatchedBy(func(route blobServerRoute) bool { return route.BaseURI == "https://blobs" })).Return(200, nil)
+		bsClient.On("checkBlobServer", mock.AnythingOfType("blobServerRoute")).Return(0, errors.New("connection refused"))
+		apiMan.healthMonitor.probe(apiMan)
+		code, result := check()
+		Expect(code).To(Equal(200))
+		Expect(result.Status).To(Equal(healthStatusDegraded))
+		Expect(result.BlobServers).To(Equal([]blobServerStatus{
+			{BaseURI: "https://blobs", Required: true, Reachable: true, StatusCode: 200},
+			{BaseURI: "https://mirror", Error: "connection refused"},
+			{BaseURI: "https://archive", Error: "connection refused"},
+		}))
+		Expect(metrics.get(metricHealthDegraded)).To(Equal(int64(1)))
+		Expect(metrics.get(metricHealthUnavailable)).To(Equal(int64(0)))
+		Expect(metrics.get(metricBlobServerUnreachable)).To(Equal(int64(2)))
+		Expect(metrics.get(metricRequiredUnreachable)).To(Equal(int64(0)))
+	})
+
+	It("should be degraded, without saying why, while the DB of the last snapshot cannot be opened", func() {
+		dbMan.On("getDbVersion").Return("snapshot")
+		dbMan.On("getDbError").Return(errors.New("unable to access database version next"))
+		bsClient.On("checkBlobServer", mock.AnythingOfType("blobServerRoute")).Return(200, nil)
+		apiMan.healthMonitor.probe(apiMan)
+		code, result := check()
+		Expect(code).To(Equal(200))
+		Expect(result.Status).To(Equal(healthStatusDegraded))
+		Expect(result.DbError).To(Equal(healthDbError))
+		Expect(metrics.get(metricHealthDegraded)).To(Equal(int64(1)))
+		Expect(metrics.get(metricHealthUnavailable)).To(Equal(int64(0)))
+
+		dbMan.On("countTraceSignals").Return(0, nil)
+		w := httptest.NewRecorder()
+		apiMan.apiGetDiagnosticsEndpoint(w, httptest.NewRequest("GET", debugEndpoint, nil))
+		var diagnostics diagnosticsResult
+		Expect(json.Unmarshal(w.Body.Bytes(), &diagnostics)).To(Succeed())
+		Expect(diagnostics.DbError).To(Equal("unable to access database version next"))
+	})
+
+	It("should always be alive", func() {
+		w := httptest.NewRecorder()
+		apiMan.apiGetLivenessEndpoint(w, httptest.NewRequest("GET", healthEndpoint+livenessSuffix, nil))
+		Expect(w.Code).To(Equal(200))
+	})
+})
@@ -0,0 +1,253 @@
+package apidGatewayTrace
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	configIdempotencyWindow   = "apidgatewaytrace_idempotency_window"
+	defaultIdempotencyWindow  = 10 * time.Minute
+	configIdempotencyWait     = "apidgatewaytrace_idempotency_wait"
+	defaultIdempotencyWait    = 30 * time.Second
+	configIdempotencyHash     = "apidgatewaytrace_idempotency_hash_traces"
+	TRANSACTION_ID_HEADER     = "X-Apigee-Transaction-ID"
+	IDEMPOTENCY_KEY_HEADER    = "Idempotency-Key"
+	IDEMPOTENT_REPLAY_HEADER  = "X-Apigee-Idempotent-Replay"
+	metricUploadsDeduplicated = "uploads_deduplicated"
+)
+
+//errUploadInProgress is returned to a duplicate upload which gave up waiting for the first upload of its transaction
+var errUploadInProgress = errors.New("the first upload of the transaction is still in progress")
+
+//idempotentResult is the response given to the first upload of a transaction.  done is closed once that upload
+//finishes, at which point completed tells whether the response may be replayed or the upload failed and should be
+//attempted again
+type idempotentResult struct {
+	done        chan struct{}
+	completed   bool
+	at          time.Time
+	status      int
+	contentType string
+	body        []byte
+}
+
+//idempotencyCache remembers, per debug session, the response to each transaction uploaded within the window, so that
+//an MP retrying an upload gets the original response instead of storing the trace twice.  Duplicates wait for the
+//first upload of their transaction for at most wait.  Uploads are only deduplicated when the MP sends a key, unless
+//hashTraces is set, which keys the others by their content at the cost of reading each of them into memory first
+type idempotencyCache struct {
+	window     time.Duration
+	wait       time.Duration
+	hashTraces bool
+	mux        sync.Mutex
+	results    map[string]*idempotentResult
+	now        func() time.Time
+	stop       chan struct{}
+}
+
+//newIdempotencyCache creates an idempotencyCache, returning nil if deduplication was disabled with a zero window
+func newIdempotencyCache() *idempotencyCache {
+	window := defaultIdempotencyWindow
+	if config.IsSet(configIdempotencyWindow) {
+		window = config.GetDuration(configIdempotencyWindow)
+	}
+	if window <= 0 {
+		return nil
+	}
+	wait := defaultIdempotencyWait
+	if config.IsSet(configIdempotencyWait) {
+		wait = config.GetDuration(configIdempotencyWait)
+	}
+	return &idempotencyCache{
+		window:     window,
+		wait:       wait,
+		hashTraces: config.GetBool(configIdempotencyHash),
+		results:    make(map[string]*idempotentResult),
+		now:        time.Now,
+	}
+}
+
+//idempotencySettings is the deduplication configuration, as reported by the diagnostics endpoint
+type idempotencySettings struct {
+	Enabled    bool   `json:"enabled"`
+	Window     string `json:"window,omitempty"`
+	Wait       string `json:"wait,omitempty"`
+	HashTraces bool   `json:"hashTraces"`
+}
+
+//settings returns the configuration the cache currently applies, which is disabled for a nil cache
+func (ic *idempotencyCache) settings() idempotencySettings {
+	if ic == nil {
+		return idempotencySettings{}
+	}
+	ic.mux.Lock()
+	defer ic.mux.Unlock()
+	return idempotencySettings{Enabled: true, Window: ic.window.String(), Wait: ic.wait.String(), HashTraces: ic.hashTraces}
+}
+
+//key identifies the transaction of an upload by the keys sent by the MP, or if enabled by hashing the trace as
+//received.  It returns an empty key for uploads which are not deduplicated
+func (ic *idempotencyCache) key(upload *traceUpload, header http.Header) (string, error) {
+	if key := strings.TrimSpace(header.Get(TRANSACTION_ID_HEADER)); key != "" {
+		return "transaction:" + key, nil
+	}
+	if key := strings.TrimSpace(header.Get(IDEMPOTENCY_KEY_HEADER)); key != "" {
+		return "key:" + key, nil
+	}
+	ic.mux.Lock()
+	hashTraces := ic.hashTraces
+	ic.mux.Unlock()
+	if !hashTraces {
+		return "", nil
+	}
+	data, err := upload.bufferBody()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+//begin looks up the result for a transaction of a session.  If the transaction is new, or its result expired, the
+//caller becomes its owner and must call finish once the upload is done.  Otherwise begin waits for the owner to
+//finish, and returns its result, unless the owner's upload failed in which case the caller takes over.  Waiting ends
+//with an error when ctx is done or the configured wait has passed
+func (ic *idempotencyCache) begin(ctx context.Context, sessionId, key string) (*idempotentResult, bool, error) {
+	id := sessionId + "\x00" + key
+	ic.mux.Lock()
+	timeout := time.NewTimer(ic.wait)
+	ic.mux.Unlock()
+	defer timeout.Stop()
+	for {
+		ic.mux.Lock()
+		result, ok := ic.results[id]
+		if !ok || ic.expired(result) {
+			result = &idempotentResult{done: make(chan struct{})}
+			ic.results[id] = result
+			ic.mux.Unlock()
+			return result, true, nil
+		}
+		ic.mux.Unlock()
+
+		select {
+		case <-result.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case <-timeout.C:
+			return nil, false, errUploadInProgress
+		}
+		if result.completed {
+			return result, false, nil
+		}
+	}
+}
+
+//finish records the response an owner gave for its transaction.  Only successful responses are remembered, so that
+//a retry after a failure uploads the trace again
+func (ic *idempotencyCache) finish(sessionId, key string, result *idempotentResult, rec *recordingResponseWriter) {
+	id := sessionId + "\x00" + key
+	ic.mux.Lock()
+	defer ic.mux.Unlock()
+	if rec.status >= 200 && rec.status < 300 {
+		result.completed = true
+		result.at = ic.now()
+		result.status = rec.status
+		result.contentType = rec.Header().Get("Content-Type")
+		result.body = rec.body.Bytes()
+	} else {
+		delete(ic.results, id)
+	}
+	close(result.done)
+}
+
+//expired tells whether a result is older than the window.  Callers must hold the mutex
+func (ic *idempotencyCache) expired(result *idempotentResult) bool {
+	return result.completed && ic.now().Sub(result.at) > ic.window
+}
+
+//prune forgets results older than the window
+func (ic *idempotencyCache) prune() {
+	ic.mux.Lock()
+	defer ic.mux.Unlock()
+	for id, result := range ic.results {
+		if ic.expired(result) {
+			delete(ic.results, id)
+		}
+	}
+}
+
+//startPruning prunes the cache once per window until stopPruning is called, so that transactions which are never
+//retried do not accumulate.  Lookups expire results on their own, so pruning only bounds memory
+func (ic *idempotencyCache) startPruning() {
+	ic.stop = make(chan struct{})
+	go func(stop chan struct{}) {
+		for {
+			ic.mux.Lock()
+			window := ic.window
+			ic.mux.Unlock()
+			select {
+			case <-time.After(window):
+				ic.prune()
+			case <-stop:
+				return
+			}
+		}
+	}(ic.stop)
+}
+
+//stopPruning stops the pruning started by startPruning
+func (ic *idempotencyCache) stopPruning() {
+	if ic.stop != nil {
+		close(ic.stop)
+		ic.stop = nil
+	}
+}
+
+//reconfigure takes the settings of other, keeping the transactions already remembered
+func (ic *idempotencyCache) reconfigure(other *idempotencyCache) {
+	ic.mux.Lock()
+	defer ic.mux.Unlock()
+	ic.window = other.window
+	ic.wait = other.wait
+	ic.hashTraces = other.hashTraces
+}
+
+//replay writes a remembered response again, flagging it as such for the MP
+func (result *idempotentResult) replay(w http.ResponseWriter) {
+	if result.contentType != "" {
+		w.Header().Set("Content-Type", result.contentType)
+	}
+	w.Header().Set(IDEMPOTENT_REPLAY_HEADER, "true")
+	w.WriteHeader(result.status)
+	w.Write(result.body)
+}
+
+//recordingResponseWriter passes a response through to the client while keeping a copy of its status and body
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *recordingResponseWriter) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recordingResponseWriter) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
@@ -0,0 +1,197 @@
+package apidGatewayTrace
+
+import (
+	"context"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Idempotent uploads", func() {
+
+	var mockBsClient *mockBlobstoreClient
+	var apiMan *apiManager
+
+	upload := func(sessionId, trace string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/uploadtrace", strings.NewReader(trace))
+		r.Header.Add(UPLOAD_TRACESESSION_HEADER, sessionId)
+		for name, values := range header {
+			r.Header.Set(name, values[0])
+		}
+		w := httptest.NewRecorder()
+		apiMan.apiUploadTraceDataEndpoint(w, r)
+		return w
+	}
+
+	BeforeEach(func() {
+		mockBsClient = &mockBlobstoreClient{}
+		apiMan = &apiManager{bsClient: mockBsClient, idempotency: newIdempotencyCache()}
+		mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), defaultBlobServerRoute()).Return(&blobServerResponse{Id: "testblob", SignedUrl: "testurl"}, nil)
+	})
+
+	It("should replay the result of a transaction uploaded twice", func() {
+		mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Return(&http.Response{StatusCode: 201}, nil).Once()
+		header := http.Header{TRANSACTION_ID_HEADER: {"tx1"}}
+		first := upload("org__env__app__rev__id", "a trace", header)
+		Expect(first.Code).To(Equal(201))
+
+		second := upload("org__env__app__rev__id", "a retried trace", header)
+		Expect(second.Code).To(Equal(201))
+		Expect(second.Body.String()).To(Equal(first.Body.String()))
+		Expect(second.Header().Get("Content-Type")).To(Equal("application/json"))
+		Expect(second.Header().Get(IDEMPOTENT_REPLAY_HEADER)).To(Equal("true"))
+		mockBsClient.AssertNumberOfCalls(GinkgoT(), "uploadToBlobstore", 1)
+	})
+
+	It("should key transactions by session and header", func() {
+		mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Return(&http.Response{StatusCode: 200}, nil)
+		upload("org__env__app__rev__id", "a trace", http.Header{IDEMPOTENCY_KEY_HEADER: {"k"}})
+		upload("org__env__app__rev__other", "a trace", http.Header{IDEMPOTENCY_KEY_HEADER: {"k"}})
+		Expect(upload("org__env__app__rev__id", "a trace", http.Header{IDEMPOTENCY_KEY_HEADER: {"k"}}).Header().Get(IDEMPOTENT_REPLAY_HEADER)).To(Equal("true"))
+		mockBsClient.AssertNumberOfCalls(GinkgoT(), "uploadToBlobstore", 2)
+
+		//uploads without a key are not deduplicated, nor read before they are streamed
+		Expect(upload("org__env__app__rev__id", "a trace", nil).Header().Get(IDEMPOTENT_REPLAY_HEADER)).To(Equal(""))
+		Expect(upload("org__env__app__rev__id", "a trace", nil).Header().Get(IDEMPOTENT_REPLAY_HEADER)).To(Equal(""))
+		mockBsClient.AssertNumberOfCalls(GinkgoT(), "uploadToBlobstore", 4)
+		trace := &traceUpload{body: strings.NewReader("a trace")}
+		key, err := apiMan.idempotency.key(trace, http.Header{})
+		Expect(err).To(Succeed())
+		Expect(key).To(Equal(""))
+		Expect(trace.body.(*strings.Reader).Len()).To(Equal(len("a trace")))
+	})
+
+	It("should key transactions by content when enabled", func() {
+		config.Set(configIdempotencyHash, true)
+		defer config.Set(configIdempotencyHash, false)
+		apiMan.idempotency = newIdempotencyCache()
+		mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Return(&http.Response{StatusCode: 200}, nil)
+		Expect(upload("org__env__app__rev__id", "a trace", nil).Header().Get(IDEMPOTENT_REPLAY_HEADER)).To(Equal(""))
+		Expect(upload("org__env__app__rev__id", "a trace", nil).Header().Get(IDEMPOTENT_REPLAY_HEADER)).To(Equal("true"))
+		upload("org__env__app__rev__id", "another trace", nil)
+		mockBsClient.AssertNumberOfCalls(GinkgoT(), "uploadToBlobstore", 2)
+	})
+
+	It("should apply the upload limits before looking up the transaction", func() {
+		config.Set(configSampleRate, 0)
+		defer config.Set(configSampleRate, 1)
+		mockDbMan := &mockDbManager{}
+		mockDbMan.On("findTraceSignal", mock.Anything).Return((*traceSignal)(nil), nil)
+		limiter, err := newUploadLimiter(mockDbMan)
+		Expect(err).To(Succeed())
+		apiMan.limiter = limiter
+		w := upload("org__env__app__rev__id", "a trace", http.Header{TRANSACTION_ID_HEADER: {"tx1"}})
+		Expect(w.Code).To(Equal(http.StatusAccepted))
+		Expect(apiMan.idempotency.results).To(BeEmpty())
+		mockBsClient.AssertNotCalled(GinkgoT(), "uploadToBlobstore", mock.Anything, mock.Anything)
+	})
+
+	It("should upload again after a failure", func() {
+		mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Return((*http.Response)(nil), io.ErrUnexpectedEOF).Once()
+		mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Return(&http.Response{StatusCode: 200}, nil).Once()
+		header := http.Header{TRANSACTION_ID_HEADER: {"tx1"}}
+		Expect(upload("org__env__app__rev__id", "a trace", header).Code).To(Equal(500))
+		Expect(upload("org__env__app__rev__id", "a trace", header).Code).To(Equal(200))
+		mockBsClient.AssertNumberOfCalls(GinkgoT(), "uploadToBlobstore", 2)
+	})
+
+	It("should make concurrent duplicates wait for the first upload", func() {
+		release := make(chan struct{})
+		mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Run(func(args mock.Arguments) {
+			<-release
+		}).Return(&http.Response{StatusCode: 200}, nil).Once()
+		header := http.Header{TRANSACTION_ID_HEADER: {"tx1"}}
+		results := make(chan *httptest.ResponseRecorder, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				defer GinkgoRecover()
+				results <- upload("org__env__app__rev__id", "a trace", header)
+			}()
+		}
+		Consistently(results, 100*time.Millisecond).ShouldNot(Receive())
+		close(release)
+		Expect((<-results).Code).To(Equal(200))
+		Expect((<-results).Code).To(Equal(200))
+		mockBsClient.AssertNumberOfCalls(GinkgoT(), "uploadToBlobstore", 1)
+	})
+
+	It("should forget transactions after the window", func() {
+		now := time.Now()
+		apiMan.idempotency.now = func() time.Time { return now }
+		mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Return(&http.Response{StatusCode: 200}, nil)
+		header := http.Header{TRANSACTION_ID_HEADER: {"tx1"}}
+		upload("org__env__app__rev__id", "a trace", header)
+		now = now.Add(defaultIdempotencyWindow + time.Second)
+		Expect(upload("org__env__app__rev__id", "a trace", header).Header().Get(IDEMPOTENT_REPLAY_HEADER)).To(Equal(""))
+		Expect(apiMan.idempotency.results).To(HaveLen(1))
+	})
+
+	It("should stop waiting for the first upload after the configured wait", func() {
+		apiMan.idempotency.wait = 50 * time.Millisecond
+		release := make(chan struct{})
+		defer close(release)
+		mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Run(func(args mock.Arguments) {
+			<-release
+		}).Return(&http.Response{StatusCode: 200}, nil).Once()
+		header := http.Header{TRANSACTION_ID_HEADER: {"tx1"}}
+		go func() {
+			defer GinkgoRecover()
+			upload("org__env__app__rev__id", "a trace", header)
+		}()
+		Eventually(func() int {
+			apiMan.idempotency.mux.Lock()
+			defer apiMan.idempotency.mux.Unlock()
+			return len(apiMan.idempotency.results)
+		}).Should(Equal(1))
+		w := upload("org__env__app__rev__id", "a trace", header)
+		Expect(w.Code).To(Equal(http.StatusConflict))
+		Expect(w.Body.String()).To(ContainSubstring("upload_in_progress"))
+	})
+
+	It("should stop waiting for the first upload when the request is canceled", func() {
+		first, owner, err := apiMan.idempotency.begin(context.Background(), "org__env__app__rev__id", "tx1")
+		Expect(err).To(Succeed())
+		Expect(owner).To(BeTrue())
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, _, err = apiMan.idempotency.begin(ctx, "org__env__app__rev__id", "tx1")
+		Expect(err).To(Equal(context.Canceled))
+		apiMan.idempotency.finish("org__env__app__rev__id", "tx1", first,
+			&recordingResponseWriter{ResponseWriter: httptest.NewRecorder(), status: 200})
+	})
+
+	It("should prune expired transactions which are never retried", func() {
+		now := time.Now()
+		apiMan.idempotency.now = func() time.Time { return now }
+		mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Return(&http.Response{StatusCode: 200}, nil)
+		upload("org__env__app__rev__id", "a trace", http.Header{TRANSACTION_ID_HEADER: {"tx1"}})
+		upload("org__env__app__rev__id", "a trace", http.Header{TRANSACTION_ID_HEADER: {"tx2"}})
+		apiMan.idempotency.prune()
+		Expect(apiMan.idempotency.results).To(HaveLen(2))
+		now = now.Add(defaultIdempotencyWindow + time.Second)
+		apiMan.idempotency.prune()
+		Expect(apiMan.idempotency.results).To(BeEmpty())
+	})
+
+	It("should be disabled by a zero window", func() {
+		config.Set(configIdempotencyWindow, "0s")
+		defer config.Set(configIdempotencyWindow, defaultIdempotencyWindow.String())
+		Expect(newIdempotencyCache()).To(BeNil())
+	})
+
+	It("should hash the trace when the MP sends no key and hashing is enabled", func() {
+		apiMan.idempotency.hashTraces = true
+		trace := &traceUpload{body: strings.NewReader("a trace")}
+		key, err := apiMan.idempotency.key(trace, http.Header{})
+		Expect(err).To(Succeed())
+		Expect(key).To(HavePrefix("sha256:"))
+		body, _ := ioutil.ReadAll(trace.body)
+		Expect(string(body)).To(Equal("a trace"))
+	})
+})
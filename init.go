@@ -2,7 +2,6 @@ package apidGatewayTrace
 
 import (
 	"github.com/apid/apid-core"
-	"net/http"
 	"sync"
 )
 
@@ -13,8 +12,15 @@ var (
 )
 
 const (
-	signalEndpoint = "/tracesignals"
-	uploadEndpoint = "/uploadtrace"
+	signalEndpoint       = "/tracesignals"
+	uploadEndpoint       = "/uploadtrace"
+	transactionsEndpoint = "/tracesessions/{id}/transactions"
+	sessionEndpoint      = "/tracesessions/{id}"
+	deadLettersEndpoint  = "/tracedeadletters"
+	reloadEndpoint       = "/traceconfig/reload"
+	debugEndpoint        = "/tracesignals/debug"
+	healthEndpoint       = "/tracehealth"
+	livenessSuffix       = "/live"
 )
 
 //initServices initializes global apid-core based variables
@@ -32,27 +38,45 @@ func initPlugin(s apid.Services) (apid.PluginData, error) {
 		data:  services.Data(),
 		dbMux: sync.RWMutex{},
 	}
+	if err := dbMan.initDb(); err != nil {
+		return pluginData, err
+	}
+	dbMan.startIndexPruning()
+
+	cfg, err := loadPluginConfig(dbMan)
+	if err != nil {
+		return pluginData, err
+	}
 
 	apiMan := &apiManager{
-		dbMan: dbMan,
-		bsClient: &blobstoreClient{
-			httpClient: &http.Client{
-				Transport: &http.Transport{
-					MaxIdleConnsPerHost: maxIdleConnsPerHost,
-				},
-				Timeout: httpTimeout,
-				CheckRedirect: func(req *http.Request, _ []*http.Request) error {
-					req.Header.Set("Authorization", getBearerToken())
-					return nil
-				},
-			},
-		},
-		signalEndpoint: signalEndpoint,
-		uploadEndpoint: uploadEndpoint,
-		apiInitialized: false,
-		newSignal:      make(chan interface{}),
-		addSubscriber:  make(chan chan interface{}),
+		dbMan:                dbMan,
+		sessions:             newSessionValidator(dbMan),
+		asyncUploads:         newAsyncUploadQueue(),
+		healthMonitor:        newHealthMonitor(),
+		signalEndpoint:       cfg.Endpoints.Signal,
+		uploadEndpoint:       cfg.Endpoints.Upload,
+		transactionsEndpoint: cfg.Endpoints.Transactions,
+		sessionEndpoint:      cfg.Endpoints.Session,
+		deadLettersEndpoint:  cfg.Endpoints.DeadLetters,
+		reloadEndpoint:       cfg.Endpoints.Reload,
+		debugEndpoint:        cfg.Endpoints.Debug,
+		healthEndpoint:       cfg.Endpoints.Health,
+		endpointPrefix:       cfg.Endpoints.Prefix,
+		signalAliases:        cfg.Endpoints.SignalAliases,
+		uploadAliases:        cfg.Endpoints.UploadAliases,
+		apiInitialized:       false,
+		newSignal:            make(chan interface{}),
+		addSubscriber:        make(chan chan interface{}),
+	}
+	apiMan.applyConfig(cfg)
+	apiMan.reloadOnSignal()
+
+	//endpoints are registered right away, so that callers are told the plugin is not ready rather than getting 404
+	//until the first snapshot arrives
+	if err := apiMan.registerAPI(); err != nil {
+		return pluginData, err
 	}
+	apiMan.healthMonitor.start(apiMan)
 
 	// initialize event handler
 	eventHandler := &apigeeSyncHandler{
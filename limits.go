@@ -0,0 +1,261 @@
+package apidGatewayTrace
+
+import (
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	configSampleRate          = "apidgatewaytrace_sample_rate"
+	configSessionRateLimit    = "apidgatewaytrace_session_rate_limit"
+	configSessionRateBurst    = "apidgatewaytrace_session_rate_burst"
+	configOrgRateLimit        = "apidgatewaytrace_org_rate_limit"
+	configOrgRateBurst        = "apidgatewaytrace_org_rate_burst"
+	signalParamSampleRate     = "sampleRate"
+	signalParamRateLimit      = "rateLimit"
+	signalParamRateBurst      = "rateBurst"
+	dropReasonSampled         = "sampled"
+	dropReasonSessionLimit    = "session_rate_limited"
+	dropReasonOrgLimit        = "org_rate_limited"
+	metricUploadsSampledOut   = "uploads_sampled_out"
+	metricUploadsRateLimited  = "uploads_rate_limited"
+	idleSessionLimitsLifetime = time.Hour
+)
+
+//limitSettings describes how many of a session's uploads are kept.  A zero rate means no rate limit, and the burst
+//defaults to one second worth of uploads
+type limitSettings struct {
+	SampleRate float64
+	Rate       float64
+	Burst      int
+}
+
+//sessionCounts tallies what happened to the uploads of a debug session
+type sessionCounts struct {
+	Accepted    int64 `json:"accepted"`
+	Sampled     int64 `json:"sampledOut"`
+	RateLimited int64 `json:"rateLimited"`
+}
+
+//sessionLimits is the sampling and rate limiting state of a single debug session
+type sessionLimits struct {
+	settings limitSettings
+	bucket   *tokenBucket
+	counts   sessionCounts
+	lastSeen time.Time
+}
+
+//uploadLimiter samples and rate limits uploads, per debug session and per org.  Session settings come from config,
+//and may be overridden by query parameters of the session's trace signal URI
+type uploadLimiter struct {
+	dbMan    dbManagerInterface
+	session  limitSettings
+	org      limitSettings
+	mux      sync.Mutex
+	sessions map[string]*sessionLimits
+	orgs     map[string]*tokenBucket
+	now      func() time.Time
+	random   func() float64
+}
+
+//newUploadLimiter creates the uploadLimiter from the plugin configuration, rejecting out of range settings
+func newUploadLimiter(dbMan dbManagerInterface) (*uploadLimiter, error) {
+	ul := &uploadLimiter{
+		dbMan:    dbMan,
+		session:  limitSettings{SampleRate: 1},
+		sessions: make(map[string]*sessionLimits),
+		orgs:     make(map[string]*tokenBucket),
+		now:      time.Now,
+		random:   rand.Float64,
+	}
+	if config.IsSet(configSampleRate) {
+		ul.session.SampleRate = config.GetFloat64(configSampleRate)
+	}
+	ul.session.Rate = config.GetFloat64(configSessionRateLimit)
+	ul.session.Burst = config.GetInt(configSessionRateBurst)
+	ul.org.Rate = config.GetFloat64(configOrgRateLimit)
+	ul.org.Burst = config.GetInt(configOrgRateBurst)
+	if err := ul.session.validate(); err != nil {
+		return nil, err
+	}
+	if err := ul.org.validate(); err != nil {
+		return nil, err
+	}
+	return ul, nil
+}
+
+func (ls limitSettings) validate() error {
+	if ls.SampleRate < 0 || ls.SampleRate > 1 {
+		return fmt.Errorf("sample rate must be between 0 and 1, got %v", ls.SampleRate)
+	}
+	if ls.Rate < 0 || ls.Burst < 0 {
+		return fmt.Errorf("rate limit and burst must not be negative, got %v and %d", ls.Rate, ls.Burst)
+	}
+	return nil
+}
+
+//overriddenBy applies the limit settings found in the query of a trace signal URI, ignoring invalid values
+func (ls limitSettings) overriddenBy(signalUri string) limitSettings {
+	u, err := url.Parse(signalUri)
+	if err != nil {
+		return ls
+	}
+	query := u.Query()
+	overridden := ls
+	if v, err := strconv.ParseFloat(query.Get(signalParamSampleRate), 64); err == nil {
+		overridden.SampleRate = v
+	}
+	if v, err := strconv.ParseFloat(query.Get(signalParamRateLimit), 64); err == nil {
+		overridden.Rate = v
+	}
+	if v, err := strconv.Atoi(query.Get(signalParamRateBurst)); err == nil {
+		overridden.Burst = v
+	}
+	if err := overridden.validate(); err != nil {
+		log.Errorf("ignoring limits of trace signal %s: %v", signalUri, err)
+		return ls
+	}
+	return overridden
+}
+
+//newBucket creates the token bucket enforcing the settings, nil if they do not limit the rate
+func (ls limitSettings) newBucket(now time.Time) *tokenBucket {
+	if ls.Rate == 0 {
+		return nil
+	}
+	burst := float64(ls.Burst)
+	if burst == 0 {
+		burst = ls.Rate
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: ls.Rate, burst: burst, tokens: burst, last: now}
+}
+
+//admit decides whether an upload should be stored, returning the reason it is dropped or "" if it is not.  Sampling
+//comes first so that uploads which are sampled out do not use up the rate limits
+func (ul *uploadLimiter) admit(sessionId *debugSessionId) (string, error) {
+	sl, err := ul.sessionLimits(sessionId)
+	if err != nil {
+		return "", err
+	}
+
+	ul.mux.Lock()
+	defer ul.mux.Unlock()
+	now := ul.now()
+	sl.lastSeen = now
+
+	if sl.settings.SampleRate < 1 && ul.random() >= sl.settings.SampleRate {
+		sl.counts.Sampled++
+		metrics.inc(metricUploadsSampledOut)
+		return dropReasonSampled, nil
+	}
+	if sl.bucket != nil && !sl.bucket.take(now) {
+		sl.counts.RateLimited++
+		metrics.inc(metricUploadsRateLimited)
+		return dropReasonSessionLimit, nil
+	}
+	orgBucket, ok := ul.orgs[sessionId.Organization]
+	if !ok {
+		orgBucket = ul.org.newBucket(now)
+		ul.orgs[sessionId.Organization] = orgBucket
+	}
+	if orgBucket != nil && !orgBucket.take(now) {
+		sl.counts.RateLimited++
+		metrics.inc(metricUploadsRateLimited)
+		return dropReasonOrgLimit, nil
+	}
+	sl.counts.Accepted++
+	return "", nil
+}
+
+//sessionLimits returns the state of a session, creating it on its first upload.  The trace signal is only read then,
+//as signals are inserted and deleted but never updated
+func (ul *uploadLimiter) sessionLimits(sessionId *debugSessionId) (*sessionLimits, error) {
+	ul.mux.Lock()
+	sl, ok := ul.sessions[sessionId.Raw]
+	settings := ul.session
+	ul.mux.Unlock()
+	if ok {
+		return sl, nil
+	}
+
+	if ul.dbMan != nil {
+		signal, err := ul.dbMan.findTraceSignal(sessionId.signalIds()...)
+		if err != nil {
+			return nil, err
+		}
+		if signal != nil {
+			settings = settings.overriddenBy(signal.Uri)
+		}
+	}
+
+	ul.mux.Lock()
+	defer ul.mux.Unlock()
+	if sl, ok := ul.sessions[sessionId.Raw]; ok {
+		return sl, nil
+	}
+	now := ul.now()
+	ul.pruneSessions(now)
+	sl = &sessionLimits{settings: settings, bucket: settings.newBucket(now), lastSeen: now}
+	ul.sessions[sessionId.Raw] = sl
+	return sl, nil
+}
+
+//reconfigure changes the limit settings after a configuration reload.  Sessions already seen keep their settings,
+//while the org buckets start over with the new ones
+func (ul *uploadLimiter) reconfigure(session, org limitSettings) {
+	ul.mux.Lock()
+	defer ul.mux.Unlock()
+	ul.session = session
+	ul.org = org
+	ul.orgs = make(map[string]*tokenBucket)
+}
+
+//counts returns the tally of a session's uploads, zero if none were seen recently
+func (ul *uploadLimiter) counts(sessionId *debugSessionId) sessionCounts {
+	ul.mux.Lock()
+	defer ul.mux.Unlock()
+	if sl, ok := ul.sessions[sessionId.Raw]; ok {
+		return sl.counts
+	}
+	return sessionCounts{}
+}
+
+//pruneSessions forgets sessions which have not uploaded for a while.  Callers must hold the mutex
+func (ul *uploadLimiter) pruneSessions(now time.Time) {
+	for id, sl := range ul.sessions {
+		if now.Sub(sl.lastSeen) > idleSessionLimitsLifetime {
+			delete(ul.sessions, id)
+		}
+	}
+}
+
+//tokenBucket allows rate events per second on average, with bursts of up to burst events
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+//take refills the bucket for the time elapsed since the last call, then uses a token if one is available
+func (tb *tokenBucket) take(now time.Time) bool {
+	if elapsed := now.Sub(tb.last); elapsed > 0 {
+		tb.tokens += elapsed.Seconds() * tb.rate
+		if tb.tokens > tb.burst {
+			tb.tokens = tb.burst
+		}
+		tb.last = now
+	}
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
@@ -0,0 +1,148 @@
+package apidGatewayTrace
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/mock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Upload limits", func() {
+
+	var mockDbMan *mockDbManager
+	var now time.Time
+	var random float64
+
+	newLimiter := func() *uploadLimiter {
+		ul, err := newUploadLimiter(mockDbMan)
+		Expect(err).To(Succeed())
+		ul.now = func() time.Time { return now }
+		ul.random = func() float64 { return random }
+		return ul
+	}
+
+	BeforeEach(func() {
+		mockDbMan = &mockDbManager{}
+		mockDbMan.On("findTraceSignal", mock.Anything).Return((*traceSignal)(nil), nil)
+		now = time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+		random = 0.5
+	})
+
+	AfterEach(func() {
+		for _, key := range []string{configSampleRate, configSessionRateLimit, configSessionRateBurst,
+			configOrgRateLimit, configOrgRateBurst} {
+			config.Set(key, 0)
+		}
+		config.Set(configSampleRate, 1)
+	})
+
+	It("should refill token buckets over time up to the burst", func() {
+		tb := limitSettings{Rate: 2, Burst: 3}.newBucket(now)
+		for i := 0; i < 3; i++ {
+			Expect(tb.take(now)).To(BeTrue())
+		}
+		Expect(tb.take(now)).To(BeFalse())
+		Expect(tb.take(now.Add(400 * time.Millisecond))).To(BeFalse())
+		Expect(tb.take(now.Add(500 * time.Millisecond))).To(BeTrue())
+		Expect(tb.take(now.Add(500 * time.Millisecond))).To(BeFalse())
+
+		tb.take(now.Add(time.Hour))
+		Expect(tb.tokens).To(Equal(2.0))
+		Expect(limitSettings{}.newBucket(now)).To(BeNil())
+	})
+
+	It("should admit everything by default", func() {
+		ul := newLimiter()
+		for i := 0; i < 100; i++ {
+			Expect(ul.admit(mustParseSessionId("org__env__app__rev__id"))).To(Equal(""))
+		}
+		Expect(ul.counts(mustParseSessionId("org__env__app__rev__id")).Accepted).To(Equal(int64(100)))
+	})
+
+	It("should sample uploads", func() {
+		config.Set(configSampleRate, 0.25)
+		ul := newLimiter()
+		sessionId := mustParseSessionId("org__env__app__rev__id")
+		Expect(ul.admit(sessionId)).To(Equal(dropReasonSampled))
+		random = 0.1
+		Expect(ul.admit(sessionId)).To(Equal(""))
+		Expect(ul.counts(sessionId)).To(Equal(sessionCounts{Accepted: 1, Sampled: 1}))
+	})
+
+	It("should rate limit sessions independently", func() {
+		config.Set(configSessionRateLimit, 1)
+		config.Set(configSessionRateBurst, 2)
+		ul := newLimiter()
+		first := mustParseSessionId("org__env__app__rev__first")
+		second := mustParseSessionId("org__env__app__rev__second")
+		Expect(ul.admit(first)).To(Equal(""))
+		Expect(ul.admit(first)).To(Equal(""))
+		Expect(ul.admit(first)).To(Equal(dropReasonSessionLimit))
+		Expect(ul.admit(second)).To(Equal(""))
+		now = now.Add(time.Second)
+		Expect(ul.admit(first)).To(Equal(""))
+		Expect(ul.counts(first)).To(Equal(sessionCounts{Accepted: 3, RateLimited: 1}))
+	})
+
+	It("should rate limit all sessions of an org together", func() {
+		config.Set(configOrgRateLimit, 1)
+		ul := newLimiter()
+		Expect(ul.admit(mustParseSessionId("org__env__app__rev__first"))).To(Equal(""))
+		Expect(ul.admit(mustParseSessionId("org__env__app__rev__second"))).To(Equal(dropReasonOrgLimit))
+		Expect(ul.admit(mustParseSessionId("other__env__app__rev__third"))).To(Equal(""))
+	})
+
+	It("should let the trace signal override the session settings", func() {
+		config.Set(configSessionRateLimit, 100)
+		mockDbMan = &mockDbManager{}
+		mockDbMan.On("findTraceSignal", []string{"org__env__app__rev__id", "id"}).Return(
+			&traceSignal{Id: "id", Uri: "https://mp/trace?sampleRate=1&rateLimit=1&rateBurst=1"}, nil)
+		mockDbMan.On("findTraceSignal", mock.Anything).Return(
+			&traceSignal{Id: "bad", Uri: "https://mp/trace?sampleRate=2&rateLimit=1"}, nil)
+		ul := newLimiter()
+		sessionId := mustParseSessionId("org__env__app__rev__id")
+		Expect(ul.admit(sessionId)).To(Equal(""))
+		Expect(ul.admit(sessionId)).To(Equal(dropReasonSessionLimit))
+
+		bad := mustParseSessionId("org__env__app__rev__bad")
+		Expect(ul.admit(bad)).To(Equal(""))
+		Expect(ul.admit(bad)).To(Equal(""))
+		mockDbMan.AssertNumberOfCalls(GinkgoT(), "findTraceSignal", 2)
+	})
+
+	It("should reject out of range settings", func() {
+		config.Set(configSampleRate, 1.5)
+		_, err := newUploadLimiter(mockDbMan)
+		Expect(err).ToNot(Succeed())
+		config.Set(configSampleRate, 1)
+		config.Set(configOrgRateLimit, -1)
+		_, err = newUploadLimiter(mockDbMan)
+		Expect(err).ToNot(Succeed())
+	})
+
+	Context("API", func() {
+		It("should acknowledge dropped uploads and count them in the session status", func() {
+			config.Set(configSampleRate, 0)
+			apiMan := &apiManager{limiter: newLimiter()}
+			r := httptest.NewRequest("POST", "/uploadtrace", strings.NewReader("a trace"))
+			r.Header.Add(UPLOAD_TRACESESSION_HEADER, "org__env__app__rev__limited")
+			w := httptest.NewRecorder()
+			apiMan.apiUploadTraceDataEndpoint(w, r)
+			Expect(w.Code).To(Equal(http.StatusAccepted))
+			Expect(w.Body.String()).To(MatchJSON(`{"dropped":"sampled"}`))
+
+			services.API().Router().HandleFunc("/limits"+sessionEndpoint, apiMan.apiGetTraceSessionEndpoint)
+			w = httptest.NewRecorder()
+			services.API().Router().ServeHTTP(w, httptest.NewRequest("GET", "/limits/tracesessions/org__env__app__rev__limited", nil))
+			Expect(w.Code).To(Equal(200))
+			var result sessionStatusResult
+			Expect(json.Unmarshal(w.Body.Bytes(), &result)).To(Succeed())
+			Expect(result.SessionId).To(Equal("org__env__app__rev__limited"))
+			Expect(result.Sampled).To(Equal(int64(1)))
+		})
+	})
+})
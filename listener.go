@@ -3,6 +3,7 @@ package apidGatewayTrace
 import (
 	"github.com/apid/apid-core"
 	"github.com/apigee-labs/transicator/common"
+	"time"
 )
 
 const (
@@ -33,12 +34,18 @@ func (h *apigeeSyncHandler) Handle(e apid.Event) {
 }
 
 //processSnapshot assumes that all rows have already been inserted by apidApigeeSync plugin, and merely updates the db
-//version.  It also calls the idempotent InitAPI method of it's apiManager
+//version.  It also calls the idempotent InitAPI method of it's apiManager, unless no DB version could be opened yet
 func (h *apigeeSyncHandler) processSnapshot(snapshot *common.Snapshot) {
 
 	log.Debugf("Snapshot received. Switching to DB version: %s", snapshot.SnapshotInfo)
+	metrics.set(metricLastSnapshotTime, time.Now().UnixNano()/int64(time.Millisecond))
 
-	h.dbMan.setDbVersion(snapshot.SnapshotInfo)
+	if err := h.dbMan.setDbVersion(snapshot.SnapshotInfo); err != nil {
+		log.Errorf("keeping the previous database until the next snapshot: %v", err)
+		if h.dbMan.getDbVersion() == "" {
+			return
+		}
+	}
 
 	//InitAPI is idempotent
 	h.apiMan.InitAPI()
@@ -50,6 +57,7 @@ func (h *apigeeSyncHandler) processSnapshot(snapshot *common.Snapshot) {
 func (h *apigeeSyncHandler) processChangeList(changes *common.ChangeList) {
 
 	log.Debugf("Processing changes")
+	metrics.set(metricLastChangeListTime, time.Now().UnixNano()/int64(time.Millisecond))
 	// changes have been applied to DB
 	for _, change := range changes.Changes {
 		switch change.Table {
@@ -58,6 +66,10 @@ func (h *apigeeSyncHandler) processChangeList(changes *common.ChangeList) {
 			case common.Insert:
 				h.apiMan.notifyChange(true)
 			case common.Delete:
+				var id string
+				if err := change.OldRow.Get("id", &id); err == nil && id != "" {
+					h.apiMan.sessionDeleted(id)
+				}
 				h.apiMan.notifyChange(true)
 			case common.Update:
 				log.Errorf("Update operation on table %s not supported", TRACESIGNAL_PG_TABLENAME)
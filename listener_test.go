@@ -1,8 +1,10 @@
 package apidGatewayTrace
 
 import (
+	"errors"
 	"github.com/apigee-labs/transicator/common"
 	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
 )
 
 var _ = Describe("Listener", func() {
@@ -14,7 +16,7 @@ var _ = Describe("Listener", func() {
 			apiManager.On("InitAPI").Return()
 
 			dbManager := new(mockDbManager)
-			dbManager.On("setDbVersion", "testSnapshotId").Return()
+			dbManager.On("setDbVersion", "testSnapshotId").Return(nil)
 
 			handler := apigeeSyncHandler{
 				dbMan:  dbManager,
@@ -24,9 +26,30 @@ var _ = Describe("Listener", func() {
 			handler.Handle(&common.Snapshot{SnapshotInfo: "testSnapshotId"})
 			apiManager.AssertNumberOfCalls(GinkgoT(), "InitAPI", 1)
 			dbManager.AssertNumberOfCalls(GinkgoT(), "setDbVersion", 1)
+			Expect(metricTime(metrics.get(metricLastSnapshotTime))).ToNot(BeNil())
 
 		})
 
+		It("listener should keep the previous DB when a snapshot cannot be opened", func() {
+			apiManager := new(mockApiManager)
+			apiManager.On("InitAPI").Return()
+			dbManager := new(mockDbManager)
+			dbManager.On("setDbVersion", "badSnapshotId").Return(errors.New("unable to open"))
+			dbManager.On("getDbVersion").Return("").Once()
+			handler := apigeeSyncHandler{
+				dbMan:  dbManager,
+				apiMan: apiManager,
+				closed: false,
+			}
+
+			handler.Handle(&common.Snapshot{SnapshotInfo: "badSnapshotId"})
+			apiManager.AssertNotCalled(GinkgoT(), "InitAPI")
+
+			dbManager.On("getDbVersion").Return("previousSnapshotId")
+			handler.Handle(&common.Snapshot{SnapshotInfo: "badSnapshotId"})
+			apiManager.AssertNumberOfCalls(GinkgoT(), "InitAPI", 1)
+		})
+
 		It("listener should process a changelist", func() {
 			apiManager := new(mockApiManager)
 			apiManager.On("notifyChange", true)
@@ -43,6 +66,22 @@ var _ = Describe("Listener", func() {
 				{Table: TRACESIGNAL_PG_TABLENAME, Operation: common.Update}}})
 			apiManager.AssertNumberOfCalls(GinkgoT(), "notifyChange", 2)
 		})
+
+		It("listener should report deleted trace signals", func() {
+			apiManager := new(mockApiManager)
+			apiManager.On("notifyChange", true)
+			apiManager.On("sessionDeleted", "testID")
+			handler := apigeeSyncHandler{
+				dbMan:  nil,
+				apiMan: apiManager,
+				closed: false,
+			}
+			handler.Handle(&common.ChangeList{Changes: []common.Change{
+				{Table: TRACESIGNAL_PG_TABLENAME, Operation: common.Delete,
+					OldRow: common.Row{"id": &common.ColumnVal{Value: "testID"}}}}})
+			apiManager.AssertCalled(GinkgoT(), "sessionDeleted", "testID")
+			apiManager.AssertNumberOfCalls(GinkgoT(), "notifyChange", 1)
+		})
 	})
 
 })
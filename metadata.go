@@ -0,0 +1,107 @@
+package apidGatewayTrace
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	configBlobTags  = "apidgatewaytrace_blob_tags"
+	defaultBlobTags = "{session},{sessionId},proxy:{proxy},revision:{revision}"
+
+	UPLOAD_MP_HOST_HEADER          = "X-Apigee-MP-Host"
+	UPLOAD_TRANSACTION_TIME_HEADER = "X-Apigee-Transaction-Time"
+	UPLOAD_STATUS_CODE_HEADER      = "X-Apigee-Status-Code"
+)
+
+//createBlobMetadata builds the metadata for the blob holding a trace from its parsed debug session ID and the
+//optional transaction headers sent by the MP.  The MP format carries no separate customer, so the organization is
+//used for both.  Malformed optional headers are logged and left out rather than failing the upload
+func createBlobMetadata(id *debugSessionId, header http.Header) blobCreationMetadata {
+	metadata := blobCreationMetadata{
+		Customer:         id.Organization,
+		Organization:     id.Organization,
+		Environment:      id.Environment,
+		Proxy:            id.Proxy,
+		Revision:         id.Revision,
+		MessageProcessor: header.Get(UPLOAD_MP_HOST_HEADER),
+		ContentType:      header.Get("Content-Type"),
+	}
+
+	if value := header.Get(UPLOAD_TRANSACTION_TIME_HEADER); value != "" {
+		if t, err := parseTransactionTime(value); err == nil {
+			metadata.TransactionTime = t.UTC().Format(time.RFC3339Nano)
+		} else {
+			log.Debugf("ignoring bad %s header %s: %v", UPLOAD_TRANSACTION_TIME_HEADER, value, err)
+		}
+	}
+
+	if value := header.Get(UPLOAD_STATUS_CODE_HEADER); value != "" {
+		if code, err := strconv.Atoi(value); err == nil && code >= 100 && code <= 999 {
+			metadata.StatusCode = code
+		} else {
+			log.Debugf("ignoring bad %s header %s", UPLOAD_STATUS_CODE_HEADER, value)
+		}
+	}
+
+	metadata.Tags = blobTags(tagTemplates(), id, metadata)
+	return metadata
+}
+
+//parseTransactionTime accepts either an RFC 3339 timestamp or milliseconds since the epoch
+func parseTransactionTime(value string) (time.Time, error) {
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(0, millis*int64(time.Millisecond)), nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+//tagTemplates returns the configured tag scheme, a comma separated list of templates
+func tagTemplates() []string {
+	templates := config.GetString(configBlobTags)
+	if templates == "" {
+		templates = defaultBlobTags
+	}
+	return splitConfigList(templates)
+}
+
+//blobTags expands tag templates such as "proxy:{proxy}" for a blob.  A tag is left out if any placeholder it uses
+//has no value, so that optional metadata never produces tags like "mp:"
+func blobTags(templates []string, id *debugSessionId, metadata blobCreationMetadata) []string {
+	values := map[string]string{
+		"{organization}":     id.Organization,
+		"{environment}":      id.Environment,
+		"{proxy}":            id.Proxy,
+		"{revision}":         id.Revision,
+		"{session}":          id.Session,
+		"{sessionId}":        id.Raw,
+		"{messageProcessor}": metadata.MessageProcessor,
+		"{contentType}":      metadata.ContentType,
+		"{statusCode}":       "",
+	}
+	if metadata.StatusCode != 0 {
+		values["{statusCode}"] = strconv.Itoa(metadata.StatusCode)
+	}
+
+	pairs := make([]string, 0, 2*len(values))
+	for placeholder, value := range values {
+		pairs = append(pairs, placeholder, value)
+	}
+	replacer := strings.NewReplacer(pairs...)
+
+	tags := make([]string, 0, len(templates))
+	for _, template := range templates {
+		complete := true
+		for placeholder, value := range values {
+			if value == "" && strings.Contains(template, placeholder) {
+				complete = false
+			}
+		}
+		if complete {
+			tags = append(tags, replacer.Replace(template))
+		}
+	}
+	return tags
+}
@@ -0,0 +1,74 @@
+package apidGatewayTrace
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/mock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+var _ = Describe("Blob metadata", func() {
+
+	AfterEach(func() {
+		config.Set(configBlobTags, "")
+	})
+
+	It("should include transaction details sent by the MP", func() {
+		header := http.Header{}
+		header.Set(UPLOAD_MP_HOST_HEADER, "mp-1.example.com")
+		header.Set(UPLOAD_TRANSACTION_TIME_HEADER, "1500000000123")
+		header.Set(UPLOAD_STATUS_CODE_HEADER, "503")
+		header.Set("Content-Type", "application/xml")
+
+		metadata := createBlobMetadata(mustParseSessionId("org__env__proxy__rev__session"), header)
+		Expect(metadata.Proxy).To(Equal("proxy"))
+		Expect(metadata.Revision).To(Equal("rev"))
+		Expect(metadata.MessageProcessor).To(Equal("mp-1.example.com"))
+		Expect(metadata.TransactionTime).To(Equal("2017-07-14T02:40:00.123Z"))
+		Expect(metadata.StatusCode).To(Equal(503))
+		Expect(metadata.ContentType).To(Equal("application/xml"))
+	})
+
+	It("should ignore malformed optional headers", func() {
+		header := http.Header{}
+		header.Set(UPLOAD_TRANSACTION_TIME_HEADER, "yesterday")
+		header.Set(UPLOAD_STATUS_CODE_HEADER, "OK")
+
+		metadata := createBlobMetadata(mustParseSessionId("org__env__proxy__rev__session"), header)
+		Expect(metadata.TransactionTime).To(Equal(""))
+		Expect(metadata.StatusCode).To(Equal(0))
+
+		header.Set(UPLOAD_TRANSACTION_TIME_HEADER, "2017-07-14T04:40:00+02:00")
+		metadata = createBlobMetadata(mustParseSessionId("org__env__proxy__rev__session"), header)
+		Expect(metadata.TransactionTime).To(Equal("2017-07-14T02:40:00Z"))
+	})
+
+	It("should expand the configured tag scheme, skipping tags with missing values", func() {
+		config.Set(configBlobTags, "{sessionId}, {organization}/{environment}, mp:{messageProcessor}, status:{statusCode}")
+		header := http.Header{}
+		header.Set(UPLOAD_STATUS_CODE_HEADER, "200")
+
+		metadata := createBlobMetadata(mustParseSessionId("org__env__proxy__rev__session"), header)
+		Expect(metadata.Tags).To(Equal([]string{"org__env__proxy__rev__session", "org/env", "status:200"}))
+	})
+
+	It("should send the metadata when fetching the signed url", func() {
+		mockBsClient := mockBlobstoreClient{}
+		r := httptest.NewRequest("POST", "/uploadTrace", strings.NewReader("a trace"))
+		r.Header.Add(UPLOAD_TRACESESSION_HEADER, "org__env__app__rev__testID")
+		r.Header.Add(UPLOAD_MP_HOST_HEADER, "mp-1")
+		w := httptest.NewRecorder()
+		apiMan := apiManager{
+			bsClient: &mockBsClient,
+		}
+		mockBsClient.On("getSignedURL", mock.MatchedBy(func(metadata blobCreationMetadata) bool {
+			return metadata.Proxy == "app" && metadata.Revision == "rev" && metadata.MessageProcessor == "mp-1"
+		}), defaultBlobServerRoute()).Return(&blobServerResponse{Id: "testblob", SignedUrl: "testurl"}, nil)
+		mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Return(&http.Response{StatusCode: 200}, nil)
+
+		apiMan.apiUploadTraceDataEndpoint(w, r)
+		Expect(w.Code).To(Equal(200))
+	})
+})
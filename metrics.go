@@ -0,0 +1,62 @@
+package apidGatewayTrace
+
+import (
+	"sync"
+)
+
+const (
+	metricAuthRejectedUnauthenticated = "auth_rejected_unauthenticated"
+	metricAuthRejectedUnauthorized    = "auth_rejected_unauthorized"
+)
+
+//metricsRegistry is a goroutine safe set of named counters and gauges describing the plugin's activity
+type metricsRegistry struct {
+	mux    sync.Mutex
+	values map[string]int64
+}
+
+//metrics is the registry shared by all components of the plugin
+var metrics = newMetricsRegistry()
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		values: make(map[string]int64),
+	}
+}
+
+//inc increments a counter by one
+func (m *metricsRegistry) inc(name string) {
+	m.add(name, 1)
+}
+
+//add increments a counter by delta
+func (m *metricsRegistry) add(name string, delta int64) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.values[name] += delta
+}
+
+//set records the current value of a gauge
+func (m *metricsRegistry) set(name string, value int64) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.values[name] = value
+}
+
+//get returns the current value of a counter or gauge, zero if it was never recorded
+func (m *metricsRegistry) get(name string) int64 {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.values[name]
+}
+
+//snapshot returns a copy of every value currently recorded
+func (m *metricsRegistry) snapshot() map[string]int64 {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	values := make(map[string]int64, len(m.values))
+	for name, value := range m.values {
+		values[name] = value
+	}
+	return values
+}
@@ -0,0 +1,144 @@
+package apidGatewayTrace
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+const (
+	configMaxTraceSize  = "apidgatewaytrace_max_trace_size"
+	defaultMaxTraceSize = 10 * 1024 * 1024
+)
+
+//traceUpload carries a single trace, and the metadata describing it, through the upload path
+type traceUpload struct {
+	sessionId  *debugSessionId
+	metadata   blobCreationMetadata
+	summary    *traceSummary
+	validation *traceValidation
+	body       io.Reader
+	//stored names the destinations which stored the trace, or were handed a copy of it for async upload
+	stored []string
+}
+
+//uploadStage transforms a trace on its way to blobstore.  Stages run in order, each seeing the body and metadata
+//left by the previous one
+type uploadStage interface {
+	process(upload *traceUpload) error
+}
+
+//uploadError is returned by an uploadStage to reject a trace with a specific error code.  Any other
+//error from a stage is reported to the MP as an internal error.  cause, when set, holds details which are logged but
+//not sent to the MP
+type uploadError struct {
+	code   int
+	reason string
+	cause  error
+}
+
+func (e *uploadError) Error() string {
+	return e.reason
+}
+
+//newUploadStages creates the upload stages enabled in config, in the order they must run
+func newUploadStages() ([]uploadStage, error) {
+	stages := make([]uploadStage, 0)
+	//validation must come first, so that it sees the trace exactly as the MP sent it
+	validation, err := newValidationStage()
+	if err != nil {
+		return nil, err
+	}
+	if validation != nil {
+		stages = append(stages, validation)
+	}
+	redaction, err := newRedactionStage()
+	if err != nil {
+		return nil, err
+	}
+	if redaction != nil {
+		stages = append(stages, redaction)
+	}
+	//encryption must come last, as no later stage could read the trace
+	encryption, err := newEncryptionStage()
+	if err != nil {
+		return nil, err
+	}
+	if encryption != nil {
+		stages = append(stages, encryption)
+	}
+	return stages, nil
+}
+
+//runUploadStages applies each stage to the upload, writing an error to the client and returning false if any fails
+func runUploadStages(w http.ResponseWriter, r *http.Request, stages []uploadStage, upload *traceUpload) bool {
+	for _, stage := range stages {
+		if err := stage.process(upload); err != nil {
+			writeUploadError(w, r, upload, err)
+			return false
+		}
+	}
+	return true
+}
+
+//writeUploadError reports an error met while processing a trace, with the code of an uploadError
+func writeUploadError(w http.ResponseWriter, r *http.Request, upload *traceUpload, err error) {
+	if ue, ok := err.(*uploadError); ok {
+		writeError(w, r, ue.code, ue.reason)
+		return
+	}
+	log.Errorf("unable to process trace for %s: %v", upload.sessionId.Raw, err)
+	writeError(w, r, API_ERR_UPLOAD_STAGE, "unable to process trace")
+}
+
+//close releases what the stages hold for an upload once it is over, whether or not its body was read
+func (upload *traceUpload) close() {
+	if upload.validation != nil {
+		upload.validation.abort()
+	}
+}
+
+//storedAt tells whether a destination already has the trace
+func (upload *traceUpload) storedAt(name string) bool {
+	for _, stored := range upload.stored {
+		if stored == name {
+			return true
+		}
+	}
+	return false
+}
+
+//bufferBody reads the whole trace into memory for stages which cannot work on a stream, replacing the body with a
+//reader over the buffered bytes.  Traces larger than the configured maximum are rejected
+func (upload *traceUpload) bufferBody() ([]byte, error) {
+	maxSize := int64(defaultMaxTraceSize)
+	if config.IsSet(configMaxTraceSize) {
+		maxSize = int64(config.GetInt(configMaxTraceSize))
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(upload.body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxSize {
+		return nil, &uploadError{
+			code:   API_ERR_TRACE_TOO_LARGE,
+			reason: fmt.Sprintf("trace exceeds maximum size of %d bytes", maxSize),
+		}
+	}
+	upload.body = bytes.NewReader(data)
+	return data, nil
+}
+
+//countingReader counts the bytes read through it, giving the size of a trace as it is streamed to blobstore
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
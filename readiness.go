@@ -0,0 +1,93 @@
+package apidGatewayTrace
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	notReadyRetryAfter     = 5 * time.Second
+	metricNotReadyRejected = "not_ready_rejected"
+)
+
+//isReady reports whether the first snapshot was received
+func (a *apiManager) isReady() bool {
+	a.readyMux.Lock()
+	defer a.readyMux.Unlock()
+	return a.apiInitialized
+}
+
+//readyChannel returns a channel which is closed once the first snapshot was received
+func (a *apiManager) readyChannel() <-chan struct{} {
+	a.readyMux.Lock()
+	defer a.readyMux.Unlock()
+	if a.ready == nil {
+		a.ready = make(chan struct{})
+		if a.apiInitialized {
+			close(a.ready)
+		}
+	}
+	return a.ready
+}
+
+//whenReady answers that the plugin is not ready, instead of calling an endpoint which needs the trace signals, until
+//the first snapshot was received
+func (a *apiManager) whenReady(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.isReady() {
+			writeNotReady(w, r)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+//parkUntilReady holds long-polling requests which arrive before the first snapshot until it does, for no longer than
+//they asked to block.  The request is then handled with what is left of its block time
+func (a *apiManager) parkUntilReady(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ready := a.readyChannel()
+		select {
+		case <-ready:
+			handler(w, r)
+			return
+		default:
+		}
+
+		block, err := strconv.Atoi(r.URL.Query().Get("block"))
+		if err != nil || block <= 0 {
+			writeNotReady(w, r)
+			return
+		}
+		log.Debugf("parking request for up to %ds until the first snapshot arrives", block)
+		start := time.Now()
+		timer := time.NewTimer(time.Duration(block) * time.Second)
+		defer timer.Stop()
+		metrics.add(metricBlockedSubscribers, 1)
+		select {
+		case <-ready:
+			metrics.add(metricBlockedSubscribers, -1)
+			remaining := block - int(time.Since(start)/time.Second)
+			if remaining < 1 {
+				remaining = 1
+			}
+			query := r.URL.Query()
+			query.Set("block", strconv.Itoa(remaining))
+			r.URL.RawQuery = query.Encode()
+			handler(w, r)
+		case <-timer.C:
+			metrics.add(metricBlockedSubscribers, -1)
+			writeNotReady(w, r)
+		case <-r.Context().Done():
+			metrics.add(metricBlockedSubscribers, -1)
+		}
+	}
+}
+
+//writeNotReady tells the caller to come back once the plugin received its first snapshot
+func writeNotReady(w http.ResponseWriter, r *http.Request) {
+	metrics.inc(metricNotReadyRejected)
+	w.Header().Set("Retry-After", strconv.Itoa(int(notReadyRetryAfter/time.Second)))
+	writeError(w, r, API_ERR_NOT_READY, "trace plugin has not received its first snapshot yet")
+}
@@ -0,0 +1,84 @@
+package apidGatewayTrace
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("Readiness", func() {
+
+	var apiMan *apiManager
+	var handled chan string
+
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		handled <- r.URL.Query().Get("block")
+		w.WriteHeader(http.StatusOK)
+	}
+
+	expectNotReady := func(w *httptest.ResponseRecorder) {
+		Expect(w.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(w.Header().Get("Retry-After")).To(Equal("5"))
+		var errResp errorResponse
+		Expect(json.Unmarshal(w.Body.Bytes(), &errResp)).To(Succeed())
+		Expect(errResp.ErrorCode).To(Equal(API_ERR_NOT_READY))
+	}
+
+	BeforeEach(func() {
+		apiMan = &apiManager{}
+		//the endpoints are not registered, only the readiness of the apiManager is under test
+		apiMan.registerOnce.Do(func() {})
+		handled = make(chan string, 1)
+	})
+
+	It("should answer not ready until the first snapshot arrives", func() {
+		w := httptest.NewRecorder()
+		apiMan.whenReady(handler)(w, httptest.NewRequest("POST", uploadEndpoint, nil))
+		expectNotReady(w)
+		Expect(handled).ToNot(Receive())
+
+		apiMan.InitAPI()
+		w = httptest.NewRecorder()
+		apiMan.whenReady(handler)(w, httptest.NewRequest("POST", uploadEndpoint, nil))
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(handled).To(Receive())
+	})
+
+	It("should park long-polling requests until the first snapshot arrives", func() {
+		w := httptest.NewRecorder()
+		done := make(chan bool)
+		go func() {
+			apiMan.parkUntilReady(handler)(w, httptest.NewRequest("GET", signalEndpoint+"?block=3", nil))
+			close(done)
+		}()
+		Consistently(handled, 200*time.Millisecond).ShouldNot(Receive())
+		apiMan.InitAPI()
+		Eventually(done).Should(BeClosed())
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(handled).To(Receive(Equal("3")))
+	})
+
+	It("should answer not ready to requests which do not block long enough", func() {
+		w := httptest.NewRecorder()
+		apiMan.parkUntilReady(handler)(w, httptest.NewRequest("GET", signalEndpoint, nil))
+		expectNotReady(w)
+
+		w = httptest.NewRecorder()
+		apiMan.parkUntilReady(handler)(w, httptest.NewRequest("GET", signalEndpoint+"?block=1", nil))
+		expectNotReady(w)
+		Expect(handled).ToNot(Receive())
+	})
+
+	It("should send the trace signals when notified of a change", func() {
+		dbMan := &mockDbManager{}
+		dbMan.On("getTraceSignals").Return(getTraceSignalsResult{Signals: []traceSignal{{Id: "1", Uri: "uri1"}}}, nil)
+		apiMan.dbMan = dbMan
+		w := httptest.NewRecorder()
+		apiMan.sendTraceSignals(nil, true, w)
+		Expect(w.Code).To(Equal(http.StatusOK))
+		Expect(w.Body.String()).To(ContainSubstring(`"uri1"`))
+	})
+})
@@ -0,0 +1,428 @@
+package apidGatewayTrace
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	configRedactionRulesFile = "apidgatewaytrace_redaction_rules_file"
+	redactionMask            = "********"
+	pathWildcard             = "*"
+	pathRecursiveWildcard    = "**"
+)
+
+//redactionRules describes what to mask in a trace.  Headers and query params are matched by name wherever the trace
+//records a header or URI.  JSON paths ("$.user.password", "$..cvv", "$.cards[*].number") and simplified XPaths
+//("/Completed/Point/RequestMessage/Content", "//Password") apply to the trace document itself and to any JSON or XML
+//message bodies it contains.  Patterns are regular expressions masked in every remaining text value
+type redactionRules struct {
+	Headers     []string `json:"headers"`
+	QueryParams []string `json:"queryParams"`
+	JSONPaths   []string `json:"jsonPaths"`
+	XPaths      []string `json:"xpaths"`
+	Patterns    []string `json:"patterns"`
+
+	jsonPaths [][]string
+	xpaths    [][]string
+	patterns  []*regexp.Regexp
+}
+
+//redactionConfig is the content of the redaction rules file.  Rules for an org are applied in addition to the defaults
+type redactionConfig struct {
+	Default redactionRules            `json:"default"`
+	Orgs    map[string]redactionRules `json:"orgs"`
+}
+
+//redactionStage is the uploadStage masking sensitive data in traces before they leave the gateway
+type redactionStage struct {
+	config redactionConfig
+	rules  map[string]*redactionRules
+	base   *redactionRules
+}
+
+//newRedactionStage loads the redaction rules file, returning nil if none is configured
+func newRedactionStage() (*redactionStage, error) {
+	file := config.GetString(configRedactionRulesFile)
+	if file == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read redaction rules %s", file)
+	}
+	rc := redactionConfig{}
+	if err = json.Unmarshal(data, &rc); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse redaction rules %s", file)
+	}
+	return newRedactionStageFromConfig(rc)
+}
+
+//newRedactionStageFromConfig compiles a redactionConfig, merging each org's rules with the defaults
+func newRedactionStageFromConfig(rc redactionConfig) (*redactionStage, error) {
+	base := rc.Default
+	if err := base.compile(); err != nil {
+		return nil, errors.Wrap(err, "bad default redaction rules")
+	}
+	rs := &redactionStage{
+		config: rc,
+		rules:  make(map[string]*redactionRules),
+		base:   &base,
+	}
+	for org, orgRules := range rc.Orgs {
+		merged := redactionRules{
+			Headers:     append(append([]string{}, base.Headers...), orgRules.Headers...),
+			QueryParams: append(append([]string{}, base.QueryParams...), orgRules.QueryParams...),
+			JSONPaths:   append(append([]string{}, base.JSONPaths...), orgRules.JSONPaths...),
+			XPaths:      append(append([]string{}, base.XPaths...), orgRules.XPaths...),
+			Patterns:    append(append([]string{}, base.Patterns...), orgRules.Patterns...),
+		}
+		if err := merged.compile(); err != nil {
+			return nil, errors.Wrapf(err, "bad redaction rules for org %s", org)
+		}
+		rs.rules[org] = &merged
+	}
+	return rs, nil
+}
+
+//process redacts the trace body, recording the number of masked values in the blob metadata.  A trace which cannot
+//be parsed is rejected rather than uploaded with its secrets intact
+func (rs *redactionStage) process(upload *traceUpload) error {
+	rules := rs.base
+	if orgRules, ok := rs.rules[upload.sessionId.Organization]; ok {
+		rules = orgRules
+	}
+	if rules.empty() {
+		return nil
+	}
+
+	data, err := upload.bufferBody()
+	if err != nil {
+		return err
+	}
+	redacted, count, err := rules.redactDocument(data)
+	if err != nil {
+		log.Errorf("unable to redact trace for %s: %v", upload.sessionId.Raw, err)
+		return &uploadError{
+			code:   API_ERR_REDACTION,
+			reason: "unable to parse trace for redaction",
+		}
+	}
+	upload.body = bytes.NewReader(redacted)
+	upload.metadata.Redactions += count
+	return nil
+}
+
+//compile validates and pre-parses the paths and patterns of a rule set
+func (rr *redactionRules) compile() error {
+	rr.jsonPaths = nil
+	for _, path := range rr.JSONPaths {
+		parsed, err := parseJSONPath(path)
+		if err != nil {
+			return err
+		}
+		rr.jsonPaths = append(rr.jsonPaths, parsed)
+	}
+	rr.xpaths = nil
+	for _, path := range rr.XPaths {
+		parsed, err := parseXPath(path)
+		if err != nil {
+			return err
+		}
+		rr.xpaths = append(rr.xpaths, parsed)
+	}
+	rr.patterns = nil
+	for _, pattern := range rr.Patterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return errors.Wrapf(err, "bad redaction pattern %s", pattern)
+		}
+		rr.patterns = append(rr.patterns, compiled)
+	}
+	return nil
+}
+
+func (rr *redactionRules) empty() bool {
+	return len(rr.Headers) == 0 && len(rr.QueryParams) == 0 && len(rr.jsonPaths) == 0 &&
+		len(rr.xpaths) == 0 && len(rr.patterns) == 0
+}
+
+//redactDocument redacts a JSON or XML document, detected by its first non-blank character
+func (rr *redactionRules) redactDocument(data []byte) ([]byte, int, error) {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '['):
+		return rr.redactJSON(data)
+	case len(trimmed) > 0 && trimmed[0] == '<':
+		return rr.redactXML(data)
+	}
+	return nil, 0, errors.New("trace is neither JSON nor XML")
+}
+
+//redactBody redacts a message body embedded in a trace.  Bodies which are not JSON or XML only have patterns applied
+func (rr *redactionRules) redactBody(body string) (string, int) {
+	if redacted, count, err := rr.redactDocument([]byte(body)); err == nil {
+		return string(redacted), count
+	}
+	return rr.redactText(body)
+}
+
+//redactText masks every match of the configured patterns
+func (rr *redactionRules) redactText(text string) (string, int) {
+	count := 0
+	for _, pattern := range rr.patterns {
+		text = pattern.ReplaceAllStringFunc(text, func(string) string {
+			count++
+			return redactionMask
+		})
+	}
+	return text, count
+}
+
+//redactURI masks the values of configured query params, then applies patterns to the result
+func (rr *redactionRules) redactURI(uri string) (string, int) {
+	count := 0
+	if i := strings.Index(uri, "?"); i >= 0 && len(rr.QueryParams) > 0 {
+		params := strings.Split(uri[i+1:], "&")
+		for j, param := range params {
+			name := param
+			if k := strings.Index(param, "="); k >= 0 {
+				name = param[:k]
+			}
+			if unescaped, err := url.QueryUnescape(name); err == nil && rr.isQueryParam(unescaped) {
+				params[j] = name + "=" + redactionMask
+				count++
+			}
+		}
+		uri = uri[:i+1] + strings.Join(params, "&")
+	}
+	uri, patternCount := rr.redactText(uri)
+	return uri, count + patternCount
+}
+
+func (rr *redactionRules) isHeader(name string) bool {
+	return containsFold(rr.Headers, name)
+}
+
+func (rr *redactionRules) isQueryParam(name string) bool {
+	return containsFold(rr.QueryParams, name)
+}
+
+//redactJSON redacts a JSON document.  Objects holding "name" and "value" inside a "headers" list are treated as
+//headers, and "uri" or "uRI" strings as URIs, matching the MP's JSON trace format
+func (rr *redactionRules) redactJSON(data []byte) ([]byte, int, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, 0, errors.Wrap(err, "invalid JSON")
+	}
+	count := 0
+	doc = rr.redactJSONValue(doc, nil, &count)
+	redacted, err := json.Marshal(doc)
+	return redacted, count, err
+}
+
+func (rr *redactionRules) redactJSONValue(value interface{}, path []string, count *int) interface{} {
+	for _, pattern := range rr.jsonPaths {
+		if matchPath(pattern, path) {
+			*count++
+			return redactionMask
+		}
+	}
+
+	key := ""
+	if len(path) > 0 {
+		key = path[len(path)-1]
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if name, ok := v["name"].(string); ok && len(path) > 1 && strings.EqualFold(path[len(path)-2], "headers") {
+			if _, hasValue := v["value"]; hasValue && rr.isHeader(name) {
+				v["value"] = redactionMask
+				*count++
+			}
+		}
+		for k, child := range v {
+			v[k] = rr.redactJSONValue(child, append(path, k), count)
+		}
+		return v
+	case []interface{}:
+		for i, child := range v {
+			v[i] = rr.redactJSONValue(child, append(path, strconv.Itoa(i)), count)
+		}
+		return v
+	case string:
+		var redacted string
+		var n int
+		switch {
+		case strings.EqualFold(key, "uri"):
+			redacted, n = rr.redactURI(v)
+		case strings.EqualFold(key, "content"):
+			redacted, n = rr.redactBody(v)
+		default:
+			redacted, n = rr.redactText(v)
+		}
+		*count += n
+		return redacted
+	}
+	return value
+}
+
+//redactXML redacts an XML document by rewriting its token stream.  <Header name="..."> elements are treated as
+//headers, <URI> elements as URIs and <Content> elements as message bodies, matching the MP's XML trace format.
+//Comments are dropped, since they could hold anything
+func (rr *redactionRules) redactXML(data []byte) ([]byte, int, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	out := &bytes.Buffer{}
+	encoder := xml.NewEncoder(out)
+	count := 0
+	stack := make([]string, 0)
+	maskedDepth := -1
+	headerDepth := -1
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "invalid XML")
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			stack = append(stack, t.Name.Local)
+			if maskedDepth < 0 {
+				for _, pattern := range rr.xpaths {
+					if matchPath(pattern, stack) {
+						maskedDepth = len(stack)
+						count++
+						break
+					}
+				}
+			}
+			if t.Name.Local == "Header" && rr.isHeader(xmlAttr(t, "name")) {
+				headerDepth = len(stack)
+				count++
+			}
+		case xml.EndElement:
+			if len(stack) == maskedDepth {
+				maskedDepth = -1
+			}
+			if len(stack) == headerDepth {
+				headerDepth = -1
+			}
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			text := string(t)
+			n := 0
+			switch {
+			case maskedDepth >= 0 || headerDepth >= 0:
+				if strings.TrimSpace(text) != "" {
+					text = redactionMask
+				}
+			case len(stack) > 0 && strings.EqualFold(stack[len(stack)-1], "URI"):
+				text, n = rr.redactURI(text)
+			case len(stack) > 0 && stack[len(stack)-1] == "Content":
+				text, n = rr.redactBody(text)
+			default:
+				text, n = rr.redactText(text)
+			}
+			count += n
+			token = xml.CharData(text)
+		case xml.Comment:
+			continue
+		}
+
+		if err = encoder.EncodeToken(xml.CopyToken(token)); err != nil {
+			return nil, 0, errors.Wrap(err, "unable to encode redacted XML")
+		}
+	}
+	if err := encoder.Flush(); err != nil {
+		return nil, 0, err
+	}
+	return out.Bytes(), count, nil
+}
+
+func xmlAttr(element xml.StartElement, name string) string {
+	for _, attr := range element.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+	return ""
+}
+
+//parseJSONPath converts a JSON path such as "$.cards[*].number" or "$..password" into path segments
+func parseJSONPath(path string) ([]string, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("bad JSON path %s, must start with $", path)
+	}
+	path = strings.Replace(path[1:], "[", ".", -1)
+	path = strings.Replace(path, "]", "", -1)
+	path = strings.Replace(path, "..", "."+pathRecursiveWildcard+".", -1)
+	return splitPath(path, ".", path)
+}
+
+//parseXPath converts a simplified XPath, made only of element names, "*" and "//", into path segments
+func parseXPath(path string) ([]string, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("bad XPath %s, must start with /", path)
+	}
+	if strings.ContainsAny(path, "[]@()") {
+		return nil, fmt.Errorf("bad XPath %s, predicates and functions are not supported", path)
+	}
+	return splitPath(strings.Replace(path, "//", "/"+pathRecursiveWildcard+"/", -1), "/", path)
+}
+
+func splitPath(path, separator, original string) ([]string, error) {
+	segments := make([]string, 0)
+	for _, segment := range strings.Split(path, separator) {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	if len(segments) == 0 || segments[len(segments)-1] == pathRecursiveWildcard {
+		return nil, fmt.Errorf("bad path %s", original)
+	}
+	return segments, nil
+}
+
+//matchPath matches a path against a pattern whose segments may be "*", matching any one segment, or "**", matching
+//any number of segments
+func matchPath(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == pathRecursiveWildcard {
+		for i := 0; i <= len(path); i++ {
+			if matchPath(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 || (pattern[0] != pathWildcard && pattern[0] != path[0]) {
+		return false
+	}
+	return matchPath(pattern[1:], path[1:])
+}
+
+func containsFold(list []string, target string) bool {
+	for _, s := range list {
+		if strings.EqualFold(s, target) {
+			return true
+		}
+	}
+	return false
+}
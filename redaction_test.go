@@ -0,0 +1,185 @@
+package apidGatewayTrace
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+)
+
+const xmlTrace = `<Completed>
+	<Point id="StateChange">
+		<RequestMessage>
+			<Headers>
+				<Header name="Accept">*/*</Header>
+				<Header name="Authorization">Bearer abc123</Header>
+			</Headers>
+			<URI>/v1/orders?apikey=k3y&amp;page=2</URI>
+			<Verb>POST</Verb>
+			<Content>{"user":{"name":"jo","password":"hunter2"},"card":"4111 1111 1111 1111"}</Content>
+		</RequestMessage>
+	</Point>
+	<Point id="Execution">
+		<DebugInfo><Secret>s3cret</Secret></DebugInfo>
+	</Point>
+</Completed>`
+
+const jsonTrace = `{"point":[{"id":"StateChange","results":[{"ActionResult":"RequestMessage",
+	"headers":[{"name":"Accept","value":"*/*"},{"name":"authorization","value":"Bearer abc123"}],
+	"uRI":"/v1/orders?page=2&apikey=k3y","verb":"POST",
+	"content":"{\"user\":{\"password\":\"hunter2\"}}"}]}]}`
+
+var _ = Describe("Redaction", func() {
+
+	var rules redactionConfig
+
+	BeforeEach(func() {
+		rules = redactionConfig{
+			Default: redactionRules{
+				Headers:     []string{"authorization"},
+				QueryParams: []string{"apikey"},
+				JSONPaths:   []string{"$..password"},
+				XPaths:      []string{"//DebugInfo/Secret"},
+				Patterns:    []string{`\b(?:\d[ -]?){13,16}\b`},
+			},
+		}
+	})
+
+	It("should redact the XML trace format", func() {
+		rs, err := newRedactionStageFromConfig(rules)
+		Expect(err).To(Succeed())
+		redacted, count, err := rs.base.redactDocument([]byte(xmlTrace))
+		Expect(err).To(Succeed())
+		Expect(count).To(Equal(5))
+		out := string(redacted)
+		Expect(out).To(ContainSubstring(`<Header name="Accept">*/*</Header>`))
+		Expect(out).To(ContainSubstring(`<Header name="Authorization">********</Header>`))
+		Expect(out).To(ContainSubstring(`<URI>/v1/orders?apikey=********&amp;page=2</URI>`))
+		Expect(out).To(ContainSubstring(`<Secret>********</Secret>`))
+		Expect(out).ToNot(ContainSubstring("hunter2"))
+		Expect(out).ToNot(ContainSubstring("4111"))
+		Expect(out).To(ContainSubstring("jo"))
+	})
+
+	It("should redact the JSON trace format", func() {
+		rs, err := newRedactionStageFromConfig(rules)
+		Expect(err).To(Succeed())
+		redacted, count, err := rs.base.redactDocument([]byte(jsonTrace))
+		Expect(err).To(Succeed())
+		Expect(count).To(Equal(3))
+
+		var doc struct {
+			Point []struct {
+				Results []map[string]interface{} `json:"results"`
+			} `json:"point"`
+		}
+		Expect(json.Unmarshal(redacted, &doc)).To(Succeed())
+		result := doc.Point[0].Results[0]
+		Expect(result["headers"]).To(Equal([]interface{}{
+			map[string]interface{}{"name": "Accept", "value": "*/*"},
+			map[string]interface{}{"name": "authorization", "value": redactionMask},
+		}))
+		Expect(result["uRI"]).To(Equal("/v1/orders?page=2&apikey=" + redactionMask))
+		Expect(result["content"]).To(Equal(`{"user":{"password":"` + redactionMask + `"}}`))
+	})
+
+	It("should apply org rules in addition to the defaults", func() {
+		rules.Orgs = map[string]redactionRules{"acme": {Headers: []string{"Accept"}}}
+		rs, err := newRedactionStageFromConfig(rules)
+		Expect(err).To(Succeed())
+
+		upload := &traceUpload{sessionId: mustParseSessionId("acme__env__app__rev__id"), body: strings.NewReader(xmlTrace)}
+		Expect(rs.process(upload)).To(Succeed())
+		Expect(upload.metadata.Redactions).To(Equal(6))
+		out, _ := ioutil.ReadAll(upload.body)
+		Expect(string(out)).To(ContainSubstring(`<Header name="Accept">********</Header>`))
+
+		upload = &traceUpload{sessionId: mustParseSessionId("other__env__app__rev__id"), body: strings.NewReader(xmlTrace)}
+		Expect(rs.process(upload)).To(Succeed())
+		Expect(upload.metadata.Redactions).To(Equal(5))
+	})
+
+	It("should reject bad rules", func() {
+		for _, bad := range []redactionRules{
+			{JSONPaths: []string{"user.password"}},
+			{XPaths: []string{"//Header[@name='Authorization']"}},
+			{Patterns: []string{"("}},
+		} {
+			_, err := newRedactionStageFromConfig(redactionConfig{Default: bad})
+			Expect(err).ToNot(Succeed())
+		}
+	})
+
+	It("should load rules from the configured file", func() {
+		dir, err := ioutil.TempDir(testTempDirBase, "redaction")
+		Expect(err).To(Succeed())
+		file := filepath.Join(dir, "rules.json")
+		Expect(ioutil.WriteFile(file, []byte(`{"default":{"headers":["Authorization"]}}`), 0600)).To(Succeed())
+		config.Set(configRedactionRulesFile, file)
+		defer config.Set(configRedactionRulesFile, "")
+
+		stages, err := newUploadStages()
+		Expect(err).To(Succeed())
+		Expect(stages).To(HaveLen(1))
+		Expect(stages[0].(*redactionStage).base.Headers).To(Equal([]string{"Authorization"}))
+	})
+
+	Context("upload path", func() {
+		It("should upload the redacted trace and report the count in the metadata", func() {
+			rs, err := newRedactionStageFromConfig(rules)
+			Expect(err).To(Succeed())
+			mockBsClient := mockBlobstoreClient{}
+			apiMan := apiManager{
+				bsClient: &mockBsClient,
+				stages:   []uploadStage{rs},
+			}
+			var uploaded string
+			mockBsClient.On("getSignedURL", mock.MatchedBy(func(metadata blobCreationMetadata) bool {
+				return metadata.Redactions == 5
+			}), defaultBlobServerRoute()).Return(&blobServerResponse{Id: "testblob", SignedUrl: "testurl"}, nil)
+			mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Run(func(args mock.Arguments) {
+				b, _ := ioutil.ReadAll(args.Get(1).(io.Reader))
+				uploaded = string(b)
+			}).Return(&http.Response{StatusCode: 200}, nil)
+
+			r := httptest.NewRequest("POST", "/uploadtrace", strings.NewReader(xmlTrace))
+			r.Header.Add(UPLOAD_TRACESESSION_HEADER, "org__env__app__rev__testID")
+			w := httptest.NewRecorder()
+			apiMan.apiUploadTraceDataEndpoint(w, r)
+			Expect(w.Code).To(Equal(200))
+			Expect(uploaded).ToNot(ContainSubstring("abc123"))
+		})
+
+		It("should reject traces which cannot be parsed", func() {
+			rs, err := newRedactionStageFromConfig(rules)
+			Expect(err).To(Succeed())
+			apiMan := apiManager{stages: []uploadStage{rs}}
+
+			r := httptest.NewRequest("POST", "/uploadtrace", strings.NewReader("<Completed><Point>"))
+			r.Header.Add(UPLOAD_TRACESESSION_HEADER, "org__env__app__rev__testID")
+			w := httptest.NewRecorder()
+			apiMan.apiUploadTraceDataEndpoint(w, r)
+			Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+		})
+
+		It("should reject traces larger than the maximum size", func() {
+			rs, err := newRedactionStageFromConfig(rules)
+			Expect(err).To(Succeed())
+			apiMan := apiManager{stages: []uploadStage{rs}}
+			config.Set(configMaxTraceSize, 16)
+			defer config.Set(configMaxTraceSize, defaultMaxTraceSize)
+
+			r := httptest.NewRequest("POST", "/uploadtrace", strings.NewReader(xmlTrace))
+			r.Header.Add(UPLOAD_TRACESESSION_HEADER, "org__env__app__rev__testID")
+			w := httptest.NewRecorder()
+			apiMan.apiUploadTraceDataEndpoint(w, r)
+			Expect(w.Code).To(Equal(http.StatusRequestEntityTooLarge))
+		})
+	})
+})
@@ -0,0 +1,93 @@
+package apidGatewayTrace
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+//apiRoute is a path and method the plugin serves on the apid router
+type apiRoute struct {
+	method  string
+	path    string
+	handler http.HandlerFunc
+}
+
+//routes lists every route of the apiManager.  Endpoints left empty are not served, and the prefix applies to every
+//endpoint but the aliases of the signal and upload endpoints
+func (a *apiManager) routes() []apiRoute {
+	signal := a.authenticated(a.parkUntilReady(a.apiGetTraceSignalEndpoint))
+	upload := a.authenticated(a.whenReady(a.apiUploadTraceDataEndpoint))
+	routes := make([]apiRoute, 0)
+	add := func(method, endpoint string, handler http.HandlerFunc) {
+		if endpoint != "" {
+			routes = append(routes, apiRoute{method: method, path: a.endpointPrefix + endpoint, handler: handler})
+		}
+	}
+
+	add("GET", a.signalEndpoint, signal)
+	add("POST", a.uploadEndpoint, upload)
+	for _, version := range apiVersions {
+		if a.signalEndpoint != "" {
+			add("GET", versionedPath(version, a.signalEndpoint), versioned(version, signal))
+		}
+		if a.uploadEndpoint != "" {
+			add("POST", versionedPath(version, a.uploadEndpoint), versioned(version, upload))
+		}
+	}
+	for _, alias := range a.signalAliases {
+		routes = append(routes, apiRoute{method: "GET", path: alias, handler: signal})
+	}
+	for _, alias := range a.uploadAliases {
+		routes = append(routes, apiRoute{method: "POST", path: alias, handler: upload})
+	}
+
+	add("GET", a.transactionsEndpoint, a.authenticated(a.apiGetTraceTransactionsEndpoint))
+	add("GET", a.sessionEndpoint, a.authenticated(a.whenReady(a.apiGetTraceSessionEndpoint)))
+	if a.deadLettersEndpoint != "" {
+		deadLetters := a.administered(a.apiReplayDeadLettersEndpoint)
+		add("GET", a.deadLettersEndpoint, a.administered(a.apiGetDeadLettersEndpoint))
+		add("POST", a.deadLettersEndpoint+"/replay", deadLetters)
+		add("POST", a.deadLettersEndpoint+"/{id}/replay", deadLetters)
+	}
+	add("POST", a.reloadEndpoint, a.administered(a.apiReloadConfigEndpoint))
+	add("GET", a.debugEndpoint, a.administered(a.apiGetDiagnosticsEndpoint))
+	if a.healthEndpoint != "" {
+		add("GET", a.healthEndpoint, a.apiGetHealthEndpoint)
+		add("GET", a.healthEndpoint+livenessSuffix, a.apiGetLivenessEndpoint)
+	}
+	return routes
+}
+
+//checkRoutes finds routes of the same method which could both match a request.  The apid router would send such
+//requests to whichever was registered first, silently hiding the other.  Only the plugin's own routes are compared:
+//the paths other apid plugins register are not known here, so a conflict with one of them goes unnoticed
+func checkRoutes(routes []apiRoute) error {
+	for i, route := range routes {
+		for _, other := range routes[:i] {
+			if route.method == other.method && pathsOverlap(route.path, other.path) {
+				return fmt.Errorf("%s %s conflicts with trace plugin route %s %s", route.method, route.path, other.method, other.path)
+			}
+		}
+	}
+	return nil
+}
+
+//pathsOverlap tells whether a request path could match both path templates, a {variable} matching any segment
+func pathsOverlap(path, other string) bool {
+	segments, otherSegments := strings.Split(path, "/"), strings.Split(other, "/")
+	if len(segments) != len(otherSegments) {
+		return false
+	}
+	for i, segment := range segments {
+		if segment != otherSegments[i] && !isPathVariable(segment) && !isPathVariable(otherSegments[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+//isPathVariable tells whether a segment of a path template is a variable
+func isPathVariable(segment string) bool {
+	return strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}")
+}
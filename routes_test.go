@@ -0,0 +1,100 @@
+package apidGatewayTrace
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("API routes", func() {
+
+	paths := func(routes []apiRoute) []string {
+		list := make([]string, len(routes))
+		for i, route := range routes {
+			list[i] = route.method + " " + route.path
+		}
+		return list
+	}
+
+	It("should prefix every endpoint but the aliases", func() {
+		apiMan := &apiManager{
+			endpointPrefix:       "/trace",
+			signalEndpoint:       signalEndpoint,
+			uploadEndpoint:       uploadEndpoint,
+			transactionsEndpoint: transactionsEndpoint,
+			sessionEndpoint:      sessionEndpoint,
+			healthEndpoint:       healthEndpoint,
+			signalAliases:        []string{"/tracesignals"},
+			uploadAliases:        []string{"/uploadtrace"},
+		}
+		Expect(paths(apiMan.routes())).To(Equal([]string{
+			"GET /trace/tracesignals",
+			"POST /trace/uploadtrace",
+			"GET /trace/v1/tracesignals",
+			"POST /trace/v1/uploadtrace",
+			"GET /trace/v2/tracesignals",
+			"POST /trace/v2/uploadtrace",
+			"GET /tracesignals",
+			"POST /uploadtrace",
+			"GET /trace/tracesessions/{id}/transactions",
+			"GET /trace/tracesessions/{id}",
+			"GET /trace/tracehealth",
+			"GET /trace/tracehealth/live",
+		}))
+		Expect(checkRoutes(apiMan.routes())).To(Succeed())
+	})
+
+	It("should detect routes which match the same requests", func() {
+		Expect(pathsOverlap("/tracesessions/{id}", "/tracesessions/legacy")).To(BeTrue())
+		Expect(pathsOverlap("/tracesessions/{id}", "/tracesessions/{id}/transactions")).To(BeFalse())
+		Expect(pathsOverlap("/tracedeadletters/replay", "/tracedeadletters/{id}/replay")).To(BeFalse())
+		Expect(pathsOverlap("/tracesignals", "/tracesignals/debug")).To(BeFalse())
+
+		apiMan := &apiManager{
+			signalEndpoint:  signalEndpoint,
+			uploadEndpoint:  uploadEndpoint,
+			sessionEndpoint: sessionEndpoint,
+			signalAliases:   []string{"/v1/tracesignals"},
+		}
+		Expect(checkRoutes(apiMan.routes()).Error()).To(Equal("GET /v1/tracesignals conflicts with trace plugin route GET /v1/tracesignals"))
+
+		apiMan.signalAliases = []string{"/tracesessions/legacy"}
+		Expect(checkRoutes(apiMan.routes()).Error()).To(Equal("GET /tracesessions/{id} conflicts with trace plugin route GET /tracesessions/legacy"))
+
+		//the same path with another method is a different route
+		apiMan.signalAliases = []string{uploadEndpoint}
+		Expect(checkRoutes(apiMan.routes())).To(Succeed())
+	})
+
+	It("should register no endpoint when two of them conflict", func() {
+		apiMan := &apiManager{
+			endpointPrefix: "/conflicting",
+			signalEndpoint: signalEndpoint,
+			uploadAliases:  []string{"/conflicting" + uploadEndpoint},
+			uploadEndpoint: uploadEndpoint,
+		}
+		Expect(apiMan.registerAPI()).ToNot(Succeed())
+		Expect(apiMan.registerAPI()).ToNot(Succeed())
+
+		w := httptest.NewRecorder()
+		services.API().Router().ServeHTTP(w, httptest.NewRequest("GET", "/conflicting"+signalEndpoint, nil))
+		Expect(w.Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("should serve the endpoints under the prefix and on their aliases", func() {
+		apiMan := &apiManager{
+			endpointPrefix: "/prefixed",
+			signalEndpoint: signalEndpoint,
+			signalAliases:  []string{"/prefixed-legacy" + signalEndpoint},
+			newSignal:      make(chan interface{}),
+			addSubscriber:  make(chan chan interface{}),
+		}
+		Expect(apiMan.registerAPI()).To(Succeed())
+		for _, path := range []string{"/prefixed" + signalEndpoint, "/prefixed/v2" + signalEndpoint, "/prefixed-legacy" + signalEndpoint} {
+			w := httptest.NewRecorder()
+			services.API().Router().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+			Expect(w.Code).To(Equal(http.StatusServiceUnavailable), path)
+		}
+	})
+})
@@ -0,0 +1,153 @@
+package apidGatewayTrace
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	configBlobServerRoutesFile = "apidgatewaytrace_blobserver_routes_file"
+)
+
+//blobServerRoute sends the traces of the orgs and environments matching its patterns, any part of which may be "*",
+//to a blob server.  Routes without a bearer token use the global apigeesync_bearer_token
+type blobServerRoute struct {
+	Organization    string `json:"organization"`
+	Environment     string `json:"environment"`
+	BaseURI         string `json:"baseUri"`
+	BearerToken     string `json:"bearerToken,omitempty"`
+	BearerTokenFile string `json:"bearerTokenFile,omitempty"`
+}
+
+//blobServerRoutesConfig is the format of the routes file.  Routes are tried in order, and the default route, when
+//present, replaces the blob server configured in apigeesync_blob_server_base for traces matching none of them
+type blobServerRoutesConfig struct {
+	Routes  []blobServerRoute `json:"routes"`
+	Default *blobServerRoute  `json:"default"`
+}
+
+//blobServerRouter picks the blob server a trace is uploaded to from the org/env of its debug session
+type blobServerRouter struct {
+	routes       []blobServerRoute
+	defaultRoute *blobServerRoute
+}
+
+//newBlobServerRouter loads the routing table from the configured file, returning nil if none was configured, in
+//which case every trace goes to the default blob server
+func newBlobServerRouter() (*blobServerRouter, error) {
+	file := config.GetString(configBlobServerRoutesFile)
+	if file == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read blob server routes %s", file)
+	}
+	var routesConfig blobServerRoutesConfig
+	if err = json.Unmarshal(data, &routesConfig); err != nil {
+		return nil, errors.Wrapf(err, "invalid blob server routes %s", file)
+	}
+	return newBlobServerRouterFromConfig(routesConfig)
+}
+
+//newBlobServerRouterFromConfig checks every route and loads the bearer tokens kept in files
+func newBlobServerRouterFromConfig(routesConfig blobServerRoutesConfig) (*blobServerRouter, error) {
+	router := &blobServerRouter{routes: make([]blobServerRoute, 0, len(routesConfig.Routes))}
+	for i, route := range routesConfig.Routes {
+		if route.Organization == "" || route.Environment == "" {
+			return nil, fmt.Errorf("blob server route %d must have an organization and an environment", i)
+		}
+		route, err := loadBlobServerRoute(route)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid blob server route %d", i)
+		}
+		router.routes = append(router.routes, route)
+	}
+	if routesConfig.Default != nil {
+		route, err := loadBlobServerRoute(*routesConfig.Default)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid default blob server route")
+		}
+		router.defaultRoute = &route
+	}
+	return router, nil
+}
+
+//routesConfig returns the routing table of the router, with the bearer tokens loaded from files
+func (router *blobServerRouter) routesConfig() *blobServerRoutesConfig {
+	if router == nil {
+		return nil
+	}
+	rc := &blobServerRoutesConfig{Routes: append([]blobServerRoute{}, router.routes...)}
+	if router.defaultRoute != nil {
+		defaultRoute := *router.defaultRoute
+		rc.Default = &defaultRoute
+	}
+	return rc
+}
+
+func loadBlobServerRoute(route blobServerRoute) (blobServerRoute, error) {
+	if route.BaseURI == "" {
+		return route, errors.New("baseUri is required")
+	}
+	if route.BearerTokenFile != "" {
+		if route.BearerToken != "" {
+			return route, errors.New("bearerToken and bearerTokenFile are mutually exclusive")
+		}
+		token, err := ioutil.ReadFile(route.BearerTokenFile)
+		if err != nil {
+			return route, errors.Wrapf(err, "unable to read bearer token %s", route.BearerTokenFile)
+		}
+		route.BearerToken = strings.TrimSpace(string(token))
+	}
+	return route, nil
+}
+
+//route returns the first route matching org and env, falling back to the default route.  A nil router always
+//returns the default blob server
+func (br *blobServerRouter) route(org, env string) blobServerRoute {
+	if br == nil {
+		return defaultBlobServerRoute()
+	}
+	for _, route := range br.routes {
+		if scopeMatches(route.Organization, org) && scopeMatches(route.Environment, env) {
+			return route
+		}
+	}
+	if br.defaultRoute != nil {
+		return *br.defaultRoute
+	}
+	return defaultBlobServerRoute()
+}
+
+//blobServers returns every route uploads may be sent to, the fallback route last
+func (br *blobServerRouter) blobServers() []blobServerRoute {
+	if br == nil {
+		return []blobServerRoute{defaultBlobServerRoute()}
+	}
+	fallback := defaultBlobServerRoute()
+	if br.defaultRoute != nil {
+		fallback = *br.defaultRoute
+	}
+	return append(append([]blobServerRoute(nil), br.routes...), fallback)
+}
+
+//defaultBlobServerRoute is the blob server configured through apidApigeeSync's settings
+func defaultBlobServerRoute() blobServerRoute {
+	return blobServerRoute{
+		Organization: "*",
+		Environment:  "*",
+		BaseURI:      config.GetString(configBlobServerBaseURI),
+	}
+}
+
+//authorization returns the Authorization header value for requests to the route's blob server
+func (route blobServerRoute) authorization() string {
+	if route.BearerToken != "" {
+		return "Bearer " + route.BearerToken
+	}
+	return getBearerToken()
+}
@@ -0,0 +1,115 @@
+package apidGatewayTrace
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/mock"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+)
+
+var _ = Describe("Blob server routing", func() {
+
+	var routesConfig blobServerRoutesConfig
+
+	BeforeEach(func() {
+		routesConfig = blobServerRoutesConfig{
+			Routes: []blobServerRoute{
+				{Organization: "acme", Environment: "prod", BaseURI: "https://prod.blobs.acme", BearerToken: "prod-token"},
+				{Organization: "acme", Environment: "*", BaseURI: "https://blobs.acme"},
+			},
+		}
+	})
+
+	It("should pick the first matching route", func() {
+		router, err := newBlobServerRouterFromConfig(routesConfig)
+		Expect(err).To(Succeed())
+		Expect(router.route("acme", "prod").BaseURI).To(Equal("https://prod.blobs.acme"))
+		Expect(router.route("acme", "test").BaseURI).To(Equal("https://blobs.acme"))
+		Expect(router.route("other", "prod")).To(Equal(defaultBlobServerRoute()))
+	})
+
+	It("should fall back to the configured default route", func() {
+		routesConfig.Default = &blobServerRoute{BaseURI: "https://blobs.example.com"}
+		router, err := newBlobServerRouterFromConfig(routesConfig)
+		Expect(err).To(Succeed())
+		Expect(router.route("other", "prod").BaseURI).To(Equal("https://blobs.example.com"))
+
+		var nilRouter *blobServerRouter
+		Expect(nilRouter.route("acme", "prod")).To(Equal(defaultBlobServerRoute()))
+	})
+
+	It("should use the global bearer token for routes without one", func() {
+		config.Set(configBearerToken, "global-token")
+		router, err := newBlobServerRouterFromConfig(routesConfig)
+		Expect(err).To(Succeed())
+		Expect(router.route("acme", "prod").authorization()).To(Equal("Bearer prod-token"))
+		Expect(router.route("acme", "test").authorization()).To(Equal("Bearer global-token"))
+	})
+
+	It("should load routes and bearer tokens from files", func() {
+		dir, err := ioutil.TempDir(testTempDirBase, "routes")
+		Expect(err).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(dir, "token"), []byte("file-token\n"), 0600)).To(Succeed())
+		routesConfig.Routes[1].BearerTokenFile = filepath.Join(dir, "token")
+		data, _ := json.Marshal(routesConfig)
+		Expect(ioutil.WriteFile(filepath.Join(dir, "routes.json"), data, 0600)).To(Succeed())
+		config.Set(configBlobServerRoutesFile, filepath.Join(dir, "routes.json"))
+		defer config.Set(configBlobServerRoutesFile, "")
+
+		router, err := newBlobServerRouter()
+		Expect(err).To(Succeed())
+		Expect(router.route("acme", "test").authorization()).To(Equal("Bearer file-token"))
+	})
+
+	It("should reject incomplete routes", func() {
+		for _, bad := range []blobServerRoute{
+			{Organization: "acme", BaseURI: "https://blobs.acme"},
+			{Organization: "acme", Environment: "*"},
+			{Organization: "acme", Environment: "*", BaseURI: "https://blobs.acme", BearerToken: "t", BearerTokenFile: "f"},
+			{Organization: "acme", Environment: "*", BaseURI: "https://blobs.acme", BearerTokenFile: "missing"},
+		} {
+			_, err := newBlobServerRouterFromConfig(blobServerRoutesConfig{Routes: []blobServerRoute{bad}})
+			Expect(err).ToNot(Succeed())
+		}
+		_, err := newBlobServerRouterFromConfig(blobServerRoutesConfig{Default: &blobServerRoute{}})
+		Expect(err).ToNot(Succeed())
+	})
+
+	It("should send the route's credentials to its blob server", func() {
+		var authorization string
+		blobServer := httptest.NewServer(getHandler(func(w http.ResponseWriter, r *http.Request) {
+			authorization = r.Header.Get("Authorization")
+			w.Write([]byte(`{"id":"blob","signedurl":"signed"}`))
+		}))
+		defer blobServer.Close()
+
+		bsClient := &blobstoreClient{httpClient: &http.Client{}}
+		blob, err := bsClient.getSignedURL(blobCreationMetadata{}, blobServerRoute{BaseURI: blobServer.URL, BearerToken: "route-token"})
+		Expect(err).To(Succeed())
+		Expect(blob.SignedUrl).To(Equal("signed"))
+		Expect(authorization).To(Equal("Bearer route-token"))
+	})
+
+	It("should route uploads by the org and env of the debug session", func() {
+		router, err := newBlobServerRouterFromConfig(routesConfig)
+		Expect(err).To(Succeed())
+		mockBsClient := mockBlobstoreClient{}
+		apiMan := apiManager{bsClient: &mockBsClient, router: router}
+		mockBsClient.On("getSignedURL", mock.AnythingOfType("blobCreationMetadata"), mock.MatchedBy(func(route blobServerRoute) bool {
+			return route.BaseURI == "https://prod.blobs.acme"
+		})).Return(&blobServerResponse{Id: "testblob", SignedUrl: "testurl"}, nil)
+		mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Return(&http.Response{StatusCode: 200}, nil)
+
+		r := httptest.NewRequest("POST", "/uploadtrace", strings.NewReader("a trace"))
+		r.Header.Add(UPLOAD_TRACESESSION_HEADER, "acme__prod__app__rev__id")
+		w := httptest.NewRecorder()
+		apiMan.apiUploadTraceDataEndpoint(w, r)
+		Expect(w.Code).To(Equal(200))
+		mockBsClient.AssertExpectations(GinkgoT())
+	})
+})
@@ -0,0 +1,259 @@
+package apidGatewayTrace
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const fileSignalsSchema = "schema/tracesignals.json"
+
+//legacySignalsResponse is a response of /tracesignals as sent before its schema was defined, which MPs in the field
+//know how to parse
+const legacySignalsResponse = `{"signals":[{"id":"0","uri":"uri0"},{"id":"1","uri":"uri1"},{"id":"2","uri":"uri2"},` +
+	`{"id":"3","uri":"uri3"},{"id":"4","uri":"uri4"}],"error":null}`
+
+//mpTraceSignals holds what the MP client reads from a /tracesignals response
+type mpTraceSignals struct {
+	Signals []struct {
+		Id  string `json:"id"`
+		Uri string `json:"uri"`
+	} `json:"signals"`
+	Error interface{} `json:"error"`
+}
+
+//readSchema reads a JSON document of the repository
+func readSchema(file string) map[string]interface{} {
+	data, err := ioutil.ReadFile(file)
+	Expect(err).To(Succeed())
+	var schema map[string]interface{}
+	Expect(json.Unmarshal(data, &schema)).To(Succeed())
+	return schema
+}
+
+//resolveRef follows the $ref of a node, either to a fragment of root or to another document of the schema directory.
+//It returns the document holding the node referenced along with that node, which is nil if it does not exist
+func resolveRef(root, node map[string]interface{}) (map[string]interface{}, map[string]interface{}) {
+	for {
+		ref, ok := node["$ref"].(string)
+		if !ok {
+			return root, node
+		}
+		parts := strings.SplitN(ref, "#", 2)
+		if parts[0] != "" {
+			root = readSchema(filepath.Join(filepath.Dir(fileSignalsSchema), parts[0]))
+		}
+		var target interface{} = root
+		if len(parts) == 2 && parts[1] != "" {
+			for _, token := range strings.Split(strings.TrimPrefix(parts[1], "/"), "/") {
+				token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+				switch t := target.(type) {
+				case map[string]interface{}:
+					target = t[token]
+				case []interface{}:
+					i, err := strconv.Atoi(token)
+					if err != nil || i >= len(t) {
+						return root, nil
+					}
+					target = t[i]
+				default:
+					return root, nil
+				}
+			}
+		}
+		if node, ok = target.(map[string]interface{}); !ok {
+			return root, nil
+		}
+	}
+}
+
+//validateSchema validates a decoded JSON value against the subset of JSON Schema used by the documents of the
+//schema directory.  References are resolved in root
+func validateSchema(root, schema map[string]interface{}, value interface{}, path string) []string {
+	if _, ok := schema["$ref"]; ok {
+		root, schema = resolveRef(root, schema)
+		if schema == nil {
+			return []string{fmt.Sprintf("%s: unresolved reference", path)}
+		}
+		return validateSchema(root, schema, value, path)
+	}
+	for _, keyword := range []string{"oneOf", "anyOf"} {
+		options, ok := schema[keyword].([]interface{})
+		if !ok {
+			continue
+		}
+		matched := 0
+		for _, option := range options {
+			if len(validateSchema(root, option.(map[string]interface{}), value, path)) == 0 {
+				matched++
+			}
+		}
+		if matched == 0 || (keyword == "oneOf" && matched > 1) {
+			return []string{fmt.Sprintf("%s: %v matches %d schemas of %s", path, value, matched, keyword)}
+		}
+		return nil
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			found = found || reflect.DeepEqual(allowed, value)
+		}
+		if !found {
+			return []string{fmt.Sprintf("%s: %v is not one of %v", path, value, enum)}
+		}
+	}
+
+	var errs []string
+	switch schema["type"] {
+	case "null":
+		if value != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v is not null", path, value))
+		}
+	case "string":
+		s, ok := value.(string)
+		if !ok {
+			return []string{fmt.Sprintf("%s: %v is not a string", path, value)}
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %s is not a date-time", path, s))
+			}
+		}
+	case "integer", "number":
+		n, ok := value.(float64)
+		if !ok || (schema["type"] == "integer" && n != float64(int64(n))) {
+			return []string{fmt.Sprintf("%s: %v is not an %s", path, value, schema["type"])}
+		}
+		if minimum, ok := schema["minimum"].(float64); ok && n < minimum {
+			errs = append(errs, fmt.Sprintf("%s: %v is less than %v", path, n, minimum))
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			errs = append(errs, fmt.Sprintf("%s: %v is not a boolean", path, value))
+		}
+	case "array":
+		items, ok := value.([]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: %v is not an array", path, value)}
+		}
+		if itemSchema, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range items {
+				errs = append(errs, validateSchema(root, itemSchema, item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{fmt.Sprintf("%s: %v is not an object", path, value)}
+		}
+		for _, name := range toStrings(schema["required"]) {
+			if _, ok := object[name]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: missing %s", path, name))
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name, property := range object {
+			if propertySchema, ok := properties[name].(map[string]interface{}); ok {
+				errs = append(errs, validateSchema(root, propertySchema, property, path+"."+name)...)
+			} else if additional, ok := schema["additionalProperties"].(map[string]interface{}); ok {
+				errs = append(errs, validateSchema(root, additional, property, path+"."+name)...)
+			} else if schema["additionalProperties"] == false {
+				errs = append(errs, fmt.Sprintf("%s: unexpected property %s", path, name))
+			}
+		}
+	}
+	return errs
+}
+
+//toStrings converts a decoded JSON array of strings
+func toStrings(value interface{}) []string {
+	values, _ := value.([]interface{})
+	strs := make([]string, len(values))
+	for i, v := range values {
+		strs[i] = v.(string)
+	}
+	return strs
+}
+
+var _ = Describe("Tracesignals schema", func() {
+
+	var dbMan *dbManager
+	var schema map[string]interface{}
+
+	BeforeEach(func() {
+		dir, err := ioutil.TempDir(testTempDirBase, "sqlite3")
+		Expect(err).To(Succeed())
+		services.Config().Set("local_storage_path", dir)
+		dbMan = &dbManager{data: services.Data(), dbMux: sync.RWMutex{}}
+		Expect(dbMan.setDbVersion(dir)).To(Succeed())
+		setupTestDb(dbMan.getDb())
+		schema = readSchema(fileSignalsSchema)
+	})
+
+	getSignals := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", signalEndpoint, nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		(&apiManager{dbMan: dbMan}).apiGetTraceSignalEndpoint(w, r)
+		return w
+	}
+
+	validate := func(body []byte) {
+		var value interface{}
+		Expect(json.Unmarshal(body, &value)).To(Succeed())
+		Expect(validateSchema(schema, schema, value, "$")).To(BeEmpty())
+	}
+
+	It("should send signals matching the schema", func() {
+		w := getSignals("")
+		Expect(w.Code).To(Equal(200))
+		validate(w.Body.Bytes())
+		Expect(w.Header().Get("ETag")).To(Equal(`"0,1,2,3,4"`))
+
+		_, err := dbMan.getDb().Exec("INSERT INTO metadata_trace (id, uri) VALUES ('5', NULL);")
+		Expect(err).To(Succeed())
+		w = getSignals("")
+		validate(w.Body.Bytes())
+		var result getTraceSignalsResult
+		Expect(json.Unmarshal(w.Body.Bytes(), &result)).To(Succeed())
+		Expect(result.Error.Skipped).To(Equal(1))
+	})
+
+	It("should reject documents which do not match the schema", func() {
+		for _, doc := range []string{
+			`{"signals":[{"id":"0"}],"version":"0","generatedAt":"2026-10-19T10:00:00Z","error":null}`,
+			`{"signals":[],"version":"","generatedAt":"yesterday","error":null}`,
+			`{"signals":[],"version":"","generatedAt":"2026-10-19T10:00:00Z","error":{"code":"other","message":"","skipped":1}}`,
+			`{"signals":[],"version":"","generatedAt":"2026-10-19T10:00:00Z"}`,
+		} {
+			var value interface{}
+			Expect(json.Unmarshal([]byte(doc), &value)).To(Succeed())
+			Expect(validateSchema(schema, schema, value, "$")).ToNot(BeEmpty(), doc)
+		}
+	})
+
+	It("should stay compatible with the MP client", func() {
+		w := getSignals("")
+		var current, legacy mpTraceSignals
+		Expect(json.Unmarshal(w.Body.Bytes(), &current)).To(Succeed())
+		Expect(json.Unmarshal([]byte(legacySignalsResponse), &legacy)).To(Succeed())
+		Expect(current).To(Equal(legacy))
+
+		//the MP sends back the ids of the signals it knows about, or the ETag
+		for _, ifNoneMatch := range []string{"0, 1, 2, 3, 4", "0,1,2,3,4", `"0,1,2,3,4"`, `W/"0,1,2,3,4"`} {
+			Expect(getSignals(ifNoneMatch).Code).To(Equal(304), ifNoneMatch)
+		}
+		Expect(getSignals("0,1,2,3").Code).To(Equal(200))
+	})
+})
@@ -0,0 +1,97 @@
+package apidGatewayTrace
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	sessionIdLegacyVersion   = "1"
+	sessionIdV1Separator     = "__"
+	sessionIdVersionedFormat = `^v([0-9]+):(.*)$`
+)
+
+var sessionIdVersionRegexp = regexp.MustCompile(sessionIdVersionedFormat)
+
+//sessionIdV1Components names the "__" delimited components of the original MP debug session ID format, in order
+var sessionIdV1Components = []string{"organization", "environment", "proxy", "revision", "session"}
+
+//sessionIdParsers maps a session ID format version to its parser.  IDs without a "v<N>:" prefix use the legacy
+//format, which is version 1
+var sessionIdParsers = map[string]func(raw, body string) (*debugSessionId, error){
+	sessionIdLegacyVersion: parseSessionIdV1,
+}
+
+//debugSessionId is the parsed form of the X-Apigee-Debug-ID header the MP sends with every trace upload
+type debugSessionId struct {
+	Raw          string
+	Version      string
+	Organization string
+	Environment  string
+	Proxy        string
+	Revision     string
+	Session      string
+}
+
+//sessionIdError describes why a debug session ID could not be parsed, naming the offending component if there is one
+type sessionIdError struct {
+	SessionId string
+	Component string
+	Reason    string
+}
+
+func (e *sessionIdError) Error() string {
+	if e.Component != "" {
+		return fmt.Sprintf("Bad value for required header %s: %s: %s %s",
+			UPLOAD_TRACESESSION_HEADER, e.SessionId, e.Component, e.Reason)
+	}
+	return fmt.Sprintf("Bad value for required header %s: %s: %s", UPLOAD_TRACESESSION_HEADER, e.SessionId, e.Reason)
+}
+
+//parseDebugSessionId parses a debug session ID, dispatching on its optional version prefix
+func parseDebugSessionId(raw string) (*debugSessionId, error) {
+	if raw == "" {
+		return nil, &sessionIdError{SessionId: raw, Reason: "header is missing"}
+	}
+	version, body := sessionIdLegacyVersion, raw
+	if match := sessionIdVersionRegexp.FindStringSubmatch(raw); match != nil {
+		version, body = match[1], match[2]
+	}
+	parser, ok := sessionIdParsers[version]
+	if !ok {
+		return nil, &sessionIdError{SessionId: raw, Component: "version", Reason: "is not supported: " + version}
+	}
+	return parser(raw, body)
+}
+
+//parseSessionIdV1 parses the MP's org__env__proxy__revision__session format
+func parseSessionIdV1(raw, body string) (*debugSessionId, error) {
+	components := strings.Split(body, sessionIdV1Separator)
+	if len(components) != len(sessionIdV1Components) {
+		return nil, &sessionIdError{
+			SessionId: raw,
+			Reason: fmt.Sprintf("expected %d %q delimited components, found %d",
+				len(sessionIdV1Components), sessionIdV1Separator, len(components)),
+		}
+	}
+	for i, component := range components {
+		if component == "" {
+			return nil, &sessionIdError{SessionId: raw, Component: sessionIdV1Components[i], Reason: "is empty"}
+		}
+	}
+	return &debugSessionId{
+		Raw:          raw,
+		Version:      sessionIdLegacyVersion,
+		Organization: components[0],
+		Environment:  components[1],
+		Proxy:        components[2],
+		Revision:     components[3],
+		Session:      components[4],
+	}, nil
+}
+
+//signalIds returns the ids a trace signal for this session may be stored under, the full ID or its session component
+func (id *debugSessionId) signalIds() []string {
+	return []string{id.Raw, id.Session}
+}
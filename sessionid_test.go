@@ -0,0 +1,74 @@
+package apidGatewayTrace
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+)
+
+var _ = Describe("Debug session ID parser", func() {
+
+	It("should name every component of the legacy format", func() {
+		id, err := parseDebugSessionId("org__env__proxy__rev__session")
+		Expect(err).To(Succeed())
+		Expect(*id).To(Equal(debugSessionId{
+			Raw:          "org__env__proxy__rev__session",
+			Version:      "1",
+			Organization: "org",
+			Environment:  "env",
+			Proxy:        "proxy",
+			Revision:     "rev",
+			Session:      "session",
+		}))
+		Expect(id.signalIds()).To(Equal([]string{"org__env__proxy__rev__session", "session"}))
+	})
+
+	It("should accept an explicit version prefix", func() {
+		id, err := parseDebugSessionId("v1:org__env__proxy__rev__session")
+		Expect(err).To(Succeed())
+		Expect(id.Raw).To(Equal("v1:org__env__proxy__rev__session"))
+		Expect(id.Organization).To(Equal("org"))
+		Expect(id.Session).To(Equal("session"))
+	})
+
+	It("should return structured errors", func() {
+		_, err := parseDebugSessionId("")
+		Expect(err).To(BeAssignableToTypeOf(&sessionIdError{}))
+
+		_, err = parseDebugSessionId("org__env__proxy__session")
+		Expect(err).To(BeAssignableToTypeOf(&sessionIdError{}))
+		Expect(err.(*sessionIdError).Component).To(Equal(""))
+
+		_, err = parseDebugSessionId("org__env____rev__session")
+		Expect(err.(*sessionIdError).Component).To(Equal("proxy"))
+		Expect(err.Error()).To(ContainSubstring(UPLOAD_TRACESESSION_HEADER))
+
+		_, err = parseDebugSessionId("v7:org__env__proxy__rev__session")
+		Expect(err.(*sessionIdError).Component).To(Equal("version"))
+	})
+
+	It("should support registering future formats", func() {
+		sessionIdParsers["99"] = func(raw, body string) (*debugSessionId, error) {
+			return &debugSessionId{Raw: raw, Version: "99", Session: body}, nil
+		}
+		defer delete(sessionIdParsers, "99")
+		id, err := parseDebugSessionId("v99:opaque")
+		Expect(err).To(Succeed())
+		Expect(id.Version).To(Equal("99"))
+		Expect(id.Session).To(Equal("opaque"))
+	})
+
+	It("should include proxy and revision in blob metadata tags", func() {
+		metadata := createBlobMetadata(mustParseSessionId("org__env__proxy__rev__session"), http.Header{})
+		Expect(metadata.Organization).To(Equal("org"))
+		Expect(metadata.Customer).To(Equal("org"))
+		Expect(metadata.Environment).To(Equal("env"))
+		Expect(metadata.Tags).To(Equal([]string{"session", "org__env__proxy__rev__session", "proxy:proxy", "revision:rev"}))
+	})
+})
+
+func mustParseSessionId(raw string) *debugSessionId {
+	id, err := parseDebugSessionId(raw)
+	Expect(err).To(Succeed())
+	return id
+}
@@ -0,0 +1,106 @@
+package apidGatewayTrace
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	configValidateSessions     = "apidgatewaytrace_validate_sessions"
+	configDeletedSessionGrace  = "apidgatewaytrace_deleted_session_grace"
+	defaultDeletedSessionGrace = 30 * time.Second
+	deletedSessionMemory       = time.Hour
+)
+
+//sessionState describes whether uploads for a debug session are currently acceptable
+type sessionState int
+
+const (
+	sessionUnknown sessionState = iota
+	sessionActive
+	sessionInGracePeriod
+	sessionDeleted
+)
+
+var sessionStateNames = map[sessionState]string{
+	sessionUnknown:       "unknown",
+	sessionActive:        "active",
+	sessionInGracePeriod: "grace_period",
+	sessionDeleted:       "deleted",
+}
+
+func (s sessionState) String() string {
+	return sessionStateNames[s]
+}
+
+//sessionValidator decides whether uploads for a debug session should be accepted, based on the trace signals in the
+//database and a grace period for sessions deleted while their last transactions were still in flight
+type sessionValidator struct {
+	dbMan   dbManagerInterface
+	grace   time.Duration
+	mux     sync.Mutex
+	deleted map[string]time.Time
+	now     func() time.Time
+}
+
+//newSessionValidator creates a sessionValidator, returning nil if session validation has been disabled in config
+func newSessionValidator(dbMan dbManagerInterface) *sessionValidator {
+	if config.IsSet(configValidateSessions) && !config.GetBool(configValidateSessions) {
+		return nil
+	}
+	grace := defaultDeletedSessionGrace
+	if config.IsSet(configDeletedSessionGrace) {
+		grace = config.GetDuration(configDeletedSessionGrace)
+	}
+	return &sessionValidator{
+		dbMan:   dbMan,
+		grace:   grace,
+		deleted: make(map[string]time.Time),
+		now:     time.Now,
+	}
+}
+
+//sessionDeleted records the time at which a trace signal was removed, starting its grace period
+func (sv *sessionValidator) sessionDeleted(id string) {
+	sv.mux.Lock()
+	defer sv.mux.Unlock()
+	sv.deleted[id] = sv.now()
+	sv.pruneDeleted()
+}
+
+//validate determines the state of a debug session.  Trace signals may be keyed by either the full debug ID or its
+//session component, so both are checked
+func (sv *sessionValidator) validate(sessionId *debugSessionId) (sessionState, error) {
+	ids := sessionId.signalIds()
+
+	signal, err := sv.dbMan.findTraceSignal(ids...)
+	if err != nil {
+		return sessionUnknown, err
+	}
+	if signal != nil {
+		return sessionActive, nil
+	}
+
+	sv.mux.Lock()
+	defer sv.mux.Unlock()
+	sv.pruneDeleted()
+	for _, id := range ids {
+		if deletedAt, ok := sv.deleted[id]; ok {
+			if sv.now().Sub(deletedAt) <= sv.grace {
+				return sessionInGracePeriod, nil
+			}
+			return sessionDeleted, nil
+		}
+	}
+	return sessionUnknown, nil
+}
+
+//pruneDeleted forgets deletions old enough that they no longer matter for diagnosing rejected uploads.  Callers must
+//hold sv.mux
+func (sv *sessionValidator) pruneDeleted() {
+	for id, deletedAt := range sv.deleted {
+		if sv.now().Sub(deletedAt) > sv.grace+deletedSessionMemory {
+			delete(sv.deleted, id)
+		}
+	}
+}
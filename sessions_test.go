@@ -0,0 +1,100 @@
+package apidGatewayTrace
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Session validation", func() {
+
+	var dbMan *dbManager
+	var validator *sessionValidator
+	var now time.Time
+
+	BeforeEach(func() {
+		dataTestTempDir, err := ioutil.TempDir(testTempDirBase, "sqlite3")
+		Expect(err).NotTo(HaveOccurred())
+		services.Config().Set("local_storage_path", dataTestTempDir)
+		dbMan = &dbManager{
+			data:  services.Data(),
+			dbMux: sync.RWMutex{},
+		}
+		dbMan.setDbVersion(dataTestTempDir)
+		setupTestDb(dbMan.getDb())
+
+		validator = newSessionValidator(dbMan)
+		now = time.Now()
+		validator.now = func() time.Time { return now }
+	})
+
+	It("should find trace signals by full debug id or session component", func() {
+		signal, err := dbMan.findTraceSignal("org__env__app__rev__3", "3")
+		Expect(err).To(Succeed())
+		Expect(signal).To(Equal(&traceSignal{Id: "3", Uri: "uri3"}))
+
+		signal, err = dbMan.findTraceSignal("org__env__app__rev__9", "9")
+		Expect(err).To(Succeed())
+		Expect(signal).To(BeNil())
+	})
+
+	It("should accept active sessions and reject unknown ones", func() {
+		state, err := validator.validate(mustParseSessionId("org__env__app__rev__2"))
+		Expect(err).To(Succeed())
+		Expect(state).To(Equal(sessionActive))
+
+		state, err = validator.validate(mustParseSessionId("org__env__app__rev__9"))
+		Expect(err).To(Succeed())
+		Expect(state).To(Equal(sessionUnknown))
+	})
+
+	It("should honor the grace period after deletion", func() {
+		_, err := dbMan.getDb().Exec("DELETE from metadata_trace WHERE id='4'")
+		Expect(err).To(Succeed())
+		validator.sessionDeleted("4")
+
+		now = now.Add(validator.grace / 2)
+		state, err := validator.validate(mustParseSessionId("org__env__app__rev__4"))
+		Expect(err).To(Succeed())
+		Expect(state).To(Equal(sessionInGracePeriod))
+
+		now = now.Add(validator.grace)
+		state, err = validator.validate(mustParseSessionId("org__env__app__rev__4"))
+		Expect(err).To(Succeed())
+		Expect(state).To(Equal(sessionDeleted))
+
+		now = now.Add(deletedSessionMemory + validator.grace)
+		state, err = validator.validate(mustParseSessionId("org__env__app__rev__4"))
+		Expect(err).To(Succeed())
+		Expect(state).To(Equal(sessionUnknown))
+	})
+
+	It("should be disabled by config", func() {
+		config.Set(configValidateSessions, false)
+		defer config.Set(configValidateSessions, true)
+		Expect(newSessionValidator(dbMan)).To(BeNil())
+	})
+
+	It("should reject uploads for unknown and deleted sessions", func() {
+		apiMan := apiManager{sessions: validator}
+
+		r := httptest.NewRequest("POST", "/uploadtrace", nil)
+		r.Header.Add(UPLOAD_TRACESESSION_HEADER, "org__env__app__rev__9")
+		w := httptest.NewRecorder()
+		apiMan.apiUploadTraceDataEndpoint(w, r)
+		Expect(w.Code).To(Equal(404))
+
+		_, err := dbMan.getDb().Exec("DELETE from metadata_trace WHERE id='4'")
+		Expect(err).To(Succeed())
+		apiMan.sessionDeleted("4")
+		now = now.Add(2 * validator.grace)
+		r = httptest.NewRequest("POST", "/uploadtrace", nil)
+		r.Header.Add(UPLOAD_TRACESESSION_HEADER, "org__env__app__rev__4")
+		w = httptest.NewRecorder()
+		apiMan.apiUploadTraceDataEndpoint(w, r)
+		Expect(w.Code).To(Equal(410))
+	})
+})
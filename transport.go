@@ -0,0 +1,215 @@
+package apidGatewayTrace
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	configBlobServerTransportPrefix = "apidgatewaytrace_blobserver"
+	configStorageTransportPrefix    = "apidgatewaytrace_storage"
+	configTLSCAFile                 = "_tls_ca_file"
+	configTLSCertFile               = "_tls_cert_file"
+	configTLSKeyFile                = "_tls_key_file"
+	configTLSMinVersion             = "_tls_min_version"
+	configTLSServerName             = "_tls_server_name"
+	configProxyURL                  = "_proxy_url"
+	configProxyUsername             = "_proxy_username"
+	configProxyPassword             = "_proxy_password"
+	configNoProxy                   = "_no_proxy"
+	configHTTPTimeout               = "_http_timeout"
+	configMaxIdleConnsPerHost       = "_max_idle_conns_per_host"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+//transportConfig holds the TLS, proxy and pool settings for one class of outbound connection, either the blob server
+//or the storage service behind the signed URLs it hands out.  A zero Timeout or MaxIdleConnsPerHost means the default
+type transportConfig struct {
+	Timeout             time.Duration
+	MaxIdleConnsPerHost int
+	CAFile              string
+	CertFile            string
+	KeyFile             string
+	MinTLSVersion       string
+	ServerName          string
+	ProxyURL            string
+	ProxyUsername       string
+	ProxyPassword       string
+	NoProxy             []string
+}
+
+//loadTransportConfig reads the transport settings stored under the given config key prefix
+func loadTransportConfig(prefix string) transportConfig {
+	return transportConfig{
+		Timeout:             config.GetDuration(prefix + configHTTPTimeout),
+		MaxIdleConnsPerHost: config.GetInt(prefix + configMaxIdleConnsPerHost),
+		CAFile:              config.GetString(prefix + configTLSCAFile),
+		CertFile:            config.GetString(prefix + configTLSCertFile),
+		KeyFile:             config.GetString(prefix + configTLSKeyFile),
+		MinTLSVersion:       config.GetString(prefix + configTLSMinVersion),
+		ServerName:          config.GetString(prefix + configTLSServerName),
+		ProxyURL:            config.GetString(prefix + configProxyURL),
+		ProxyUsername:       config.GetString(prefix + configProxyUsername),
+		ProxyPassword:       config.GetString(prefix + configProxyPassword),
+		NoProxy:             splitConfigList(config.GetString(prefix + configNoProxy)),
+	}
+}
+
+//newHTTPClient creates an http.Client whose transport honors the given TLS and proxy settings
+func newHTTPClient(tc transportConfig, checkRedirect func(*http.Request, []*http.Request) error) (*http.Client, error) {
+	transport, err := newTransport(tc)
+	if err != nil {
+		return nil, err
+	}
+	timeout := tc.Timeout
+	if timeout < 0 {
+		return nil, fmt.Errorf("bad http timeout %v, must not be negative", timeout)
+	}
+	if timeout == 0 {
+		timeout = httpTimeout
+	}
+	return &http.Client{
+		Transport:     transport,
+		Timeout:       timeout,
+		CheckRedirect: checkRedirect,
+	}, nil
+}
+
+//newTransport builds an http.Transport from a transportConfig.  An empty config yields the same transport the plugin
+//has always used: system root CAs, Go's default minimum TLS version and no proxy
+func newTransport(tc transportConfig) (*http.Transport, error) {
+	tlsConfig, err := newTLSConfig(tc)
+	if err != nil {
+		return nil, err
+	}
+	maxIdle := tc.MaxIdleConnsPerHost
+	if maxIdle < 0 {
+		return nil, fmt.Errorf("bad max idle connections per host %d, must not be negative", maxIdle)
+	}
+	if maxIdle == 0 {
+		maxIdle = maxIdleConnsPerHost
+	}
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: maxIdle,
+		TLSClientConfig:     tlsConfig,
+	}
+	if tc.ProxyURL != "" {
+		proxyURL, err := url.Parse(tc.ProxyURL)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad proxy url %s", tc.ProxyURL)
+		}
+		if tc.ProxyUsername != "" {
+			proxyURL.User = url.UserPassword(tc.ProxyUsername, tc.ProxyPassword)
+		}
+		transport.Proxy = proxyFunc(proxyURL, tc.NoProxy)
+	}
+	return transport, nil
+}
+
+//newTLSConfig builds the tls.Config for a transportConfig, loading the CA bundle and client certificate from disk
+func newTLSConfig(tc transportConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: tc.ServerName,
+	}
+
+	if tc.MinTLSVersion != "" {
+		version, ok := tlsVersions[tc.MinTLSVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported minimum TLS version %s", tc.MinTLSVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if tc.CAFile != "" {
+		pool, err := loadCertPool(tc.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if tc.CertFile != "" || tc.KeyFile != "" {
+		if tc.CertFile == "" || tc.KeyFile == "" {
+			return nil, errors.New("client certificate and key must be configured together")
+		}
+		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to load client certificate %s", tc.CertFile)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+//proxyFunc returns a Transport.Proxy implementation which sends every request through proxyURL, except those whose
+//host matches an entry of noProxy
+func proxyFunc(proxyURL *url.URL, noProxy []string) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL.Hostname(), noProxy) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}
+}
+
+//bypassProxy reports whether host matches the NO_PROXY style list.  Entries may be "*", an exact host name, a domain
+//suffix (with or without a leading dot), an IP address or a CIDR range
+func bypassProxy(host string, noProxy []string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, entry := range noProxy {
+		entry = strings.ToLower(entry)
+		switch {
+		case entry == "*":
+			return true
+		case ip != nil && strings.Contains(entry, "/"):
+			if _, cidr, err := net.ParseCIDR(entry); err == nil && cidr.Contains(ip) {
+				return true
+			}
+		case host == strings.TrimPrefix(entry, "."):
+			return true
+		case strings.HasSuffix(host, "."+strings.TrimPrefix(entry, ".")):
+			return true
+		}
+	}
+	return false
+}
+
+//loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read CA bundle %s", file)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", file)
+	}
+	return pool, nil
+}
+
+//splitConfigList splits a comma separated config value, dropping empty entries and surrounding white space
+func splitConfigList(value string) []string {
+	list := make([]string, 0)
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
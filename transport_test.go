@@ -0,0 +1,110 @@
+package apidGatewayTrace
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+)
+
+var _ = Describe("Transport configuration", func() {
+
+	Context("newTransport", func() {
+
+		It("should default to no proxy and system roots", func() {
+			transport, err := newTransport(transportConfig{})
+			Expect(err).To(Succeed())
+			Expect(transport.Proxy).To(BeNil())
+			Expect(transport.TLSClientConfig.RootCAs).To(BeNil())
+			Expect(transport.MaxIdleConnsPerHost).To(Equal(maxIdleConnsPerHost))
+		})
+
+		It("should reject an unknown minimum TLS version", func() {
+			_, err := newTransport(transportConfig{MinTLSVersion: "0.9"})
+			Expect(err).ToNot(Succeed())
+			transport, err := newTransport(transportConfig{MinTLSVersion: "1.2"})
+			Expect(err).To(Succeed())
+			Expect(transport.TLSClientConfig.MinVersion).To(Equal(uint16(tls.VersionTLS12)))
+		})
+
+		It("should require client certificate and key together", func() {
+			_, err := newTransport(transportConfig{CertFile: "cert.pem"})
+			Expect(err).ToNot(Succeed())
+		})
+
+		It("should trust a custom CA bundle and honor a server name override", func() {
+			server := httptest.NewTLSServer(getHandler(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("ok"))
+			}))
+			defer server.Close()
+
+			dir, err := ioutil.TempDir(testTempDirBase, "ca")
+			Expect(err).To(Succeed())
+			caFile := filepath.Join(dir, "ca.pem")
+			caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+			Expect(ioutil.WriteFile(caFile, caPem, 0600)).To(Succeed())
+
+			untrusted, err := newHTTPClient(transportConfig{}, nil)
+			Expect(err).To(Succeed())
+			_, err = untrusted.Get(server.URL)
+			Expect(err).ToNot(Succeed())
+
+			trusted, err := newHTTPClient(transportConfig{CAFile: caFile, ServerName: "example.com"}, nil)
+			Expect(err).To(Succeed())
+			res, err := trusted.Get(server.URL)
+			Expect(err).To(Succeed())
+			res.Body.Close()
+			Expect(res.StatusCode).To(Equal(200))
+
+			wrongName, err := newHTTPClient(transportConfig{CAFile: caFile, ServerName: "blob.internal"}, nil)
+			Expect(err).To(Succeed())
+			_, err = wrongName.Get(server.URL)
+			Expect(err).ToNot(Succeed())
+		})
+
+		It("should send requests through an authenticated proxy", func() {
+			var proxyAuth, requestedURL string
+			proxy := httptest.NewServer(getHandler(func(w http.ResponseWriter, r *http.Request) {
+				proxyAuth = r.Header.Get("Proxy-Authorization")
+				requestedURL = r.URL.String()
+				w.Write([]byte("proxied"))
+			}))
+			defer proxy.Close()
+
+			client, err := newHTTPClient(transportConfig{
+				ProxyURL:      proxy.URL,
+				ProxyUsername: "user",
+				ProxyPassword: "pass",
+			}, nil)
+			Expect(err).To(Succeed())
+			res, err := client.Get("http://blobserver.example.com/blobs")
+			Expect(err).To(Succeed())
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			Expect(string(body)).To(Equal("proxied"))
+			Expect(requestedURL).To(Equal("http://blobserver.example.com/blobs"))
+			Expect(proxyAuth).To(Equal("Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass"))))
+		})
+	})
+
+	Context("bypassProxy", func() {
+		It("should match NO_PROXY style entries", func() {
+			noProxy := splitConfigList(" internal.example.com, .corp , 10.0.0.0/8,,")
+			Expect(noProxy).To(Equal([]string{"internal.example.com", ".corp", "10.0.0.0/8"}))
+			Expect(bypassProxy("internal.example.com", noProxy)).To(BeTrue())
+			Expect(bypassProxy("blobs.internal.example.com", noProxy)).To(BeTrue())
+			Expect(bypassProxy("storage.corp", noProxy)).To(BeTrue())
+			Expect(bypassProxy("corp", noProxy)).To(BeTrue())
+			Expect(bypassProxy("10.1.2.3", noProxy)).To(BeTrue())
+			Expect(bypassProxy("11.1.2.3", noProxy)).To(BeFalse())
+			Expect(bypassProxy("example.com", noProxy)).To(BeFalse())
+			Expect(bypassProxy("notinternal.example.com", noProxy)).To(BeFalse())
+			Expect(bypassProxy("anything", []string{"*"})).To(BeTrue())
+		})
+	})
+})
@@ -5,32 +5,50 @@ import (
 	"io"
 	"net/http"
 	"sync"
+	"time"
 )
 
 //errorResponse is the json structure returned to clients in the event of an error
 type errorResponse struct {
 	ErrorCode int    `json:"errorCode"`
 	Reason    string `json:"reason"`
+	Code      string `json:"code"`
+	Retryable bool   `json:"retryable"`
 }
 
 //blobstoreClientInterface defines the methods needed for this plugin to interact with blobstore
 type blobstoreClientInterface interface {
-	getSignedURL(metadata blobCreationMetadata, blobServerURL string) (string, error)
+	getSignedURL(metadata blobCreationMetadata, route blobServerRoute) (*blobServerResponse, error)
 	uploadToBlobstore(uriString string, data io.Reader) (*http.Response, error)
-	postWithAuth(uriString string, blobMetadata blobCreationMetadata) (io.ReadCloser, error)
+	postWithAuth(uriString string, authorization string, blobMetadata blobCreationMetadata) (io.ReadCloser, error)
+	checkBlobServer(route blobServerRoute) (int, error)
 }
 
-//blobstoreClient implements blobstoreClientInterface
+//blobstoreClient implements blobstoreClientInterface.  httpClient talks to the blob server, while storageClient is
+//used for the signed URLs it returns, which usually point at a different storage service
 type blobstoreClient struct {
-	httpClient *http.Client
+	httpClient    *http.Client
+	storageClient *http.Client
 }
 
-//blobCreationMetadata represents the metadata needed to create a blob in blobstore
+//blobCreationMetadata represents the metadata needed to create a blob in blobstore.  Fields after Tags describe the
+//traced transaction, allowing the trace viewer to query blobs by them, and are omitted when unknown
 type blobCreationMetadata struct {
-	Customer     string   `json:"customer"`
-	Environment  string   `json:"environment"`
-	Organization string   `json:"organization"`
-	Tags         []string `json:"tags"`
+	Customer         string   `json:"customer"`
+	Environment      string   `json:"environment"`
+	Organization     string   `json:"organization"`
+	Tags             []string `json:"tags"`
+	Proxy            string   `json:"proxy,omitempty"`
+	Revision         string   `json:"revision,omitempty"`
+	MessageProcessor string   `json:"messageProcessor,omitempty"`
+	TransactionTime  string   `json:"transactionTime,omitempty"`
+	StatusCode       int      `json:"statusCode,omitempty"`
+	ContentType      string   `json:"contentType,omitempty"`
+	URI              string   `json:"uri,omitempty"`
+	Verb             string   `json:"verb,omitempty"`
+	DurationMs       int64    `json:"durationMs,omitempty"`
+	Redactions       int      `json:"redactions,omitempty"`
+	EncryptionKeyId  string   `json:"encryptionKeyId,omitempty"`
 }
 
 //blobServerResponse represents the data structure returned by either the creation or fetching of a blob
@@ -42,11 +60,32 @@ type blobServerResponse struct {
 	SignedUrlExpiryTimestamp string   `json:"signedurlexpirytimestamp"`
 	Tags                     []string `json:"tags"`
 	Store                    string   `json:"store"`
-	Organization             string   `json"organization"`
+	Organization             string   `json:"organization"`
 	ContentType              string   `json:"contentType"`
 	Customer                 string   `json:"customer"`
 }
 
+//uploadTraceResult is the json structure returned to the MP once a trace is stored, identifying the blob holding it
+type uploadTraceResult struct {
+	BlobId          string `json:"blobId"`
+	Self            string `json:"self,omitempty"`
+	Store           string `json:"store,omitempty"`
+	SignedUrlExpiry string `json:"signedUrlExpiry,omitempty"`
+}
+
+//uploadDroppedResult is the json structure returned to the MP when a trace is deliberately not stored.  The MP
+//should not retry such uploads
+type uploadDroppedResult struct {
+	Dropped string `json:"dropped"`
+}
+
+//sessionStatusResult is the json structure describing a debug session and what happened to its uploads
+type sessionStatusResult struct {
+	SessionId string `json:"sessionId"`
+	State     string `json:"state,omitempty"`
+	sessionCounts
+}
+
 //apigeeSyncHandler is what listens for apid events
 type apigeeSyncHandler struct {
 	dbMan  dbManagerInterface
@@ -58,31 +97,68 @@ type apigeeSyncHandler struct {
 type apiManagerInterface interface {
 	InitAPI()
 	notifyChange(interface{})
+	sessionDeleted(string)
 }
 
 //apiManager implements apiManagerInterface
 type apiManager struct {
-	signalEndpoint string
-	uploadEndpoint string
-	dbMan          dbManagerInterface
-	bsClient       blobstoreClientInterface
-	apiInitialized bool
-	newSignal      chan interface{}
-	addSubscriber  chan chan interface{}
+	signalEndpoint       string
+	uploadEndpoint       string
+	transactionsEndpoint string
+	sessionEndpoint      string
+	deadLettersEndpoint  string
+	reloadEndpoint       string
+	debugEndpoint        string
+	healthEndpoint       string
+	endpointPrefix       string
+	signalAliases        []string
+	uploadAliases        []string
+	dbMan                dbManagerInterface
+	bsClient             blobstoreClientInterface
+	auth                 *callerAuthenticator
+	sessions             *sessionValidator
+	limiter              *uploadLimiter
+	idempotency          *idempotencyCache
+	router               *blobServerRouter
+	destinations         []uploadDestination
+	asyncUploads         *asyncUploadQueue
+	deadLetters          *deadLetterStore
+	stages               []uploadStage
+	config               *pluginConfig
+	healthMonitor        *healthMonitor
+	configMux            sync.RWMutex
+	registerOnce         sync.Once
+	registerErr          error
+	readyMux             sync.Mutex
+	ready                chan struct{}
+	apiInitialized       bool
+	newSignal            chan interface{}
+	addSubscriber        chan chan interface{}
 }
 
 //dbManagerInterface defines the necessary methods for using the shared apid sqlite database
 type dbManagerInterface interface {
-	setDbVersion(string)
+	setDbVersion(string) error
+	getDbVersion() string
+	getDbError() error
 	initDb() error
 	getTraceSignals() (result getTraceSignalsResult, err error)
+	countTraceSignals() (int, error)
+	findTraceSignal(ids ...string) (*traceSignal, error)
+	insertTraceRecord(record *traceRecord) error
+	getTraceRecords(filter traceRecordFilter) ([]traceRecord, error)
 }
 
-//dbManager implements dbManagerInterface
+//dbManager implements dbManagerInterface.  db is the versioned database holding the synced trace signals, while
+//indexDb is owned by this plugin and holds the trace index
 type dbManager struct {
-	data  apid.DataService
-	db    apid.DB
-	dbMux sync.RWMutex
+	data       apid.DataService
+	db         apid.DB
+	version    string
+	versionErr error
+	queries    *sync.WaitGroup
+	indexDb    apid.DB
+	dbMux      sync.RWMutex
 }
 
 //traceSignal is the structure used to represent the instruction to create a trace signal to the MP
@@ -91,8 +167,50 @@ type traceSignal struct {
 	Uri string `json:"uri"`
 }
 
-//getTraceSignalsResult is the structure returned to the client representing the list of active traceSignals
+//getTraceSignalsResult is the structure returned to v1 clients representing the list of active traceSignals.  Its
+//schema is published in schema/tracesignals.json
 type getTraceSignalsResult struct {
-	Signals []traceSignal `json:"signals"`
-	Err     error         `json:"error"`
+	Signals     []traceSignal `json:"signals"`
+	Version     string        `json:"version"`
+	GeneratedAt time.Time     `json:"generatedAt"`
+	Error       *signalsError `json:"error"`
+}
+
+//signalsError tells the client that some trace signals could not be read, so that the list of signals is incomplete
+type signalsError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Skipped int    `json:"skipped"`
+}
+
+//traceRecord is the entry of the trace index for a single uploaded trace
+type traceRecord struct {
+	Id         int64     `json:"id"`
+	SessionId  string    `json:"sessionId"`
+	BlobId     string    `json:"blobId"`
+	Timestamp  time.Time `json:"timestamp"`
+	Size       int64     `json:"size"`
+	URI        string    `json:"uri,omitempty"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	BlobSelf   string    `json:"blobSelf,omitempty"`
+	BlobStore  string    `json:"blobStore,omitempty"`
+}
+
+//traceRecordFilter selects a page of the trace index entries of a session.  Zero values do not filter
+type traceRecordFilter struct {
+	SessionId     string
+	URI           string
+	MinStatusCode int
+	MaxStatusCode int
+	From          time.Time
+	To            time.Time
+	Limit         int
+	Offset        int
+}
+
+//getTraceRecordsResult is the structure returned to the client listing the indexed traces of a session.  Next is the
+//offset of the following page, and is omitted on the last page
+type getTraceRecordsResult struct {
+	Transactions []traceRecord `json:"transactions"`
+	Next         *int          `json:"next,omitempty"`
 }
@@ -0,0 +1,550 @@
+package apidGatewayTrace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	configTraceValidation       = "apidgatewaytrace_trace_validation"
+	configQuarantineDir         = "apidgatewaytrace_quarantine_dir"
+	configQuarantineMaxFiles    = "apidgatewaytrace_quarantine_max_files"
+	configTraceXMLRoot          = "apidgatewaytrace_trace_xml_root"
+	configTraceJSONRootKey      = "apidgatewaytrace_trace_json_root_key"
+	configValidationBufferSize  = "apidgatewaytrace_trace_validation_buffer_size"
+	traceValidationReject       = "reject"
+	traceValidationQuarantine   = "quarantine"
+	traceValidationOff          = "off"
+	defaultQuarantineMaxFiles   = 100
+	defaultTraceXMLRoot         = "Completed"
+	defaultTraceJSONRootKey     = "point"
+	defaultValidationBufferSize = 1024 * 1024
+	mpTimestampLayout           = "02-01-06 15:04:05"
+	metricTracesValid           = "traces_valid"
+	metricTracesMalformed       = "traces_malformed"
+	metricTracesQuarantined     = "traces_quarantined"
+	metricTraceDurationTotalMs  = "trace_duration_total_ms"
+	metricTraceStatusPrefix     = "trace_status_"
+)
+
+//errValidationAborted tells the decoder of a trace that the upload ended before its body was read
+var errValidationAborted = errors.New("upload ended before the trace was read")
+
+//traceSummary holds the fields extracted from a trace while it is validated
+type traceSummary struct {
+	URI        string
+	Verb       string
+	StatusCode int
+	Duration   time.Duration
+}
+
+//validationStage is the uploadStage checking that a trace is a complete MP trace document, in either its XML or JSON
+//variant, and extracting a traceSummary from it.  Traces up to bufferSize are read and validated before the blob is
+//created, and larger ones as they stream to blobstore, so that a malformed trace fails its upload when the end of its
+//body is read.  Malformed traces are optionally kept in a quarantine directory for investigation.  The default roots
+//are those of the transaction data the MP records, as in testdata/mp-trace.xml and testdata/mp-trace.json
+type validationStage struct {
+	quarantineDir      string
+	quarantineMaxFiles int
+	xmlRoot            string
+	jsonRootKey        string
+	bufferSize         int64
+}
+
+//traceValidation validates a single trace while the upload reads it.  Every byte read from the body is also written
+//to a pipe read by the decoder, so the trace is never held in memory.  The outcome is reported by Read, which returns
+//an uploadError instead of io.EOF for a malformed trace
+type traceValidation struct {
+	stage   *validationStage
+	upload  *traceUpload
+	body    io.Reader
+	pipe    *io.PipeWriter
+	copy    *os.File
+	parsed  chan struct{}
+	summary *traceSummary
+	err     error
+	once    sync.Once
+	result  error
+}
+
+//newValidationStage creates the validationStage, returning nil unless trace validation is turned on
+func newValidationStage() (*validationStage, error) {
+	mode := config.GetString(configTraceValidation)
+	vs := &validationStage{
+		quarantineMaxFiles: defaultQuarantineMaxFiles,
+		xmlRoot:            configString(configTraceXMLRoot, defaultTraceXMLRoot),
+		jsonRootKey:        configString(configTraceJSONRootKey, defaultTraceJSONRootKey),
+		bufferSize:         defaultValidationBufferSize,
+	}
+	if config.IsSet(configQuarantineMaxFiles) {
+		vs.quarantineMaxFiles = config.GetInt(configQuarantineMaxFiles)
+	}
+	if config.IsSet(configValidationBufferSize) {
+		vs.bufferSize = int64(config.GetInt(configValidationBufferSize))
+	}
+	switch mode {
+	case traceValidationReject:
+		return vs, nil
+	case traceValidationQuarantine:
+		vs.quarantineDir = config.GetString(configQuarantineDir)
+		if vs.quarantineDir == "" {
+			return nil, fmt.Errorf("%s is required when %s is %s", configQuarantineDir, configTraceValidation, mode)
+		}
+		if err := os.MkdirAll(vs.quarantineDir, 0700); err != nil {
+			return nil, errors.Wrapf(err, "unable to create quarantine directory %s", vs.quarantineDir)
+		}
+		return vs, nil
+	case "", traceValidationOff:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported value for %s: %s", configTraceValidation, mode)
+}
+
+//validationSettings is the trace validation configuration, as reported by the diagnostics endpoint
+type validationSettings struct {
+	Mode               string `json:"mode"`
+	QuarantineDir      string `json:"quarantineDir,omitempty"`
+	QuarantineMaxFiles int    `json:"quarantineMaxFiles,omitempty"`
+	XMLRoot            string `json:"xmlRoot,omitempty"`
+	JSONRootKey        string `json:"jsonRootKey,omitempty"`
+	BufferSize         int64  `json:"bufferSize,omitempty"`
+}
+
+//settings returns the configuration the stage was created from, which is validation turned off for a nil stage
+func (vs *validationStage) settings() validationSettings {
+	if vs == nil {
+		return validationSettings{Mode: traceValidationOff}
+	}
+	settings := validationSettings{
+		Mode:        traceValidationReject,
+		XMLRoot:     vs.xmlRoot,
+		JSONRootKey: vs.jsonRootKey,
+		BufferSize:  vs.bufferSize,
+	}
+	if vs.quarantineDir != "" {
+		settings.Mode = traceValidationQuarantine
+		settings.QuarantineDir = vs.quarantineDir
+		settings.QuarantineMaxFiles = vs.quarantineMaxFiles
+	}
+	return settings
+}
+
+//process validates a trace which fits in the buffer right away, so that its summary goes into the metadata the blob
+//is created with.  Larger traces are validated as the following stages or the upload read their body, and their
+//summary, only known once the body was read, fills in the trace index but not the blob metadata
+func (vs *validationStage) process(upload *traceUpload) error {
+	if vs.bufferSize > 0 {
+		head, err := ioutil.ReadAll(io.LimitReader(upload.body, vs.bufferSize+1))
+		if err != nil {
+			return errors.Wrap(err, "unable to read trace")
+		}
+		if int64(len(head)) <= vs.bufferSize {
+			upload.body = bytes.NewReader(head)
+			return vs.validateBuffered(upload, head)
+		}
+		upload.body = io.MultiReader(bytes.NewReader(head), upload.body)
+	}
+
+	tv := &traceValidation{stage: vs, upload: upload, parsed: make(chan struct{})}
+	pr, pw := io.Pipe()
+	tv.pipe = pw
+	var tee io.Writer = pw
+	if vs.quarantineDir != "" {
+		file, err := ioutil.TempFile(vs.quarantineDir, "upload-")
+		if err != nil {
+			return errors.Wrap(err, "unable to create quarantine file")
+		}
+		tv.copy = file
+		tee = io.MultiWriter(pw, file)
+	}
+	tv.body = io.TeeReader(upload.body, tee)
+	go tv.parse(pr, upload.metadata.ContentType)
+	upload.body = tv
+	upload.validation = tv
+	return nil
+}
+
+//validateBuffered validates a trace read whole, returning the error rejecting it if it is malformed
+func (vs *validationStage) validateBuffered(upload *traceUpload, data []byte) error {
+	summary, err := parseTrace(bytes.NewReader(data), upload.metadata.ContentType, vs.xmlRoot, vs.jsonRootKey)
+	if err == nil {
+		vs.valid(upload, summary)
+		return nil
+	}
+	var file *os.File
+	if vs.quarantineDir != "" {
+		var cerr error
+		if file, cerr = vs.copyTrace(data); cerr != nil {
+			log.Errorf("unable to keep a copy of the trace for %s: %v", upload.sessionId.Raw, cerr)
+		}
+	}
+	return vs.malformed(upload, err, file)
+}
+
+//copyTrace writes a buffered trace to a file of the quarantine directory, to be quarantined
+func (vs *validationStage) copyTrace(data []byte) (*os.File, error) {
+	file, err := ioutil.TempFile(vs.quarantineDir, "upload-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return file, nil
+}
+
+//parse decodes the trace from the pipe.  Once the decoder stops, the rest of the trace is discarded so that
+//writes to the pipe never block
+func (tv *traceValidation) parse(pr *io.PipeReader, contentType string) {
+	tv.summary, tv.err = parseTrace(pr, contentType, tv.stage.xmlRoot, tv.stage.jsonRootKey)
+	close(tv.parsed)
+	io.Copy(ioutil.Discard, pr)
+}
+
+//Read reads the trace, failing as soon as the decoder found it malformed
+func (tv *traceValidation) Read(p []byte) (int, error) {
+	n, err := tv.body.Read(p)
+	if err == io.EOF {
+		return n, tv.finish(nil)
+	}
+	if err != nil {
+		tv.finish(err)
+		return n, err
+	}
+	select {
+	case <-tv.parsed:
+		if tv.err != nil {
+			return n, tv.finish(nil)
+		}
+	default:
+	}
+	return n, nil
+}
+
+//finish ends the validation, once with the outcome of the trace.  readErr is the error reading the body failed
+//with, nil if it was read to its end or found malformed.  It returns the error Read must report from now on
+func (tv *traceValidation) finish(readErr error) error {
+	tv.once.Do(func() {
+		if readErr != nil {
+			tv.pipe.CloseWithError(readErr)
+			<-tv.parsed
+			tv.discardCopy()
+			tv.result = readErr
+			return
+		}
+		tv.pipe.Close()
+		<-tv.parsed
+		if tv.err != nil {
+			tv.result = tv.stage.malformed(tv.upload, tv.err, tv.copy)
+			return
+		}
+		tv.discardCopy()
+		tv.stage.valid(tv.upload, tv.summary)
+		tv.result = io.EOF
+	})
+	return tv.result
+}
+
+//abort stops the decoder of a trace whose body was not read to its end
+func (tv *traceValidation) abort() {
+	tv.finish(errValidationAborted)
+}
+
+//discardCopy removes the copy of a trace which does not need to be quarantined
+func (tv *traceValidation) discardCopy() {
+	if tv.copy != nil {
+		tv.copy.Close()
+		os.Remove(tv.copy.Name())
+	}
+}
+
+//valid counts a valid trace and copies its summary into the upload.  Values sent by the MP in headers take precedence
+//over those found in the trace
+func (vs *validationStage) valid(upload *traceUpload, summary *traceSummary) {
+	metrics.inc(metricTracesValid)
+	metrics.add(metricTraceDurationTotalMs, int64(summary.Duration/time.Millisecond))
+	if summary.StatusCode != 0 {
+		metrics.inc(metricTraceStatusPrefix + strconv.Itoa(summary.StatusCode/100) + "xx")
+	}
+
+	upload.summary = summary
+	upload.metadata.URI = summary.URI
+	upload.metadata.Verb = summary.Verb
+	upload.metadata.DurationMs = int64(summary.Duration / time.Millisecond)
+	if upload.metadata.StatusCode == 0 {
+		upload.metadata.StatusCode = summary.StatusCode
+	}
+}
+
+//malformed counts a malformed trace and quarantines the copy of it, if one was kept, returning the error rejecting it
+func (vs *validationStage) malformed(upload *traceUpload, err error, file *os.File) error {
+	metrics.inc(metricTracesMalformed)
+	log.Errorf("malformed trace for %s: %v", upload.sessionId.Raw, err)
+	reason := "malformed trace: " + err.Error()
+	if file != nil {
+		if qerr := vs.quarantine(upload.sessionId, file); qerr != nil {
+			log.Errorf("unable to quarantine trace for %s: %v", upload.sessionId.Raw, qerr)
+			os.Remove(file.Name())
+		} else {
+			metrics.inc(metricTracesQuarantined)
+			reason += " (quarantined)"
+		}
+	}
+	return &uploadError{code: API_ERR_MALFORMED_TRACE, reason: reason}
+}
+
+//quarantine keeps the copy of a malformed trace, as far as it was read, removing the oldest quarantined traces
+//beyond the configured maximum
+func (vs *validationStage) quarantine(sessionId *debugSessionId, file *os.File) error {
+	if err := file.Close(); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.trace", time.Now().UnixNano(), sanitizeFileName(sessionId.Raw))
+	if err := os.Rename(file.Name(), filepath.Join(vs.quarantineDir, name)); err != nil {
+		return err
+	}
+	files, err := filepath.Glob(filepath.Join(vs.quarantineDir, "*.trace"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+	for len(files) > vs.quarantineMaxFiles {
+		os.Remove(files[0])
+		files = files[1:]
+	}
+	return nil
+}
+
+//parseTrace validates a trace document and extracts its summary.  The format is taken from the content type when
+//it names one, and otherwise from the first non-blank character.  Empty roots accept any document
+func parseTrace(r io.Reader, contentType, xmlRoot, jsonRootKey string) (*traceSummary, error) {
+	br := bufio.NewReader(r)
+	first, err := firstNonBlank(br)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case strings.Contains(contentType, "json"):
+		return parseJSONTrace(br, jsonRootKey)
+	case strings.Contains(contentType, "xml"):
+		return parseXMLTrace(br, xmlRoot)
+	case first == '{':
+		return parseJSONTrace(br, jsonRootKey)
+	case first == '<':
+		return parseXMLTrace(br, xmlRoot)
+	}
+	return nil, errors.New("trace is neither JSON nor XML")
+}
+
+//firstNonBlank skips leading white space, returning the first other byte without consuming it
+func firstNonBlank(br *bufio.Reader) (byte, error) {
+	for {
+		b, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != ' ' && b != '\t' && b != '\r' && b != '\n' {
+			return b, br.UnreadByte()
+		}
+	}
+}
+
+//parseXMLTrace decodes an XML trace token by token as it is read, keeping only the path to the current element
+func parseXMLTrace(r io.Reader, root string) (*traceSummary, error) {
+	decoder := xml.NewDecoder(r)
+	summary := &traceSummary{}
+	timestamps := &timestampRange{}
+	stack := make([]string, 0)
+	text := &bytes.Buffer{}
+	sawRoot := false
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if len(stack) == 0 {
+				if sawRoot {
+					return nil, errors.New("unexpected data after trace")
+				}
+				if root != "" && t.Name.Local != root {
+					return nil, fmt.Errorf("unexpected root element %s, expected %s", t.Name.Local, root)
+				}
+				sawRoot = true
+			}
+			stack = append(stack, t.Name.Local)
+			text.Reset()
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			summary.record(stack, strings.TrimSpace(text.String()), timestamps)
+			stack = stack[:len(stack)-1]
+			text.Reset()
+		}
+	}
+	if !sawRoot {
+		return nil, errors.New("empty trace")
+	}
+	summary.Duration = timestamps.duration()
+	return summary, nil
+}
+
+//parseJSONTrace decodes a JSON trace token by token as it is read, keeping only the path to the current value.  The
+//trace must be an object with a rootKey member
+func parseJSONTrace(r io.Reader, rootKey string) (*traceSummary, error) {
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	summary := &traceSummary{}
+	timestamps := &timestampRange{}
+	//path holds the member name of each open container, "" for array elements and the root
+	path := make([]string, 0)
+	containers := make([]json.Delim, 0)
+	key, expectKey := "", false
+	foundRoot, rootClosed := rootKey == "", false
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rootClosed {
+			return nil, errors.New("unexpected data after trace")
+		}
+
+		switch t := token.(type) {
+		case json.Delim:
+			if t == '{' || t == '[' {
+				if len(containers) == 0 && t != '{' {
+					return nil, errors.New("trace must be a JSON object")
+				}
+				path = append(path, key)
+				containers = append(containers, t)
+				key, expectKey = "", t == '{'
+				continue
+			}
+			containers = containers[:len(containers)-1]
+			path = path[:len(path)-1]
+			rootClosed = len(containers) == 0
+		case string:
+			if expectKey {
+				key, expectKey = t, false
+				if len(containers) == 1 && key == rootKey {
+					foundRoot = true
+				}
+				continue
+			}
+			summary.record(append(path, key), t, timestamps)
+		case json.Number:
+			summary.record(append(path, key), t.String(), timestamps)
+		}
+		if len(containers) > 0 {
+			key, expectKey = "", containers[len(containers)-1] == '{'
+		}
+	}
+	if len(containers) > 0 {
+		return nil, errors.New("truncated trace")
+	}
+	if !rootClosed {
+		return nil, errors.New("empty trace")
+	}
+	if !foundRoot {
+		return nil, fmt.Errorf("trace has no %q member", rootKey)
+	}
+	summary.Duration = timestamps.duration()
+	return summary, nil
+}
+
+//record captures a value of the trace if it is one of the summary fields.  The URI and verb come from the first
+//request message, the status code from the last response message, and the duration spans every timestamp
+func (s *traceSummary) record(path []string, value string, timestamps *timestampRange) {
+	if len(path) == 0 || value == "" {
+		return
+	}
+	name := strings.ToLower(path[len(path)-1])
+	switch name {
+	case "uri":
+		if s.URI == "" {
+			s.URI = value
+		}
+	case "verb":
+		if s.Verb == "" {
+			s.Verb = value
+		}
+	case "statuscode":
+		if code, err := strconv.Atoi(value); err == nil {
+			s.StatusCode = code
+		}
+	case "timestamp":
+		if t, err := parseMPTimestamp(value); err == nil {
+			timestamps.add(t)
+		}
+	}
+}
+
+//timestampRange tracks the earliest and latest timestamps seen in a trace
+type timestampRange struct {
+	first time.Time
+	last  time.Time
+}
+
+func (tr *timestampRange) add(t time.Time) {
+	if tr.first.IsZero() || t.Before(tr.first) {
+		tr.first = t
+	}
+	if tr.last.IsZero() || t.After(tr.last) {
+		tr.last = t
+	}
+}
+
+func (tr *timestampRange) duration() time.Duration {
+	return tr.last.Sub(tr.first)
+}
+
+//parseMPTimestamp parses the MP's "dd-MM-yy HH:mm:ss:SSS" timestamps, as well as RFC 3339 and epoch milliseconds
+func parseMPTimestamp(value string) (time.Time, error) {
+	if i := strings.LastIndex(value, ":"); i > 0 && strings.Count(value, ":") == 3 {
+		t, err := time.Parse(mpTimestampLayout, value[:i])
+		if err != nil {
+			return t, err
+		}
+		millis, err := strconv.Atoi(value[i+1:])
+		if err != nil {
+			return t, err
+		}
+		return t.Add(time.Duration(millis) * time.Millisecond), nil
+	}
+	return parseTransactionTime(value)
+}
+
+//sanitizeFileName replaces characters which are not safe in file names
+func sanitizeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, name)
+}
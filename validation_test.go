@@ -0,0 +1,304 @@
+package apidGatewayTrace
+
+import (
+	"bytes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//readTrace reads an MP trace of the testdata directory
+func readTrace(name string) string {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	Expect(err).To(Succeed())
+	return string(data)
+}
+
+//blankReader is an endless stream of white space
+type blankReader struct{}
+
+func (blankReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = ' '
+	}
+	return len(p), nil
+}
+
+var _ = Describe("Trace validation", func() {
+
+	parse := func(trace, contentType string) (*traceSummary, error) {
+		return parseTrace(strings.NewReader(trace), contentType, defaultTraceXMLRoot, defaultTraceJSONRootKey)
+	}
+
+	AfterEach(func() {
+		for _, key := range []string{configTraceValidation, configQuarantineDir, configTraceXMLRoot, configTraceJSONRootKey} {
+			config.Set(key, "")
+		}
+		config.Set(configQuarantineMaxFiles, defaultQuarantineMaxFiles)
+		config.Set(configValidationBufferSize, defaultValidationBufferSize)
+	})
+
+	It("should summarize XML traces", func() {
+		summary, err := parse(readTrace("mp-trace.xml"), "application/xml")
+		Expect(err).To(Succeed())
+		Expect(*summary).To(Equal(traceSummary{URI: "/v1/orders?limit=10", Verb: "GET", StatusCode: 404,
+			Duration: 250 * time.Millisecond}))
+	})
+
+	It("should summarize JSON traces", func() {
+		summary, err := parse(readTrace("mp-trace.json"), "")
+		Expect(err).To(Succeed())
+		Expect(*summary).To(Equal(traceSummary{URI: "/v1/orders", Verb: "POST", StatusCode: 201,
+			Duration: time.Second}))
+	})
+
+	It("should reject malformed and truncated traces", func() {
+		for _, bad := range []string{
+			"",
+			"a trace",
+			"<Completed><Point>",
+			"<Other></Other>",
+			"<Completed></Completed><Completed></Completed>",
+			`{"point":[{"id":"StateChange"}`,
+			`{"other":[]}`,
+			`["point"]`,
+			`{"point":[]} {}`,
+		} {
+			_, err := parse(bad, "")
+			Expect(err).ToNot(Succeed(), bad)
+		}
+	})
+
+	It("should honor the content type over the first character", func() {
+		_, err := parse(readTrace("mp-trace.xml"), "application/json")
+		Expect(err).ToNot(Succeed())
+	})
+
+	It("should accept the configured roots", func() {
+		_, err := parseTrace(strings.NewReader("<Trace></Trace>"), "", "Trace", defaultTraceJSONRootKey)
+		Expect(err).To(Succeed())
+		_, err = parseTrace(strings.NewReader(`{"points":[]}`), "", defaultTraceXMLRoot, "")
+		Expect(err).To(Succeed())
+		_, err = parseTrace(strings.NewReader(`{"points":[`), "", defaultTraceXMLRoot, "")
+		Expect(err).ToNot(Succeed())
+
+		config.Set(configTraceValidation, traceValidationReject)
+		config.Set(configTraceXMLRoot, "Trace")
+		vs, err := newValidationStage()
+		Expect(err).To(Succeed())
+		Expect(vs.xmlRoot).To(Equal("Trace"))
+		Expect(vs.jsonRootKey).To(Equal(defaultTraceJSONRootKey))
+	})
+
+	It("should parse MP timestamps", func() {
+		t, err := parseMPTimestamp("19-10-26 10:15:30:042")
+		Expect(err).To(Succeed())
+		Expect(t).To(Equal(time.Date(2026, 10, 19, 10, 15, 30, 42000000, time.UTC)))
+	})
+
+	It("should fill in the metadata of buffered traces without overriding MP headers", func() {
+		config.Set(configTraceValidation, traceValidationReject)
+		vs, err := newValidationStage()
+		Expect(err).To(Succeed())
+		trace := readTrace("mp-trace.xml")
+		upload := &traceUpload{
+			sessionId: mustParseSessionId("org__env__app__rev__id"),
+			metadata:  blobCreationMetadata{StatusCode: 500},
+			body:      strings.NewReader(trace),
+		}
+		defer upload.close()
+		Expect(vs.process(upload)).To(Succeed())
+		Expect(upload.summary.StatusCode).To(Equal(404))
+		Expect(upload.metadata.StatusCode).To(Equal(500))
+		Expect(upload.metadata.URI).To(Equal("/v1/orders?limit=10"))
+		Expect(upload.metadata.Verb).To(Equal("GET"))
+		Expect(upload.metadata.DurationMs).To(Equal(int64(250)))
+
+		body, err := ioutil.ReadAll(upload.body)
+		Expect(err).To(Succeed())
+		Expect(string(body)).To(Equal(trace))
+	})
+
+	It("should summarize traces larger than the buffer once they are read", func() {
+		config.Set(configTraceValidation, traceValidationReject)
+		config.Set(configValidationBufferSize, 16)
+		vs, err := newValidationStage()
+		Expect(err).To(Succeed())
+		trace := readTrace("mp-trace.xml")
+		upload := &traceUpload{
+			sessionId: mustParseSessionId("org__env__app__rev__id"),
+			metadata:  blobCreationMetadata{StatusCode: 500},
+			body:      strings.NewReader(trace),
+		}
+		defer upload.close()
+		Expect(vs.process(upload)).To(Succeed())
+		Expect(upload.summary).To(BeNil())
+
+		body, err := ioutil.ReadAll(upload.body)
+		Expect(err).To(Succeed())
+		Expect(string(body)).To(Equal(trace))
+		Expect(upload.summary.StatusCode).To(Equal(404))
+		Expect(upload.metadata.StatusCode).To(Equal(500))
+		Expect(upload.metadata.URI).To(Equal("/v1/orders?limit=10"))
+		Expect(upload.metadata.Verb).To(Equal("GET"))
+		Expect(upload.metadata.DurationMs).To(Equal(int64(250)))
+	})
+
+	It("should validate traces larger than the buffered maximum as they stream", func() {
+		config.Set(configTraceValidation, traceValidationReject)
+		vs, err := newValidationStage()
+		Expect(err).To(Succeed())
+		points := bytes.Repeat([]byte(`<Point id="Execution"/>`), defaultMaxTraceSize/20)
+		upload := &traceUpload{
+			sessionId: mustParseSessionId("org__env__app__rev__id"),
+			body: io.MultiReader(strings.NewReader("<Completed>"), bytes.NewReader(points),
+				strings.NewReader("</Completed>")),
+		}
+		defer upload.close()
+		Expect(vs.process(upload)).To(Succeed())
+		n, err := io.Copy(ioutil.Discard, upload.body)
+		Expect(err).To(Succeed())
+		Expect(n).To(BeNumerically(">", defaultMaxTraceSize))
+	})
+
+	It("should fail reading a trace as soon as it is found malformed", func() {
+		config.Set(configTraceValidation, traceValidationReject)
+		vs, err := newValidationStage()
+		Expect(err).To(Succeed())
+		upload := &traceUpload{
+			sessionId: mustParseSessionId("org__env__app__rev__id"),
+			body:      io.MultiReader(strings.NewReader("<Other>"), io.LimitReader(blankReader{}, 1<<26)),
+		}
+		defer upload.close()
+		Expect(vs.process(upload)).To(Succeed())
+		n, err := io.Copy(ioutil.Discard, upload.body)
+		Expect(n).To(BeNumerically("<", 1<<26))
+		Expect(err).To(BeAssignableToTypeOf(&uploadError{}))
+		Expect(err.(*uploadError).code).To(Equal(API_ERR_MALFORMED_TRACE))
+	})
+
+	It("should not create a stage unless validation is turned on", func() {
+		vs, err := newValidationStage()
+		Expect(err).To(Succeed())
+		Expect(vs).To(BeNil())
+
+		config.Set(configTraceValidation, traceValidationOff)
+		vs, err = newValidationStage()
+		Expect(err).To(Succeed())
+		Expect(vs).To(BeNil())
+
+		config.Set(configTraceValidation, "sometimes")
+		_, err = newValidationStage()
+		Expect(err).ToNot(Succeed())
+	})
+
+	It("should keep a bounded number of quarantined traces", func() {
+		dir, err := ioutil.TempDir(testTempDirBase, "quarantine")
+		Expect(err).To(Succeed())
+		config.Set(configTraceValidation, traceValidationQuarantine)
+		config.Set(configQuarantineDir, dir)
+		config.Set(configQuarantineMaxFiles, 2)
+		vs, err := newValidationStage()
+		Expect(err).To(Succeed())
+
+		//buffered traces are rejected by the stage, larger ones when their body is read
+		streaming := *vs
+		streaming.bufferSize = 0
+		for i, stage := range []*validationStage{vs, &streaming, vs} {
+			upload := &traceUpload{
+				sessionId: mustParseSessionId("org__env__app__rev__id"),
+				body:      strings.NewReader("<Completed><Point>"),
+			}
+			err := stage.process(upload)
+			if stage == vs {
+				Expect(err).ToNot(Succeed(), "upload %d", i)
+			} else {
+				Expect(err).To(Succeed())
+				_, err = ioutil.ReadAll(upload.body)
+				Expect(err).ToNot(Succeed())
+			}
+			Expect(err.(*uploadError).code).To(Equal(API_ERR_MALFORMED_TRACE))
+			upload.close()
+		}
+		files, err := filepath.Glob(filepath.Join(dir, "*"))
+		Expect(err).To(Succeed())
+		Expect(files).To(HaveLen(2))
+		for _, file := range files {
+			data, err := ioutil.ReadFile(file)
+			Expect(err).To(Succeed())
+			Expect(string(data)).To(Equal("<Completed><Point>"))
+		}
+
+		//the copies of valid traces and of uploads which ended early are not kept
+		for _, trace := range []string{readTrace("mp-trace.json"), "<Completed>"} {
+			upload := &traceUpload{
+				sessionId: mustParseSessionId("org__env__app__rev__id"),
+				body:      strings.NewReader(trace),
+			}
+			Expect(streaming.process(upload)).To(Succeed())
+			if trace != "<Completed>" {
+				_, err = ioutil.ReadAll(upload.body)
+				Expect(err).To(Succeed())
+			}
+			upload.close()
+		}
+		Expect(vs.process(&traceUpload{body: strings.NewReader(readTrace("mp-trace.json"))})).To(Succeed())
+		files, err = filepath.Glob(filepath.Join(dir, "*"))
+		Expect(err).To(Succeed())
+		Expect(files).To(HaveLen(2))
+	})
+
+	Context("upload path", func() {
+		It("should send the extracted fields in the blob metadata and index them", func() {
+			config.Set(configTraceValidation, traceValidationReject)
+			vs, err := newValidationStage()
+			Expect(err).To(Succeed())
+			mockBsClient := mockBlobstoreClient{}
+			mockDbMan := mockDbManager{}
+			apiMan := apiManager{
+				dbMan:    &mockDbMan,
+				bsClient: &mockBsClient,
+				stages:   []uploadStage{vs},
+			}
+			mockBsClient.On("getSignedURL", mock.MatchedBy(func(metadata blobCreationMetadata) bool {
+				return metadata.URI == "/v1/orders" && metadata.Verb == "POST" && metadata.StatusCode == 201
+			}), defaultBlobServerRoute()).Return(&blobServerResponse{Id: "testblob", SignedUrl: "testurl"}, nil)
+			mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Return(&http.Response{StatusCode: 200}, nil)
+			mockDbMan.On("insertTraceRecord", mock.MatchedBy(func(record *traceRecord) bool {
+				return record.URI == "/v1/orders" && record.StatusCode == 201
+			})).Return(nil)
+
+			r := httptest.NewRequest("POST", "/uploadtrace", strings.NewReader(readTrace("mp-trace.json")))
+			r.Header.Add(UPLOAD_TRACESESSION_HEADER, "org__env__app__rev__testID")
+			w := httptest.NewRecorder()
+			apiMan.apiUploadTraceDataEndpoint(w, r)
+			Expect(w.Code).To(Equal(200))
+			mockBsClient.AssertExpectations(GinkgoT())
+			mockDbMan.AssertExpectations(GinkgoT())
+		})
+
+		It("should reject malformed traces", func() {
+			config.Set(configTraceValidation, traceValidationReject)
+			vs, err := newValidationStage()
+			Expect(err).To(Succeed())
+			mockBsClient := mockBlobstoreClient{}
+			apiMan := apiManager{bsClient: &mockBsClient, stages: []uploadStage{vs}}
+			mockBsClient.On("getSignedURL", mock.Anything, defaultBlobServerRoute()).Return(&blobServerResponse{Id: "testblob", SignedUrl: "testurl"}, nil)
+			mockBsClient.On("uploadToBlobstore", "testurl", mock.Anything).Return(&http.Response{StatusCode: 200}, nil)
+
+			r := httptest.NewRequest("POST", "/uploadtrace", strings.NewReader(`{"point":[`))
+			r.Header.Add(UPLOAD_TRACESESSION_HEADER, "org__env__app__rev__testID")
+			w := httptest.NewRecorder()
+			apiMan.apiUploadTraceDataEndpoint(w, r)
+			Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+			Expect(w.Body.String()).To(ContainSubstring("malformed trace"))
+		})
+	})
+})
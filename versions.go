@@ -0,0 +1,160 @@
+package apidGatewayTrace
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//apiVersionKey is the request context key holding the version of the API
+type apiVersionKey struct{}
+
+//apiVersion holds what differs between the versions of the MP-facing API.  The handlers are shared by all versions,
+//and look up the version of the request wherever its contract differs
+type apiVersion struct {
+	name string
+	//problemErrors sends every error as application/problem+json, rather than only when the client prefers it
+	problemErrors bool
+	//signalsVersion identifies a list of trace signals, as sent in the ETag header and expected in If-None-Match
+	signalsVersion func(signals []traceSignal) string
+	//signalsModified tells whether the trace signals differ from those the client identified with If-None-Match
+	signalsModified func(result getTraceSignalsResult, ifNoneMatch string) bool
+	//signalsBody is the response body sending the trace signals
+	signalsBody func(result getTraceSignalsResult) interface{}
+}
+
+//apiV1 is the original contract, also served on the unversioned routes deployed MPs use
+var apiV1 = &apiVersion{
+	name:            "v1",
+	signalsVersion:  signalsVersion,
+	signalsModified: additionOrDeletionDetected,
+	signalsBody: func(result getTraceSignalsResult) interface{} {
+		return result
+	},
+}
+
+//apiV2 sends opaque ETags, problem details for every error and trace signals describing their debug session
+var apiV2 = &apiVersion{
+	name:           "v2",
+	problemErrors:  true,
+	signalsVersion: signalsDigest,
+	signalsModified: func(result getTraceSignalsResult, ifNoneMatch string) bool {
+		return ifNoneMatch != signalsDigest(result.Signals)
+	},
+	signalsBody: newTraceSignalsResultV2,
+}
+
+//apiVersions lists the versions of the API, each registered under its name as a path prefix
+var apiVersions = []*apiVersion{apiV1, apiV2}
+
+//traceSignalsResultV2 is the list of active trace signals sent by version 2 of the API
+type traceSignalsResultV2 struct {
+	Signals     []traceSignalV2 `json:"signals"`
+	ETag        string          `json:"etag"`
+	GeneratedAt time.Time       `json:"generatedAt"`
+	Errors      []signalsError  `json:"errors"`
+}
+
+//traceSignalV2 is a trace signal along with the debug session and upload limits it carries, when there are any
+type traceSignalV2 struct {
+	Id           string        `json:"id"`
+	Uri          string        `json:"uri"`
+	Organization string        `json:"organization,omitempty"`
+	Environment  string        `json:"environment,omitempty"`
+	Proxy        string        `json:"proxy,omitempty"`
+	Revision     string        `json:"revision,omitempty"`
+	Session      string        `json:"session,omitempty"`
+	Limits       *signalLimits `json:"limits,omitempty"`
+}
+
+//signalLimits are the upload limits set by the query of a trace signal URI
+type signalLimits struct {
+	SampleRate *float64 `json:"sampleRate,omitempty"`
+	RateLimit  *float64 `json:"rateLimit,omitempty"`
+	RateBurst  *int     `json:"rateBurst,omitempty"`
+}
+
+//versioned serves a handler as the given version of the API
+func versioned(version *apiVersion, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r.WithContext(context.WithValue(r.Context(), apiVersionKey{}, version)))
+	}
+}
+
+//requestAPIVersion returns the version of the API a request was made to, version 1 unless it came through a
+//versioned route
+func requestAPIVersion(r *http.Request) *apiVersion {
+	if r != nil {
+		if version, ok := r.Context().Value(apiVersionKey{}).(*apiVersion); ok {
+			return version
+		}
+	}
+	return apiV1
+}
+
+//versionedPath is the route of an endpoint in a version of the API
+func versionedPath(version *apiVersion, endpoint string) string {
+	return "/" + version.name + endpoint
+}
+
+//signalsDigest identifies a list of trace signals by a hash of their ids and URIs, which clients must not interpret
+func signalsDigest(signals []traceSignal) string {
+	hash := sha256.New()
+	for _, signal := range signals {
+		hash.Write([]byte(signal.Id + "\x00" + signal.Uri + "\x00"))
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:32]
+}
+
+//newTraceSignalsResultV2 describes the trace signals for version 2 of the API
+func newTraceSignalsResultV2(result getTraceSignalsResult) interface{} {
+	v2 := traceSignalsResultV2{
+		Signals:     make([]traceSignalV2, len(result.Signals)),
+		ETag:        signalsDigest(result.Signals),
+		GeneratedAt: result.GeneratedAt,
+		Errors:      make([]signalsError, 0),
+	}
+	for i, signal := range result.Signals {
+		v2.Signals[i] = newTraceSignalV2(signal)
+	}
+	if result.Error != nil {
+		v2.Errors = append(v2.Errors, *result.Error)
+	}
+	return v2
+}
+
+//newTraceSignalV2 describes a trace signal.  Signals keyed by a full debug session id carry its components
+func newTraceSignalV2(signal traceSignal) traceSignalV2 {
+	v2 := traceSignalV2{Id: signal.Id, Uri: signal.Uri}
+	if strings.Contains(signal.Id, sessionIdV1Separator) {
+		if id, err := parseDebugSessionId(signal.Id); err == nil {
+			v2.Organization = id.Organization
+			v2.Environment = id.Environment
+			v2.Proxy = id.Proxy
+			v2.Revision = id.Revision
+			v2.Session = id.Session
+		}
+	}
+	if u, err := url.Parse(signal.Uri); err == nil {
+		query := u.Query()
+		var limits signalLimits
+		if v, err := strconv.ParseFloat(query.Get(signalParamSampleRate), 64); err == nil {
+			limits.SampleRate = &v
+		}
+		if v, err := strconv.ParseFloat(query.Get(signalParamRateLimit), 64); err == nil {
+			limits.RateLimit = &v
+		}
+		if v, err := strconv.Atoi(query.Get(signalParamRateBurst)); err == nil {
+			limits.RateBurst = &v
+		}
+		if limits != (signalLimits{}) {
+			v2.Limits = &limits
+		}
+	}
+	return v2
+}
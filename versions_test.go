@@ -0,0 +1,110 @@
+package apidGatewayTrace
+
+import (
+	"encoding/json"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+var _ = Describe("API versions", func() {
+
+	It("should serve each version on its own routes", func() {
+		prefix := "/versions"
+		apiMan := &apiManager{
+			signalEndpoint:       prefix + signalEndpoint,
+			uploadEndpoint:       prefix + uploadEndpoint,
+			transactionsEndpoint: prefix + transactionsEndpoint,
+			sessionEndpoint:      prefix + sessionEndpoint,
+			newSignal:            make(chan interface{}),
+			addSubscriber:        make(chan chan interface{}),
+		}
+		apiMan.registerAPI()
+
+		contentTypes := map[string]string{
+			prefix + signalEndpoint:                     "application/json",
+			versionedPath(apiV1, prefix+signalEndpoint): "application/json",
+			versionedPath(apiV2, prefix+signalEndpoint): problemContentType,
+			versionedPath(apiV2, prefix+uploadEndpoint): problemContentType,
+		}
+		for path, contentType := range contentTypes {
+			method := "GET"
+			if path == versionedPath(apiV2, prefix+uploadEndpoint) {
+				method = "POST"
+			}
+			w := httptest.NewRecorder()
+			services.API().Router().ServeHTTP(w, httptest.NewRequest(method, path, nil))
+			Expect(w.Code).To(Equal(http.StatusServiceUnavailable), path)
+			Expect(w.Header().Get("Content-Type")).To(Equal(contentType), path)
+		}
+	})
+
+	It("should send problem details for every v2 error", func() {
+		r := httptest.NewRequest("GET", signalEndpoint+"?block=abc", nil)
+		r.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		versioned(apiV2, (&apiManager{}).apiGetTraceSignalEndpoint)(w, r)
+		Expect(w.Code).To(Equal(http.StatusBadRequest))
+		Expect(w.Header().Get("Content-Type")).To(Equal(problemContentType))
+		Expect(requestAPIVersion(r)).To(Equal(apiV1))
+	})
+
+	It("should identify the signals by an opaque ETag in v2", func() {
+		signals := []traceSignal{{Id: "1", Uri: "uri1"}, {Id: "2", Uri: "uri2"}}
+		dbMan := &mockDbManager{}
+		dbMan.On("getTraceSignals").Return(getTraceSignalsResult{Signals: signals, Version: "1,2"}, nil)
+		apiMan := &apiManager{dbMan: dbMan}
+		get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest("GET", signalEndpoint, nil)
+			r.Header.Set("If-None-Match", ifNoneMatch)
+			w := httptest.NewRecorder()
+			versioned(apiV2, apiMan.apiGetTraceSignalEndpoint)(w, r)
+			return w
+		}
+
+		etag := `"` + signalsDigest(signals) + `"`
+		Expect(get("1,2").Code).To(Equal(http.StatusOK))
+		w := get(etag)
+		Expect(w.Code).To(Equal(http.StatusNotModified))
+		Expect(w.Header().Get("ETag")).To(Equal(etag))
+
+		Expect(signalsDigest(signals)).ToNot(Equal(signalsDigest([]traceSignal{{Id: "1", Uri: "uri1?sampleRate=0.5"}, {Id: "2", Uri: "uri2"}})))
+		Expect(signalsDigest(signals)).ToNot(Equal(signalsDigest(signals[:1])))
+	})
+
+	It("should describe the debug session and limits of v2 signals", func() {
+		generatedAt := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+		result := newTraceSignalsResultV2(getTraceSignalsResult{
+			Signals: []traceSignal{
+				{Id: "org__env__proxy__rev__session", Uri: "uri?sampleRate=0.5&rateBurst=3&rateLimit=bad"},
+				{Id: "session", Uri: "uri"},
+			},
+			GeneratedAt: generatedAt,
+			Error:       &signalsError{Code: signalsErrorSkipped, Message: "skipped", Skipped: 2},
+		}).(traceSignalsResultV2)
+
+		sampleRate, burst := 0.5, 3
+		Expect(result.Signals).To(Equal([]traceSignalV2{
+			{
+				Id:           "org__env__proxy__rev__session",
+				Uri:          "uri?sampleRate=0.5&rateBurst=3&rateLimit=bad",
+				Organization: "org",
+				Environment:  "env",
+				Proxy:        "proxy",
+				Revision:     "rev",
+				Session:      "session",
+				Limits:       &signalLimits{SampleRate: &sampleRate, RateBurst: &burst},
+			},
+			{Id: "session", Uri: "uri"},
+		}))
+		Expect(result.GeneratedAt).To(Equal(generatedAt))
+		Expect(result.Errors).To(Equal([]signalsError{{Code: signalsErrorSkipped, Message: "skipped", Skipped: 2}}))
+
+		b, err := json.Marshal(newTraceSignalsResultV2(getTraceSignalsResult{}))
+		Expect(err).To(Succeed())
+		Expect(string(b)).To(ContainSubstring(`"signals":[]`))
+		Expect(string(b)).To(ContainSubstring(`"errors":[]`))
+	})
+})